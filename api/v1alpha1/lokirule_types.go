@@ -21,18 +21,34 @@ import (
 )
 
 type RuleGroup struct {
-	Name  string `json:"name,omitempty" yaml:"name,omitempty"`
-	Rules []Rule `json:"rules,omitempty" yaml:"rules,omitempty"`
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Interval is how often the rules of the group are evaluated, defaults to the ruler evaluation interval
+	// +kubebuilder:validation:Pattern="^(0|(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$"
+	Interval string `json:"interval,omitempty" yaml:"interval,omitempty"`
+	// Limit is the number of alerts an alerting rule and series a recording rule can produce, 0 is no limit
+	// +kubebuilder:validation:Minimum=0
+	Limit int `json:"limit,omitempty" yaml:"limit,omitempty"`
+	// QueryOffset is the duration by which rule evaluation is delayed
+	// +kubebuilder:validation:Pattern="^(0|(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$"
+	QueryOffset string `json:"queryOffset,omitempty" yaml:"query_offset,omitempty"`
+	// SourceTenants are the tenants queried by the rules of the group, for federated rule groups
+	SourceTenants []string `json:"sourceTenants,omitempty" yaml:"source_tenants,omitempty"`
+	Rules         []Rule   `json:"rules,omitempty" yaml:"rules,omitempty"`
 }
 
 // Rule defines a rule for a LokiRule
 type Rule struct {
-	Alert       string            `json:"alert,omitempty" yaml:"alert,omitempty"`
-	Record      string            `json:"record,omitempty" yaml:"record,omitempty"`
-	Expr        string            `json:"expr,omitempty" yaml:"expr"`
-	For         string            `json:"for,omitempty" yaml:"for,omitempty"`
-	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
-	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	Alert  string `json:"alert,omitempty" yaml:"alert,omitempty"`
+	Record string `json:"record,omitempty" yaml:"record,omitempty"`
+	Expr   string `json:"expr,omitempty" yaml:"expr"`
+	// For is how long an alert must be pending before firing
+	// +kubebuilder:validation:Pattern="^(0|(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$"
+	For string `json:"for,omitempty" yaml:"for,omitempty"`
+	// KeepFiringFor is how long an alert keeps firing after its condition cleared
+	// +kubebuilder:validation:Pattern="^(0|(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$"
+	KeepFiringFor string            `json:"keepFiringFor,omitempty" yaml:"keep_firing_for,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
 }
 
 // LokiRuleSpec defines the desired state of LokiRule
@@ -42,10 +58,76 @@ type LokiRuleSpec struct {
 	Groups []RuleGroup `json:"groups,omitempty" yaml:"groups"`
 }
 
+const (
+	// ConditionAccepted reports whether the LokiRule was written to the rules ConfigMap
+	ConditionAccepted = "Accepted"
+	// ConditionQuarantined reports whether the LokiRule failed validation and was kept out of the rules ConfigMap
+	ConditionQuarantined = "Quarantined"
+	// ConditionLoaded reports whether the Loki ruler loaded the rule groups of the LokiRule
+	ConditionLoaded = "Loaded"
+
+	ReasonAccepted         = "Accepted"
+	ReasonQuotaExceeded    = "QuotaExceeded"
+	ReasonInvalidRule      = "InvalidRule"
+	ReasonValidRule        = "ValidRule"
+	ReasonRuleFileConflict = "RuleFileConflict"
+	ReasonLokiUnavailable  = "LokiUnavailable"
+	ReasonRulesLoaded      = "RulesLoaded"
+	ReasonLoadPending      = "LoadPending"
+	ReasonRulesNotLoaded   = "RulesNotLoaded"
+)
+
+const (
+	// RuleHealthOK is the health of a rule the Loki ruler last evaluated successfully
+	RuleHealthOK = "ok"
+	// RuleHealthErr is the health of a rule whose last evaluation by the Loki ruler failed
+	RuleHealthErr = "err"
+	// RuleHealthUnknown is the health of a rule the Loki ruler has not evaluated yet
+	RuleHealthUnknown = "unknown"
+)
+
+// RuleStatus is the state of a rule of the LokiRule as evaluated by the Loki ruler
+type RuleStatus struct {
+	// Group is the name of the rule group of the rule
+	Group string `json:"group"`
+	// Name is the alert or record name of the rule
+	Name string `json:"name"`
+	// Health of the rule at its last evaluation
+	// +kubebuilder:validation:Enum=ok;err;unknown
+	Health string `json:"health"`
+	// LastError is the error of the last evaluation of the rule
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+	// LastEvaluation is when the rule was last evaluated
+	// +optional
+	LastEvaluation *metav1.Time `json:"lastEvaluation,omitempty"`
+	// PendingAlerts is the number of pending alerts of an alerting rule
+	// +optional
+	PendingAlerts int32 `json:"pendingAlerts,omitempty"`
+	// FiringAlerts is the number of firing alerts of an alerting rule
+	// +optional
+	FiringAlerts int32 `json:"firingAlerts,omitempty"`
+}
+
 // LokiRuleStatus defines the observed state of LokiRule
 type LokiRuleStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Conditions describe the current state of the LokiRule
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// LastAppliedGeneration is the generation of the LokiRule last written to the rules ConfigMap
+	// +optional
+	LastAppliedGeneration int64 `json:"lastAppliedGeneration,omitempty"`
+
+	// LastAppliedSpecHash is the hash of the spec last written to the rules ConfigMap
+	// +optional
+	LastAppliedSpecHash string `json:"lastAppliedSpecHash,omitempty"`
+
+	// Rules is the state of every rule of the LokiRule, as last read from the Loki ruler
+	// +optional
+	Rules []RuleStatus `json:"rules,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -0,0 +1,151 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// InputStream is a synthetic log stream the rules are evaluated against
+type InputStream struct {
+	// Labels are the labels of the stream
+	Labels map[string]string `json:"labels" yaml:"labels"`
+	// Entries are the log lines of the stream
+	Entries []InputEntry `json:"entries,omitempty" yaml:"entries,omitempty"`
+}
+
+// InputEntry is a log line of an InputStream
+type InputEntry struct {
+	// At is the time of the entry, from the start of the test
+	// +kubebuilder:validation:Pattern="^(0|(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$"
+	At   string `json:"at" yaml:"at"`
+	Line string `json:"line" yaml:"line"`
+	// Repeat is how many more times the entry is logged, every Interval
+	// +kubebuilder:validation:Minimum=0
+	Repeat int `json:"repeat,omitempty" yaml:"repeat,omitempty"`
+	// Interval is the time between repetitions of the entry
+	// +kubebuilder:validation:Pattern="^(0|(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$"
+	Interval string `json:"interval,omitempty" yaml:"interval,omitempty"`
+}
+
+// ExpectedAlert is an alert expected to be firing
+type ExpectedAlert struct {
+	// ExpLabels are the labels of the alert, including the labels of the rule
+	ExpLabels map[string]string `json:"expLabels,omitempty" yaml:"exp_labels,omitempty"`
+	// ExpAnnotations are the expanded annotations of the alert
+	ExpAnnotations map[string]string `json:"expAnnotations,omitempty" yaml:"exp_annotations,omitempty"`
+}
+
+// AlertRuleTest checks the alerts firing at a given time
+type AlertRuleTest struct {
+	// EvalTime is the time the alerts are checked at, from the start of the test
+	// +kubebuilder:validation:Pattern="^(0|(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$"
+	EvalTime string `json:"evalTime" yaml:"eval_time"`
+	// Alertname is the name of the alerting rule tested
+	Alertname string `json:"alertname" yaml:"alertname"`
+	// ExpAlerts are the alerts expected to be firing, none when empty
+	ExpAlerts []ExpectedAlert `json:"expAlerts,omitempty" yaml:"exp_alerts,omitempty"`
+}
+
+// ExpectedSample is a sample expected to be recorded
+type ExpectedSample struct {
+	// Labels are the labels of the sample, including the labels of the rule
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	// Value is the value of the sample
+	// +kubebuilder:validation:Pattern="^[-+]?([0-9]*[.])?[0-9]+([eE][-+]?[0-9]+)?$"
+	Value string `json:"value" yaml:"value"`
+}
+
+// RecordingRuleTest checks the samples recorded at a given time
+type RecordingRuleTest struct {
+	// EvalTime is the time the samples are checked at, from the start of the test
+	// +kubebuilder:validation:Pattern="^(0|(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$"
+	EvalTime string `json:"evalTime" yaml:"eval_time"`
+	// Record is the name of the recording rule tested
+	Record string `json:"record" yaml:"record"`
+	// ExpSamples are the samples expected to be recorded, none when empty
+	ExpSamples []ExpectedSample `json:"expSamples,omitempty" yaml:"exp_samples,omitempty"`
+}
+
+// LokiRuleTestSpec defines the desired state of LokiRuleTest
+type LokiRuleTestSpec struct {
+	// LokiRuleName is the name of the LokiRule tested, in the namespace of the LokiRuleTest
+	LokiRuleName string `json:"lokiRuleName" yaml:"loki_rule_name"`
+	// EvaluationInterval is how often rule groups without an interval are evaluated, defaults to 1m
+	// +kubebuilder:validation:Pattern="^(0|(([0-9]+)y)?(([0-9]+)w)?(([0-9]+)d)?(([0-9]+)h)?(([0-9]+)m)?(([0-9]+)s)?(([0-9]+)ms)?)$"
+	EvaluationInterval string `json:"evaluationInterval,omitempty" yaml:"evaluation_interval,omitempty"`
+	// InputStreams are the log streams the rules are evaluated against
+	InputStreams []InputStream `json:"inputStreams,omitempty" yaml:"input_streams,omitempty"`
+	// AlertRuleTests check the alerts firing
+	AlertRuleTests []AlertRuleTest `json:"alertRuleTests,omitempty" yaml:"alert_rule_tests,omitempty"`
+	// RecordingRuleTests check the samples recorded
+	RecordingRuleTests []RecordingRuleTest `json:"recordingRuleTests,omitempty" yaml:"recording_rule_tests,omitempty"`
+}
+
+const (
+	// ConditionPassed reports whether the rules of the LokiRule passed the tests
+	ConditionPassed = "Passed"
+
+	ReasonTestsPassed      = "TestsPassed"
+	ReasonTestsFailed      = "TestsFailed"
+	ReasonInvalidTest      = "InvalidTest"
+	ReasonLokiRuleNotFound = "LokiRuleNotFound"
+)
+
+// LokiRuleTestStatus defines the observed state of LokiRuleTest
+type LokiRuleTestStatus struct {
+	// Conditions describe the result of the tests
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Failures describe every failed test
+	// +optional
+	Failures []string `json:"failures,omitempty"`
+
+	// TestedSpecHash is the spec hash of the LokiRule tested
+	// +optional
+	TestedSpecHash string `json:"testedSpecHash,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="LokiRule",type=string,JSONPath=`.spec.lokiRuleName`
+//+kubebuilder:printcolumn:name="Passed",type=string,JSONPath=`.status.conditions[?(@.type=="Passed")].status`
+
+// LokiRuleTest is the Schema for the lokiRuleTests API
+type LokiRuleTest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LokiRuleTestSpec   `json:"spec,omitempty"`
+	Status LokiRuleTestStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// LokiRuleTestList contains a list of LokiRuleTest
+type LokiRuleTestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []LokiRuleTest `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&LokiRuleTest{}, &LokiRuleTestList{})
+}
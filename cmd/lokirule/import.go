@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+// lokiRuleManifest is a LokiRule without its status and server populated
+// metadata, as written by import.
+type lokiRuleManifest struct {
+	metav1.TypeMeta `json:",inline"`
+	Metadata        struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Labels    map[string]string `json:"labels,omitempty"`
+	} `json:"metadata"`
+	Spec querocomv1alpha1.LokiRuleSpec `json:"spec"`
+}
+
+func marshalLokiRule(rule *querocomv1alpha1.LokiRule) ([]byte, error) {
+	manifest := lokiRuleManifest{TypeMeta: rule.TypeMeta, Spec: rule.Spec}
+	manifest.Metadata.Name = rule.Name
+	manifest.Metadata.Namespace = rule.Namespace
+	manifest.Metadata.Labels = rule.Labels
+
+	return sigsyaml.Marshal(manifest)
+}
+
+// importFile converts the rule files and PrometheusRules of a file into
+// LokiRules. A rule file read from stdin is named name.
+func importFile(r io.Reader, file, name, namespace string) ([]*querocomv1alpha1.LokiRule, error) {
+	reader := yaml.NewYAMLReader(bufio.NewReader(r))
+
+	var rules []*querocomv1alpha1.LokiRule
+	ruleFiles := 0
+	for i := 0; ; i++ {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return rules, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.TrimSpace(string(doc)) == "" {
+			continue
+		}
+
+		typeMeta := metav1.TypeMeta{}
+		if err := sigsyaml.Unmarshal(doc, &typeMeta); err != nil {
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+
+		var rule *querocomv1alpha1.LokiRule
+		switch {
+		case typeMeta.GroupVersionKind().Group == lokirule.PrometheusRuleGroup && typeMeta.Kind == "PrometheusRule":
+			rule, err = lokirule.ImportPrometheusRule(doc, namespace)
+		case typeMeta.APIVersion == "" && typeMeta.Kind == "":
+			// Rule files are named after their file, which only fits one.
+			ruleFiles++
+			if ruleFiles > 1 {
+				return nil, fmt.Errorf("document %d: only one rule file is supported per file", i)
+			}
+			if file == "-" {
+				file = name
+			}
+			rule, err = lokirule.ImportRuleFile(file, doc, namespace)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+
+		rules = append(rules, rule)
+	}
+}
+
+func (c *command) importRules(args []string) error {
+	var namespace string
+	var name string
+	var outputDir string
+
+	fs := flag.NewFlagSet("lokirule import", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.StringVar(
+		&namespace,
+		"namespace",
+		"default",
+		"The namespace of the LokiRules, PrometheusRules keep their own when they set one.",
+	)
+	fs.StringVar(
+		&name,
+		"name",
+		"",
+		"The name of the LokiRule imported from a rule file read from stdin.",
+	)
+	fs.StringVar(
+		&outputDir,
+		"output-dir",
+		"",
+		"Directory the LokiRule manifests are written to, as <namespace>-<name>.yaml, instead of stdout.",
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	files, err := manifestFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	rules := map[string]*querocomv1alpha1.LokiRule{}
+	for _, file := range files {
+		var r io.Reader = c.stdin
+		source := "stdin"
+		if file != "-" {
+			source = file
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			r = bytes.NewReader(content)
+		} else if name == "" {
+			name = "stdin"
+		}
+
+		imported, err := importFile(r, file, name, namespace)
+		if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+
+		for _, rule := range imported {
+			key := rule.Namespace + "/" + rule.Name
+			if _, ok := rules[key]; ok {
+				return fmt.Errorf("%s: LokiRule %s imported twice, rename the file", source, key)
+			}
+			rules[key] = rule
+		}
+	}
+
+	keys := make([]string, 0, len(rules))
+	for key := range rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		rule := rules[key]
+
+		manifest, err := marshalLokiRule(rule)
+		if err != nil {
+			return err
+		}
+
+		if outputDir != "" {
+			fileName := fmt.Sprintf("%s-%s.yaml", rule.Namespace, rule.Name)
+			if err := os.WriteFile(filepath.Join(outputDir, fileName), manifest, 0o644); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if i > 0 {
+			fmt.Fprintln(c.stdout, "---")
+		}
+		fmt.Fprintf(c.stdout, "%s", manifest)
+	}
+
+	return nil
+}
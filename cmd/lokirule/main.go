@@ -0,0 +1,515 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command lokirule lints, renders, diffs and tests LokiRule manifests without
+// a cluster, running the same validation and rendering as the operator, and
+// imports existing rule files and PrometheusRules as LokiRules.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/flags"
+	httputil "github.com/quero-edu/loki-rule-operator/internal/http"
+	"github.com/quero-edu/loki-rule-operator/pkg/controllers"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const usage = `Usage: lokirule <command> [flags] [file|directory|-]...
+
+Reads LokiRule manifests from the files, the YAML files of the directories, or
+stdin when none is given.
+
+Commands:
+  lint    validate the LokiRules as the operator does
+  render  print the rule files the operator writes to the rules ConfigMap
+  diff    diff the rendered rule files against a ConfigMap or a directory
+  test    run the LokiRuleTests against the LokiRules
+  import  convert rule files and PrometheusRules into LokiRule manifests
+
+Run 'lokirule <command> -h' for the flags of a command.
+`
+
+// errFailed reports that the command ran but found problems, its output
+// already describes them.
+var errFailed = errors.New("failed")
+
+// commonFlags are the flags of every command.
+type commonFlags struct {
+	namespace          string
+	ruleNamespaceLabel string
+	ruleNameLabel      string
+	ruleCopyLabels     flags.ArrayFlags
+	ruleFileTemplate   string
+}
+
+func (c *commonFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(
+		&c.namespace,
+		"namespace",
+		"default",
+		"The namespace of the manifests that do not set one.",
+	)
+	fs.StringVar(
+		&c.ruleNamespaceLabel,
+		"rule-namespace-label",
+		"",
+		"Same as the operator flag, label added to every rule with the namespace of its LokiRule.",
+	)
+	fs.StringVar(
+		&c.ruleNameLabel,
+		"rule-name-label",
+		"",
+		"Same as the operator flag, label added to every rule with the name of its LokiRule.",
+	)
+	fs.Var(
+		&c.ruleCopyLabels,
+		"rule-copy-label",
+		"Same as the operator flag, LokiRule label key copied into every rule. May be repeated.",
+	)
+	fs.StringVar(
+		&c.ruleFileTemplate,
+		"rule-file-name-template",
+		lokirule.DefaultFileNameTemplate,
+		"Same as the operator flag, template of the rule file names.",
+	)
+}
+
+func (c *commonFlags) ruleOptions() lokirule.Options {
+	return lokirule.Options{
+		NamespaceLabel:   c.ruleNamespaceLabel,
+		NameLabel:        c.ruleNameLabel,
+		CopyLabels:       c.ruleCopyLabels,
+		FileNameTemplate: c.ruleFileTemplate,
+	}
+}
+
+type command struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	cmd := &command{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}
+
+	err := cmd.run(os.Args[1:])
+	switch {
+	case err == nil:
+	case errors.Is(err, errFailed):
+		os.Exit(1)
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(2)
+	default:
+		fmt.Fprintf(os.Stderr, "lokirule: %s\n", err)
+		os.Exit(2)
+	}
+}
+
+func (c *command) run(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(c.stderr, usage)
+		return flag.ErrHelp
+	}
+
+	switch args[0] {
+	case "lint":
+		return c.lint(args[1:])
+	case "render":
+		return c.render(args[1:])
+	case "diff":
+		return c.diff(args[1:])
+	case "test":
+		return c.test(args[1:])
+	case "import":
+		return c.importRules(args[1:])
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(c.stdout, usage)
+		return nil
+	}
+
+	fmt.Fprint(c.stderr, usage)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func (c *command) newFlagSet(name string, common *commonFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet("lokirule "+name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	common.register(fs)
+	return fs
+}
+
+func (c *command) lint(args []string) error {
+	common := &commonFlags{}
+	var lokiURL string
+	var lokiHeaders flags.ArrayFlags
+
+	fs := c.newFlagSet("lint", common)
+	fs.StringVar(
+		&lokiURL,
+		"loki-url",
+		"",
+		"Loki server URL. When set, expressions are also validated by Loki as the operator does.",
+	)
+	fs.Var(
+		&lokiHeaders,
+		"loki-header",
+		"Extra header that will be sent to Loki. Format KEY=VALUE. May be repeated.",
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	m, err := readManifests(fs.Args(), c.stdin, common.namespace)
+	if err != nil {
+		return err
+	}
+
+	var lokiClient *http.Client
+	if lokiURL != "" {
+		if _, err := lokiHeaders.Split("="); err != nil {
+			return err
+		}
+		lokiClient = httputil.ClientWithHeaders(&lokiHeaders)
+	}
+
+	failed := false
+	for _, rule := range m.rules {
+		name := rule.Namespace + "/" + rule.Name
+
+		_, err := lokirule.GenerateRuleConfigMapFile(rule, common.ruleOptions())
+		if err == nil && lokiClient != nil {
+			err = validateLogQL(context.Background(), lokiClient, lokiURL, ruleExprs(rule))
+		}
+
+		if err != nil {
+			failed = true
+			fmt.Fprintf(c.stdout, "%s: invalid\n  %s\n", name, strings.ReplaceAll(err.Error(), "\n", "\n  "))
+			continue
+		}
+		fmt.Fprintf(c.stdout, "%s: ok\n", name)
+	}
+
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+func ruleExprs(rule *querocomv1alpha1.LokiRule) []string {
+	var exprs []string
+	for _, group := range rule.Spec.Groups {
+		for _, r := range group.Rules {
+			exprs = append(exprs, r.Expr)
+		}
+	}
+	return exprs
+}
+
+func validateLogQL(ctx context.Context, lokiClient *http.Client, lokiURL string, exprs []string) error {
+	var errs []error
+
+	for _, expr := range exprs {
+		valid, err := controllers.ValidateLogQLOnServerFunc(ctx, lokiClient, lokiURL, expr)
+		if err != nil {
+			return fmt.Errorf("failed to send request to Loki server: %w", err)
+		}
+		if !valid {
+			errs = append(errs, fmt.Errorf("%q is not a valid LogQL query", expr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// renderRuleFiles renders the rule files of the LokiRules, keyed by file name.
+func renderRuleFiles(m *manifests, options lokirule.Options) (map[string]string, error) {
+	ruleFiles := map[string]string{}
+
+	for _, rule := range m.rules {
+		ruleFile, err := lokirule.GenerateRuleConfigMapFile(rule, options)
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", rule.Namespace, rule.Name, err)
+		}
+
+		for fileName, content := range ruleFile {
+			if _, ok := ruleFiles[fileName]; ok {
+				return nil, fmt.Errorf("%s/%s: rule file %s rendered twice", rule.Namespace, rule.Name, fileName)
+			}
+			ruleFiles[fileName] = content
+		}
+	}
+
+	return ruleFiles, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *command) render(args []string) error {
+	common := &commonFlags{}
+	var outputDir string
+
+	fs := c.newFlagSet("render", common)
+	fs.StringVar(
+		&outputDir,
+		"output-dir",
+		"",
+		"Directory the rule files are written to, instead of stdout.",
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	m, err := readManifests(fs.Args(), c.stdin, common.namespace)
+	if err != nil {
+		return err
+	}
+
+	ruleFiles, err := renderRuleFiles(m, common.ruleOptions())
+	if err != nil {
+		return err
+	}
+
+	for i, fileName := range sortedKeys(ruleFiles) {
+		if outputDir != "" {
+			if err := os.WriteFile(filepath.Join(outputDir, fileName), []byte(ruleFiles[fileName]), 0o644); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if i > 0 {
+			fmt.Fprintln(c.stdout, "---")
+		}
+		fmt.Fprintf(c.stdout, "# Source: %s\n%s", fileName, ruleFiles[fileName])
+	}
+
+	return nil
+}
+
+// liveRuleFiles reads the rule files of a ConfigMap, given as namespace/name.
+func liveRuleFiles(ctx context.Context, kubeconfig, kubeContext, configMap string) (map[string]string, error) {
+	namespace, name, ok := strings.Cut(configMap, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid ConfigMap %q, expected namespace/name", configMap)
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules,
+		&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+	).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := client.New(config, client.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &corev1.ConfigMap{}
+	err = cli.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, cm)
+	if apierrors.IsNotFound(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cm.Data, nil
+}
+
+// dirRuleFiles reads the rule files of a directory.
+func dirRuleFiles(dir string, fileNames []string) (map[string]string, error) {
+	ruleFiles := map[string]string{}
+
+	for _, fileName := range fileNames {
+		content, err := os.ReadFile(filepath.Join(dir, fileName))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ruleFiles[fileName] = string(content)
+	}
+
+	return ruleFiles, nil
+}
+
+func (c *command) diff(args []string) error {
+	common := &commonFlags{}
+	var configMap string
+	var dir string
+	var kubeconfig string
+	var kubeContext string
+
+	fs := c.newFlagSet("diff", common)
+	fs.StringVar(
+		&configMap,
+		"configmap",
+		"",
+		"The rules ConfigMap to diff against, as namespace/name.",
+	)
+	fs.StringVar(
+		&dir,
+		"dir",
+		"",
+		"The directory of rule files to diff against.",
+	)
+	fs.StringVar(
+		&kubeconfig,
+		"kubeconfig",
+		"",
+		"Path to the kubeconfig file, defaults to $KUBECONFIG or ~/.kube/config.",
+	)
+	fs.StringVar(
+		&kubeContext,
+		"context",
+		"",
+		"The kubeconfig context to use.",
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if (configMap == "") == (dir == "") {
+		return fmt.Errorf("exactly one of -configmap and -dir must be set")
+	}
+
+	m, err := readManifests(fs.Args(), c.stdin, common.namespace)
+	if err != nil {
+		return err
+	}
+
+	rendered, err := renderRuleFiles(m, common.ruleOptions())
+	if err != nil {
+		return err
+	}
+
+	var current map[string]string
+	prefix := dir
+	if configMap != "" {
+		prefix = configMap
+		current, err = liveRuleFiles(context.Background(), kubeconfig, kubeContext, configMap)
+	} else {
+		current, err = dirRuleFiles(dir, sortedKeys(rendered))
+	}
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, fileName := range sortedKeys(rendered) {
+		currentName := filepath.Join(prefix, fileName)
+		if _, ok := current[fileName]; !ok {
+			currentName = "/dev/null"
+		}
+
+		diff := unifiedDiff(currentName, fileName, current[fileName], rendered[fileName])
+		if diff != "" {
+			changed = true
+			fmt.Fprint(c.stdout, diff)
+		}
+	}
+
+	if changed {
+		return errFailed
+	}
+	return nil
+}
+
+func runTest(rules map[string]lokirule.RuleGroups, test *querocomv1alpha1.LokiRuleTest) error {
+	ruleGroups, ok := rules[test.Namespace+"/"+test.Spec.LokiRuleName]
+	if !ok {
+		return fmt.Errorf("LokiRule %q not found in the manifests", test.Spec.LokiRuleName)
+	}
+
+	ruleTest, err := lokirule.ToRuleTest(test)
+	if err != nil {
+		return err
+	}
+
+	return ruleTest.Run(ruleGroups)
+}
+
+func (c *command) test(args []string) error {
+	common := &commonFlags{}
+
+	fs := c.newFlagSet("test", common)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	m, err := readManifests(fs.Args(), c.stdin, common.namespace)
+	if err != nil {
+		return err
+	}
+
+	rules := map[string]lokirule.RuleGroups{}
+	for _, rule := range m.rules {
+		ruleGroups, err := lokirule.ToRuleGroups(rule, lokirule.Options{})
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", rule.Namespace, rule.Name, err)
+		}
+		rules[rule.Namespace+"/"+rule.Name] = ruleGroups
+	}
+
+	failed := false
+	for _, test := range m.tests {
+		name := test.Namespace + "/" + test.Name
+
+		err := runTest(rules, test)
+		if err != nil {
+			failed = true
+			fmt.Fprintf(c.stdout, "%s: FAILED\n", name)
+			for _, failure := range lokirule.Failures(err) {
+				fmt.Fprintf(c.stdout, "  %s\n", strings.ReplaceAll(failure, "\n", "\n  "))
+			}
+			continue
+		}
+		fmt.Fprintf(c.stdout, "%s: SUCCESS\n", name)
+	}
+
+	if failed {
+		return errFailed
+	}
+	return nil
+}
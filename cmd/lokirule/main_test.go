@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testManifests = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+---
+apiVersion: quero.com/v1alpha1
+kind: LokiRule
+metadata:
+  name: errors
+spec:
+  groups:
+    - name: errors
+      rules:
+        - record: app:errors:count1m
+          expr: sum by (app) (count_over_time({app="api"} |= "error" [1m]))
+---
+apiVersion: quero.com/v1alpha1
+kind: LokiRuleTest
+metadata:
+  name: errors-test
+spec:
+  lokiRuleName: errors
+  inputStreams:
+    - labels:
+        app: api
+      entries:
+        - at: 10s
+          line: error
+  recordingRuleTests:
+    - evalTime: 1m
+      record: app:errors:count1m
+      expSamples:
+        - labels:
+            app: api
+          value: "1"
+`
+
+const testRuleFile = `groups:
+- name: errors
+  rules:
+  - record: app:errors:count1m
+    expr: sum by (app) (count_over_time({app="api"} |= "error" [1m]))
+`
+
+func runCommand(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	cmd := &command{stdin: strings.NewReader(stdin), stdout: &stdout, stderr: &stderr}
+
+	err := cmd.run(args)
+	return stdout.String(), err
+}
+
+func TestLint(t *testing.T) {
+	out, err := runCommand(t, testManifests, "lint")
+	if err != nil || out != "default/errors: ok\n" {
+		t.Errorf("Expected the LokiRule to be valid, got: %q, %v", out, err)
+	}
+
+	record := "- record: app:errors:count1m"
+	invalid := strings.Replace(testManifests, record, record+"\n          for: 5m", 1)
+	out, err = runCommand(t, invalid, "lint")
+	if !errors.Is(err, errFailed) || !strings.Contains(out, "invalid field 'for' in recording rule") {
+		t.Errorf("Expected the LokiRule to be invalid, got: %q, %v", out, err)
+	}
+}
+
+func TestLintRejectsUnknownFields(t *testing.T) {
+	invalid := strings.Replace(testManifests, "expr:", "exp:", 1)
+
+	_, err := runCommand(t, invalid, "lint")
+	if err == nil || !strings.HasPrefix(err.Error(), "stdin: document 1: ") ||
+		!strings.Contains(err.Error(), `unknown field "exp"`) {
+		t.Errorf("Expected an unknown field error, got: %v", err)
+	}
+}
+
+func TestRender(t *testing.T) {
+	out, err := runCommand(t, testManifests, "render", "-namespace", "team-a")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expected := "# Source: team-a_errors.yaml\n" + testRuleFile
+	if out != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out)
+	}
+}
+
+func TestDiffDir(t *testing.T) {
+	dir := t.TempDir()
+
+	out, err := runCommand(t, testManifests, "diff", "-dir", dir)
+	if !errors.Is(err, errFailed) || !strings.HasPrefix(out, "--- /dev/null\n+++ default_errors.yaml\n@@ -0,0 +1,5 @@\n") {
+		t.Errorf("Expected the rule file to be added, got: %q, %v", out, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "default_errors.yaml"), []byte(testRuleFile), 0o600); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	out, err = runCommand(t, testManifests, "diff", "-dir", dir)
+	if err != nil || out != "" {
+		t.Errorf("Expected no differences, got: %q, %v", out, err)
+	}
+}
+
+func TestTest(t *testing.T) {
+	out, err := runCommand(t, testManifests, "test")
+	if err != nil || out != "default/errors-test: SUCCESS\n" {
+		t.Errorf("Expected the test to pass, got: %q, %v", out, err)
+	}
+
+	failing := strings.Replace(testManifests, `value: "1"`, `value: "2"`, 1)
+	out, err = runCommand(t, failing, "test")
+	if !errors.Is(err, errFailed) || !strings.Contains(out, "default/errors-test: FAILED") {
+		t.Errorf("Expected the test to fail, got: %q, %v", out, err)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	b := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+
+	expected := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -8,3 +8,4 @@
+ h
+ i
+ j
++k
+`
+	if diff := unifiedDiff("old", "new", a, b); diff != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, diff)
+	}
+
+	if diff := unifiedDiff("old", "new", a, a); diff != "" {
+		t.Errorf("Expected no diff, got:\n%s", diff)
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	prometheusRule := `apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: alerts
+  namespace: team-b
+spec:
+  groups:
+    - name: alerts
+      rules:
+        - alert: HighErrorRate
+          expr: app:errors:count1m > 10
+          for: 5m
+`
+	if err := os.WriteFile(filepath.Join(dir, "App_Errors.yaml"), []byte(testRuleFile), 0o600); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "alerts.yaml"), []byte(prometheusRule), 0o600); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	out, err := runCommand(t, "", "import", "-namespace", "team-a", dir)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expected := `apiVersion: quero.com/v1alpha1
+kind: LokiRule
+metadata:
+  name: app-errors
+  namespace: team-a
+spec:
+  groups:
+  - name: errors
+    rules:
+    - expr: sum by (app) (count_over_time({app="api"} |= "error" [1m]))
+      record: app:errors:count1m
+---
+apiVersion: quero.com/v1alpha1
+kind: LokiRule
+metadata:
+  name: alerts
+  namespace: team-b
+spec:
+  groups:
+  - name: alerts
+    rules:
+    - alert: HighErrorRate
+      expr: app:errors:count1m > 10
+      for: 5m
+`
+	if out != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out)
+	}
+
+	out, err = runCommand(t, out, "lint")
+	if err != nil || out != "team-a/app-errors: ok\nteam-b/alerts: ok\n" {
+		t.Errorf("Expected the imported LokiRules to be valid, got: %q, %v", out, err)
+	}
+}
+
+func TestImportRejectsDuplicateNames(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"errors.yaml", "errors.yml"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(testRuleFile), 0o600); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	_, err := runCommand(t, "", "import", dir)
+	if err == nil || !strings.Contains(err.Error(), "LokiRule default/errors imported twice") {
+		t.Errorf("Expected a duplicate name error, got: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+// manifests are the LokiRules and LokiRuleTests read from the input files.
+type manifests struct {
+	rules []*querocomv1alpha1.LokiRule
+	tests []*querocomv1alpha1.LokiRuleTest
+}
+
+// manifestFiles expands directories into the YAML files they contain. No
+// path, or "-", reads from stdin.
+func manifestFiles(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return []string{"-"}, nil
+	}
+
+	var files []string
+	for _, path := range paths {
+		if path == "-" {
+			files = append(files, path)
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// readManifests reads the LokiRules and LokiRuleTests of multi-document YAML
+// files, ignoring other kinds. Manifests without a namespace are given
+// defaultNamespace, as kubectl apply would.
+func readManifests(paths []string, stdin io.Reader, defaultNamespace string) (*manifests, error) {
+	files, err := manifestFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &manifests{}
+	for _, file := range files {
+		var r io.Reader = stdin
+		name := "stdin"
+		if file != "-" {
+			name = file
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			r = bytes.NewReader(content)
+		}
+
+		if err := result.read(r, defaultNamespace); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return result, nil
+}
+
+func (m *manifests) read(r io.Reader, defaultNamespace string) error {
+	reader := yaml.NewYAMLReader(bufio.NewReader(r))
+
+	for i := 0; ; i++ {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if strings.TrimSpace(string(doc)) == "" {
+			continue
+		}
+
+		typeMeta := metav1.TypeMeta{}
+		if err := sigsyaml.Unmarshal(doc, &typeMeta); err != nil {
+			return fmt.Errorf("document %d: %w", i, err)
+		}
+
+		if typeMeta.GroupVersionKind().Group != querocomv1alpha1.GroupVersion.Group {
+			continue
+		}
+
+		var obj metav1.Object
+		switch typeMeta.Kind {
+		case "LokiRule":
+			rule := &querocomv1alpha1.LokiRule{}
+			obj = rule
+			m.rules = append(m.rules, rule)
+		case "LokiRuleTest":
+			test := &querocomv1alpha1.LokiRuleTest{}
+			obj = test
+			m.tests = append(m.tests, test)
+		default:
+			continue
+		}
+
+		if err := sigsyaml.UnmarshalStrict(doc, obj); err != nil {
+			return fmt.Errorf("document %d: %w", i, err)
+		}
+
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(defaultNamespace)
+		}
+	}
+}
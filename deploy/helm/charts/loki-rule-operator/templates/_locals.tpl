@@ -18,4 +18,10 @@ commonResources:
     name: {{ include "loki-rule-operator.fullname" . }}-manager-role
   serviceAccount:
     name: {{ include "loki-rule-operator.serviceAccountName" . }}
+  webhook:
+    name: {{ include "loki-rule-operator.fullname" . }}-webhook
+    certSecretName: {{ include "loki-rule-operator.fullname" . }}-webhook-cert
+  config:
+    name: {{ include "loki-rule-operator.fullname" . }}-config
+    mountPath: /etc/loki-rule-operator
 {{- end }}
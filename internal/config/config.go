@@ -0,0 +1,373 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	httputil "github.com/quero-edu/loki-rule-operator/internal/http"
+	"github.com/quero-edu/loki-rule-operator/pkg/features"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Version is the version of the config file format this operator reads.
+const Version = "v1"
+
+// Config holds the operator settings. The flags are overridden by the config
+// file, which is overridden by environment variables.
+type Config struct {
+	// Version is the version of the config file format, always Version
+	Version        string         `yaml:"version"`
+	Loki           Loki           `yaml:"loki"`
+	RulesConfigMap RulesConfigMap `yaml:"rulesConfigMap"`
+	Rules          Rules          `yaml:"rules"`
+	Quotas         Quotas         `yaml:"quotas"`
+	Features       Features       `yaml:"features"`
+}
+
+// Loki is the Loki instance the rules are written for.
+type Loki struct {
+	// URL of the Loki server validating LogQL expressions, disabled when empty
+	URL string `yaml:"url"`
+	// Headers are sent with every request to Loki, e.g. X-Scope-OrgID
+	Headers map[string]string `yaml:"headers"`
+	Auth    Auth              `yaml:"auth"`
+	// Namespace of the Loki StatefulSet and the rules ConfigMap
+	Namespace string `yaml:"namespace"`
+	// LabelSelector selects the Loki StatefulSet the rules ConfigMap is mounted into
+	LabelSelector string `yaml:"labelSelector"`
+	// RulesMountPath is where the rules ConfigMap is mounted in Loki
+	RulesMountPath string `yaml:"rulesMountPath"`
+}
+
+// Auth are the credentials sent to Loki, either basic auth or a bearer token.
+type Auth struct {
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	BearerToken string `yaml:"bearerToken"`
+}
+
+// RulesConfigMap is the ConfigMap the rule files are written to, in
+// loki.namespace.
+type RulesConfigMap struct {
+	Name string `yaml:"name"`
+	// PreviousName is the rules ConfigMap the rule files are moved from on
+	// startup after renaming it, none when empty
+	PreviousName string `yaml:"previousName"`
+	// Labels and Annotations are set on the rules ConfigMap
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// Rules is how LokiRules are rendered into rule files.
+type Rules struct {
+	NamespaceLabel   string   `yaml:"namespaceLabel"`
+	NameLabel        string   `yaml:"nameLabel"`
+	CopyLabels       []string `yaml:"copyLabels"`
+	FileNameTemplate string   `yaml:"fileNameTemplate"`
+}
+
+// Quota limits the rules of a LokiRule or a namespace, unlimited when 0.
+type Quota struct {
+	MaxRules  int `yaml:"maxRules"`
+	MaxGroups int `yaml:"maxGroups"`
+	MaxBytes  int `yaml:"maxBytes"`
+}
+
+type Quotas struct {
+	PerObject    Quota `yaml:"perObject"`
+	PerNamespace Quota `yaml:"perNamespace"`
+}
+
+// Features toggles the optional behaviors of the operator.
+type Features struct {
+	OnlyReconcileRules bool   `yaml:"onlyReconcileRules"`
+	QuarantinePolicy   string `yaml:"quarantinePolicy"`
+	// LoadedTimeout is how long the Loki ruler has to load the rule groups of
+	// a written LokiRule, the Loaded condition is not set when 0
+	LoadedTimeout time.Duration `yaml:"loadedTimeout"`
+	DryRun        bool          `yaml:"dryRun"`
+	Webhooks      bool          `yaml:"webhooks"`
+	// DependencyReadyChecks makes the checks of Loki and of its StatefulSet
+	// readiness checks, on top of serving them under /checks
+	DependencyReadyChecks bool       `yaml:"dependencyReadyChecks"`
+	Adoption              Adoption   `yaml:"adoption"`
+	RuleHealth            RuleHealth `yaml:"ruleHealth"`
+}
+
+type Adoption struct {
+	Mode      string        `yaml:"mode"`
+	Namespace string        `yaml:"namespace"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+// RuleHealth is how the rule health is read from the Loki ruler into the
+// LokiRule status.
+type RuleHealth struct {
+	// Interval between two reads, disabled when 0
+	Interval time.Duration `yaml:"interval"`
+	// RateLimit is the number of LokiRule status updates per second, 0 is no limit
+	RateLimit int `yaml:"rateLimit"`
+}
+
+// DeepCopy returns a copy of the config sharing no map or slice with it.
+func (c Config) DeepCopy() Config {
+	c.Loki.Headers = copyStringMap(c.Loki.Headers)
+	c.RulesConfigMap.Labels = copyStringMap(c.RulesConfigMap.Labels)
+	c.RulesConfigMap.Annotations = copyStringMap(c.RulesConfigMap.Annotations)
+
+	if c.Rules.CopyLabels != nil {
+		c.Rules.CopyLabels = append([]string{}, c.Rules.CopyLabels...)
+	}
+
+	return c
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	copied := make(map[string]string, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
+// Load reads the config file at path on top of base, then applies the
+// environment variable overrides returned by lookupEnv and validates the
+// result. Settings missing from the config file keep their value in base. The
+// config file is skipped when path is empty.
+func Load(path string, base Config, lookupEnv func(string) (string, bool)) (Config, error) {
+	config := base.DeepCopy()
+
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read the config file: %w", err)
+		}
+
+		// The version is required, so a config file of another format is not
+		// partially applied.
+		var versioned struct {
+			Version string `yaml:"version"`
+		}
+		if err := yaml.Unmarshal(content, &versioned); err != nil {
+			return Config{}, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		if versioned.Version != Version {
+			return Config{}, fmt.Errorf(
+				"unsupported version %q of config file %s, expected %q", versioned.Version, path, Version,
+			)
+		}
+
+		if err := yaml.UnmarshalStrict(content, &config); err != nil {
+			return Config{}, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(&config, lookupEnv); err != nil {
+		return Config{}, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+// Validate reports every invalid setting of the config.
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.Version != Version {
+		errs = append(errs, fmt.Errorf("unsupported config version %q, expected %q", c.Version, Version))
+	}
+
+	if c.Loki.URL != "" {
+		u, err := url.Parse(c.Loki.URL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid loki.url: %w", err))
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			errs = append(errs, fmt.Errorf("invalid loki.url %q: expected an http or https URL", c.Loki.URL))
+		}
+	}
+
+	if c.Loki.Auth.BearerToken != "" && (c.Loki.Auth.Username != "" || c.Loki.Auth.Password != "") {
+		errs = append(errs, errors.New("loki.auth: set either username and password or bearerToken"))
+	}
+	if c.Loki.Auth.Password != "" && c.Loki.Auth.Username == "" {
+		errs = append(errs, errors.New("loki.auth: password set without username"))
+	}
+
+	if c.Loki.Namespace == "" {
+		errs = append(errs, errors.New("loki.namespace must be set"))
+	}
+
+	if _, err := metav1.ParseToLabelSelector(c.Loki.LabelSelector); err != nil {
+		errs = append(errs, fmt.Errorf("invalid loki.labelSelector: %w", err))
+	}
+
+	errs = append(errs, c.RulesConfigMap.validate()...)
+
+	if err := lokirule.ValidateOwnerLabels(c.Rules.NamespaceLabel, c.Rules.NameLabel); err != nil {
+		errs = append(errs, fmt.Errorf("invalid rules labels: %w", err))
+	}
+
+	if err := lokirule.ValidateFileNameTemplate(c.Rules.FileNameTemplate); err != nil {
+		errs = append(errs, fmt.Errorf("invalid rules.fileNameTemplate: %w", err))
+	}
+
+	if q := c.Quotas.PerObject; q.MaxRules < 0 || q.MaxGroups < 0 || q.MaxBytes < 0 {
+		errs = append(errs, errors.New("quotas.perObject cannot be negative"))
+	}
+	if q := c.Quotas.PerNamespace; q.MaxRules < 0 || q.MaxGroups < 0 || q.MaxBytes < 0 {
+		errs = append(errs, errors.New("quotas.perNamespace cannot be negative"))
+	}
+
+	switch c.Features.QuarantinePolicy {
+	case features.QuarantinePolicyKeep, features.QuarantinePolicyOmit:
+	default:
+		errs = append(errs, fmt.Errorf("unknown features.quarantinePolicy %q", c.Features.QuarantinePolicy))
+	}
+
+	if c.Features.LoadedTimeout < 0 {
+		errs = append(errs, errors.New("features.loadedTimeout cannot be negative"))
+	}
+
+	if c.Features.RuleHealth.Interval < 0 {
+		errs = append(errs, errors.New("features.ruleHealth.interval cannot be negative"))
+	}
+	if c.Features.RuleHealth.RateLimit < 0 {
+		errs = append(errs, errors.New("features.ruleHealth.rateLimit cannot be negative"))
+	}
+
+	switch c.Features.Adoption.Mode {
+	case features.AdoptionModeOff:
+	case features.AdoptionModeReport, features.AdoptionModeCreate:
+		if c.Features.Adoption.Interval <= 0 {
+			errs = append(errs, errors.New("features.adoption.interval must be positive"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown features.adoption.mode %q", c.Features.Adoption.Mode))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c RulesConfigMap) validate() []error {
+	var errs []error
+
+	for _, name := range []string{c.Name, c.PreviousName} {
+		if name == "" {
+			continue
+		}
+		if problems := validation.IsDNS1123Subdomain(name); len(problems) > 0 {
+			errs = append(errs, fmt.Errorf("invalid rulesConfigMap name %q: %s", name, strings.Join(problems, ", ")))
+		} else if len(lokirule.AppliedRulesConfigMapName(name)) > validation.DNS1123SubdomainMaxLength {
+			errs = append(errs, fmt.Errorf("rulesConfigMap name %q is too long to name its applied rules ConfigMap", name))
+		}
+	}
+	if c.Name == "" {
+		errs = append(errs, errors.New("rulesConfigMap.name must be set"))
+	}
+
+	for k, v := range c.Labels {
+		problems := append(validation.IsQualifiedName(k), validation.IsValidLabelValue(v)...)
+		if len(problems) > 0 {
+			errs = append(errs, fmt.Errorf("invalid rulesConfigMap.labels %q: %s", k, strings.Join(problems, ", ")))
+		}
+	}
+
+	for k := range c.Annotations {
+		if problems := validation.IsQualifiedName(k); len(problems) > 0 {
+			errs = append(errs, fmt.Errorf("invalid rulesConfigMap.annotations %q: %s", k, strings.Join(problems, ", ")))
+		}
+		if k == lokirule.AppliedRulesAnnotation {
+			errs = append(errs, fmt.Errorf("rulesConfigMap.annotations cannot set %s", k))
+		}
+	}
+
+	return errs
+}
+
+// LabelSelector returns the parsed loki.labelSelector.
+func (c Config) LabelSelector() (*metav1.LabelSelector, error) {
+	return metav1.ParseToLabelSelector(c.Loki.LabelSelector)
+}
+
+// LokiClient returns the client sending loki.headers and loki.auth with
+// every request to Loki.
+func (c Config) LokiClient() *http.Client {
+	rt := httputil.ApplyHeader(nil)
+	for k, v := range c.Loki.Headers {
+		rt.Set(k, v)
+	}
+
+	switch {
+	case c.Loki.Auth.BearerToken != "":
+		rt.Set("Authorization", "Bearer "+c.Loki.Auth.BearerToken)
+	case c.Loki.Auth.Username != "":
+		credentials := c.Loki.Auth.Username + ":" + c.Loki.Auth.Password
+		rt.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	return &http.Client{Transport: rt}
+}
+
+// RuleOptions returns how LokiRules are rendered.
+func (c Config) RuleOptions() lokirule.Options {
+	return lokirule.Options{
+		NamespaceLabel:   c.Rules.NamespaceLabel,
+		NameLabel:        c.Rules.NameLabel,
+		CopyLabels:       c.Rules.CopyLabels,
+		FileNameTemplate: c.Rules.FileNameTemplate,
+	}
+}
+
+// LokiRuleQuotas returns the quotas of the LokiRules.
+func (c Config) LokiRuleQuotas() lokirule.Quotas {
+	return lokirule.Quotas{
+		PerObject:    lokirule.Quota(c.Quotas.PerObject),
+		PerNamespace: lokirule.Quota(c.Quotas.PerNamespace),
+	}
+}
+
+// RestartRequired lists the settings changed from previous to current that
+// are only read on startup, so a reload does not apply them.
+func RestartRequired(previous, current Config) []string {
+	var changed []string
+
+	settings := []struct {
+		name              string
+		previous, current interface{}
+	}{
+		{"loki.namespace", previous.Loki.Namespace, current.Loki.Namespace},
+		{"loki.labelSelector", previous.Loki.LabelSelector, current.Loki.LabelSelector},
+		{"loki.rulesMountPath", previous.Loki.RulesMountPath, current.Loki.RulesMountPath},
+		{"rulesConfigMap.name", previous.RulesConfigMap.Name, current.RulesConfigMap.Name},
+		{"rulesConfigMap.previousName", previous.RulesConfigMap.PreviousName, current.RulesConfigMap.PreviousName},
+		{"features.onlyReconcileRules", previous.Features.OnlyReconcileRules, current.Features.OnlyReconcileRules},
+		{"features.dryRun", previous.Features.DryRun, current.Features.DryRun},
+		{"features.webhooks", previous.Features.Webhooks, current.Features.Webhooks},
+		{"features.dependencyReadyChecks", previous.Features.DependencyReadyChecks, current.Features.DependencyReadyChecks},
+		{"features.adoption", previous.Features.Adoption, current.Features.Adoption},
+	}
+	for _, setting := range settings {
+		if setting.previous != setting.current {
+			changed = append(changed, setting.name)
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+)
+
+func newBaseConfig() Config {
+	return Config{
+		Version: Version,
+		Loki: Loki{
+			URL:            "http://loki:3100",
+			Headers:        map[string]string{"X-Scope-OrgID": "1"},
+			Namespace:      "loki",
+			LabelSelector:  "app=loki",
+			RulesMountPath: "/etc/loki/rules",
+		},
+		RulesConfigMap: RulesConfigMap{Name: "loki-rule-cfg"},
+		Rules:          Rules{CopyLabels: []string{"team"}},
+		Features:       Features{QuarantinePolicy: "keep", Adoption: Adoption{Mode: "off", Interval: 10 * time.Minute}},
+	}
+}
+
+func writeConfigFile(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+}
+
+func lookupEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, `version: v1
+loki:
+  url: http://loki-gateway:3100
+  headers:
+    X-Team: a
+rulesConfigMap:
+  name: loki-rules
+  previousName: loki-rule-cfg
+  labels:
+    team: observability
+quotas:
+  perObject:
+    maxRules: 50
+features:
+  adoption:
+    mode: report
+  ruleHealth:
+    interval: 30s
+`)
+
+	base := newBaseConfig()
+	config, err := Load(path, base, lookupEnv(map[string]string{
+		"LOKI_RULE_OPERATOR_LOKI_AUTH_BEARER_TOKEN":          "secret",
+		"LOKI_RULE_OPERATOR_QUOTAS_PER_NAMESPACE_MAX_RULES":  "200",
+		"LOKI_RULE_OPERATOR_FEATURES_ADOPTION_INTERVAL":      "5m",
+		"LOKI_RULE_OPERATOR_RULES_COPY_LABELS":               "team,app",
+		"LOKI_RULE_OPERATOR_RULES_CONFIG_MAP_ANNOTATIONS":    "owner=sre",
+		"LOKI_RULE_OPERATOR_FEATURES_RULE_HEALTH_RATE_LIMIT": "5",
+	}))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expected := newBaseConfig()
+	expected.Loki.URL = "http://loki-gateway:3100"
+	expected.Loki.Headers["X-Team"] = "a"
+	expected.Loki.Auth.BearerToken = "secret"
+	expected.RulesConfigMap = RulesConfigMap{
+		Name:         "loki-rules",
+		PreviousName: "loki-rule-cfg",
+		Labels:       map[string]string{"team": "observability"},
+		Annotations:  map[string]string{"owner": "sre"},
+	}
+	expected.Quotas.PerObject.MaxRules = 50
+	expected.Quotas.PerNamespace.MaxRules = 200
+	expected.Features.Adoption = Adoption{Mode: "report", Interval: 5 * time.Minute}
+	expected.Features.RuleHealth = RuleHealth{Interval: 30 * time.Second, RateLimit: 5}
+	expected.Rules.CopyLabels = []string{"team", "app"}
+
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected %+v, got: %+v", expected, config)
+	}
+
+	if !reflect.DeepEqual(base, newBaseConfig()) {
+		t.Errorf("Expected the base config to be left untouched, got: %+v", base)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := map[string]struct {
+		content string
+		env     map[string]string
+		errors  []string
+	}{
+		"missing version": {
+			content: "loki:\n  url: http://loki:3100\n",
+			errors:  []string{`unsupported version ""`},
+		},
+		"unknown setting": {
+			content: "version: v1\nloki:\n  address: http://loki:3100\n",
+			errors:  []string{"field address not found"},
+		},
+		"invalid settings": {
+			content: "version: v1\nloki:\n  url: loki:3100\n  labelSelector: 'app in ('\n" +
+				"rules:\n  nameLabel: lokirule-name\n" +
+				"features:\n  quarantinePolicy: drop\n  loadedTimeout: -1m\n  ruleHealth:\n    rateLimit: -1\n",
+			errors: []string{
+				"invalid loki.url",
+				"invalid loki.labelSelector",
+				`invalid name label name "lokirule-name"`,
+				`unknown features.quarantinePolicy "drop"`,
+				"features.loadedTimeout cannot be negative",
+				"features.ruleHealth.rateLimit cannot be negative",
+			},
+		},
+		"invalid rules ConfigMap": {
+			content: "version: v1\nrulesConfigMap:\n  name: Loki_Rules\n  labels:\n    team: 'a b'\n" +
+				"  annotations:\n    loki-rule-operator.quero.com/applied-rules: '{}'\n",
+			errors: []string{
+				`invalid rulesConfigMap name "Loki_Rules"`,
+				`invalid rulesConfigMap.labels "team"`,
+				"rulesConfigMap.annotations cannot set loki-rule-operator.quero.com/applied-rules",
+			},
+		},
+		"rules ConfigMap name too long": {
+			content: "version: v1\nrulesConfigMap:\n  name: " + strings.Repeat("a", 240) + "\n",
+			errors:  []string{"is too long to name its applied rules ConfigMap"},
+		},
+		"invalid environment variable": {
+			content: "version: v1\n",
+			env:     map[string]string{"LOKI_RULE_OPERATOR_FEATURES_DRY_RUN": "maybe"},
+			errors:  []string{"invalid environment variable LOKI_RULE_OPERATOR_FEATURES_DRY_RUN"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			writeConfigFile(t, path, tt.content)
+
+			_, err := Load(path, newBaseConfig(), lookupEnv(tt.env))
+			if err == nil {
+				t.Fatalf("Expected an error")
+			}
+			for _, message := range tt.errors {
+				if !strings.Contains(err.Error(), message) {
+					t.Errorf("Expected %q in the error, got: %v", message, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLokiClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Scope-OrgID") != "1" {
+			t.Errorf("Missing header X-Scope-OrgID, got: %v", r.Header)
+		}
+		if r.Header.Get("Authorization") != "Basic dXNlcjpwYXNzd29yZA==" {
+			t.Errorf("Missing basic auth, got: %v", r.Header)
+		}
+	}))
+	defer server.Close()
+
+	config := newBaseConfig()
+	config.Loki.Auth = Auth{Username: "user", Password: "password"}
+
+	response, err := config.LokiClient().Get(server.URL)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	response.Body.Close()
+}
+
+func TestRestartRequired(t *testing.T) {
+	current := newBaseConfig()
+	current.Loki.URL = "http://loki-gateway:3100"
+	current.Loki.Namespace = "monitoring"
+	current.Features.Adoption.Mode = "create"
+	current.Features.RuleHealth.Interval = 5 * time.Minute
+	current.Features.DependencyReadyChecks = true
+
+	changed := RestartRequired(newBaseConfig(), current)
+	expected := []string{"loki.namespace", "features.dependencyReadyChecks", "features.adoption"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Expected %v to require a restart, got: %v", expected, changed)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, "version: v1\n")
+
+	current, err := Load(path, newBaseConfig(), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	changes := make(chan Config, 10)
+	w := &Watcher{
+		Path:    path,
+		Base:    newBaseConfig(),
+		Logger:  logger.NewNopLogger(),
+		Current: current,
+		OnChange: func(_, current Config) {
+			changes <- current
+		},
+	}
+
+	// An invalid config file is ignored.
+	writeConfigFile(t, path, "version: v1\nfeatures:\n  quarantinePolicy: drop\n")
+	w.Reload()
+	if len(changes) != 0 || w.Current.Features.QuarantinePolicy != "keep" {
+		t.Fatalf("Expected the invalid config to be ignored, got: %+v", w.Current)
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go func() {
+		if err := w.Start(ctx); err != nil {
+			t.Errorf("Error: %v", err)
+		}
+	}()
+
+	// The watch starts asynchronously, so the file is written until the
+	// change is seen.
+	timeout := time.After(5 * time.Second)
+	for {
+		writeConfigFile(t, path, "version: v1\nfeatures:\n  quarantinePolicy: omit\n")
+
+		select {
+		case config := <-changes:
+			if config.Features.QuarantinePolicy != "omit" {
+				t.Errorf("Expected the reloaded config, got: %+v", config)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("Expected the config file to be reloaded")
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// EnvPrefix prefixes the environment variables overriding settings. The
+// variable of a setting is its path in the config file in upper snake case,
+// e.g. LOKI_RULE_OPERATOR_LOKI_AUTH_BEARER_TOKEN for loki.auth.bearerToken.
+const EnvPrefix = "LOKI_RULE_OPERATOR_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// envName turns a config file key into its environment variable part, e.g.
+// "bearerToken" into "BEARER_TOKEN".
+func envName(key string) string {
+	var name strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 {
+			name.WriteByte('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// applyEnv overrides the settings of config with the environment variables
+// found by lookupEnv. Lists are comma separated and maps are comma separated
+// KEY=VALUE pairs.
+func applyEnv(config *Config, lookupEnv func(string) (string, bool)) error {
+	if lookupEnv == nil {
+		return nil
+	}
+	return applyEnvToStruct(reflect.ValueOf(config).Elem(), strings.TrimSuffix(EnvPrefix, "_"), lookupEnv)
+}
+
+func applyEnvToStruct(v reflect.Value, prefix string, lookupEnv func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "version" {
+			continue
+		}
+
+		name := prefix + "_" + envName(key)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvToStruct(field, name, lookupEnv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid environment variable %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		var values []string
+		if value != "" {
+			values = strings.Split(value, ",")
+		}
+		field.Set(reflect.ValueOf(values))
+
+	case field.Kind() == reflect.Map && field.Type().Elem().Kind() == reflect.String:
+		values := map[string]string{}
+		for _, pair := range strings.Split(value, ",") {
+			if pair == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("missing '=' in pair %q", pair)
+			}
+			values[k] = v
+		}
+		field.Set(reflect.ValueOf(values))
+
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+
+	return nil
+}
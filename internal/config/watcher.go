@@ -0,0 +1,86 @@
+package config
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+)
+
+// Watcher reloads the config file whenever it changes and hands every new
+// valid config to OnChange. An invalid config file is logged and ignored, so
+// the operator keeps running with the last valid config.
+type Watcher struct {
+	Path      string
+	Base      Config
+	LookupEnv func(string) (string, bool)
+	Logger    logger.Logger
+	// Current is the config loaded on startup
+	Current  Config
+	OnChange func(previous, current Config)
+}
+
+// NeedLeaderElection reloads the config on every replica.
+func (w *Watcher) NeedLeaderElection() bool {
+	return false
+}
+
+// Start watches the directory of the config file until ctx is done. The
+// directory is watched rather than the file, as a mounted ConfigMap is updated
+// by replacing a symlink, which a watch on the file does not see.
+func (w *Watcher) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(w.Path)); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			w.Logger.Error(err, "Failed to watch the config file", "path", w.Path)
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			w.Reload()
+		}
+	}
+}
+
+// Reload loads the config file and calls OnChange if it changed.
+func (w *Watcher) Reload() {
+	config, err := Load(w.Path, w.Base, w.LookupEnv)
+	if err != nil {
+		w.Logger.Error(err, "Invalid config file, keeping the current config", "path", w.Path)
+		return
+	}
+
+	if reflect.DeepEqual(config, w.Current) {
+		return
+	}
+
+	previous := w.Current
+	w.Current = config
+
+	w.Logger.Info("Reloaded the config file", "path", w.Path)
+	if w.OnChange != nil {
+		w.OnChange(previous, config)
+	}
+}
@@ -20,20 +20,27 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"time"
 
 	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/config"
 	"github.com/quero-edu/loki-rule-operator/internal/flags"
-	httputil "github.com/quero-edu/loki-rule-operator/internal/http"
 	"github.com/quero-edu/loki-rule-operator/internal/logger"
 	"github.com/quero-edu/loki-rule-operator/pkg/controllers"
+	"github.com/quero-edu/loki-rule-operator/pkg/features"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
 
 	"github.com/go-logr/logr"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	logCtrl "sigs.k8s.io/controller-runtime/pkg/log"
 	metricsServer "sigs.k8s.io/controller-runtime/pkg/metrics/server"
@@ -61,6 +68,7 @@ func main() {
 	var log = logger.NewLogger("all", logErrorCallback)
 	logCtrl.SetLogger(logr.New(logCtrl.NullLogSink{}))
 
+	var configFile string
 	var metricsAddr string
 	var probeAddr string
 	var enableLeaderElection bool
@@ -72,8 +80,33 @@ func main() {
 	var lokiRuleMountPath string
 	var lokiURL string
 	var lokiHeaders flags.ArrayFlags
+	var rulesConfigMapName string
+	var rulesConfigMapPreviousName string
+	var rulesConfigMapLabels flags.ArrayFlags
+	var rulesConfigMapAnnotations flags.ArrayFlags
 	var onlyReconcileRules bool
+	var ruleNamespaceLabel string
+	var ruleNameLabel string
+	var ruleCopyLabels flags.ArrayFlags
+	var ruleFileNameTemplate string
+	var enableWebhooks bool
+	var dependencyReadyChecks bool
+	var quotas lokirule.Quotas
+	var quarantinePolicy string
+	var loadedTimeout time.Duration
+	var adoptionMode string
+	var adoptionNamespace string
+	var adoptionInterval time.Duration
+	var ruleHealthInterval time.Duration
+	var ruleHealthRateLimit int
+	var dryRun bool
 
+	flag.StringVar(
+		&configFile,
+		"config",
+		"",
+		"Path of the YAML config file. Its settings override the flags and are reloaded when it changes.",
+	)
 	flag.BoolVar(
 		&enableLeaderElection,
 		"leader-elect",
@@ -139,6 +172,29 @@ func main() {
 		"loki-header",
 		"Extra header that will be sent to Loki. Format KEY=VALUE. May be repeated.",
 	)
+	flag.StringVar(
+		&rulesConfigMapName,
+		"rules-configmap-name",
+		"loki-rule-cfg",
+		"The name of the ConfigMap the rule files are written to, in the loki namespace.",
+	)
+	flag.StringVar(
+		&rulesConfigMapPreviousName,
+		"rules-configmap-previous-name",
+		"",
+		"The previous name of the rules ConfigMap. Its rule files are moved to the rules ConfigMap on startup "+
+			"and it is deleted once Loki no longer mounts it.",
+	)
+	flag.Var(
+		&rulesConfigMapLabels,
+		"rules-configmap-label",
+		"Extra label set on the rules ConfigMap. Format KEY=VALUE. May be repeated.",
+	)
+	flag.Var(
+		&rulesConfigMapAnnotations,
+		"rules-configmap-annotation",
+		"Extra annotation set on the rules ConfigMap. Format KEY=VALUE. May be repeated.",
+	)
 	flag.BoolVar(
 		&onlyReconcileRules,
 		"only-reconcile-rules",
@@ -147,19 +203,269 @@ func main() {
 			"It will skip updating the DaemonSet volume, volumeMounts and annotation hash, "+
 			"efficiently avoiding restarts of Loki.",
 	)
+	flag.StringVar(
+		&ruleNamespaceLabel,
+		"rule-namespace-label",
+		"",
+		"Label added to every generated rule holding the namespace of its LokiRule (e.g. lokirule_namespace). "+
+			"Disabled when empty.",
+	)
+	flag.StringVar(
+		&ruleNameLabel,
+		"rule-name-label",
+		"",
+		"Label added to every generated rule holding the name of its LokiRule (e.g. lokirule_name). "+
+			"Disabled when empty.",
+	)
+	flag.Var(
+		&ruleCopyLabels,
+		"rule-copy-label",
+		"LokiRule metadata label key copied into every generated rule. May be repeated.",
+	)
+	flag.StringVar(
+		&ruleFileNameTemplate,
+		"rule-file-name-template",
+		lokirule.DefaultFileNameTemplate,
+		"The Go template of the rules ConfigMap key of every LokiRule, from its .Namespace, .Name and .Hash. "+
+			"Existing rule files are renamed on startup.",
+	)
+	flag.BoolVar(
+		&enableWebhooks,
+		"enable-webhooks",
+		false,
+		"Serve the LokiRule validating webhook. Requires a serving certificate in the webhook certificate directory.",
+	)
+	flag.BoolVar(
+		&dependencyReadyChecks,
+		"dependency-ready-checks",
+		true,
+		"Make the loki and workload checks readiness checks. With the webhook enabled, an unready operator "+
+			"rejects every LokiRule write, disable it to keep accepting them while Loki is down.",
+	)
+	flag.IntVar(
+		&quotas.PerObject.MaxRules,
+		"quota-max-rules-per-object",
+		0,
+		"Maximum number of rules of a single LokiRule. Unlimited when 0.",
+	)
+	flag.IntVar(
+		&quotas.PerObject.MaxGroups,
+		"quota-max-groups-per-object",
+		0,
+		"Maximum number of rule groups of a single LokiRule. Unlimited when 0.",
+	)
+	flag.IntVar(
+		&quotas.PerObject.MaxBytes,
+		"quota-max-bytes-per-object",
+		0,
+		"Maximum size in bytes of the rule file rendered from a single LokiRule. Unlimited when 0.",
+	)
+	flag.IntVar(
+		&quotas.PerNamespace.MaxRules,
+		"quota-max-rules-per-namespace",
+		0,
+		"Maximum number of rules of all LokiRules in a namespace. Unlimited when 0.",
+	)
+	flag.IntVar(
+		&quotas.PerNamespace.MaxGroups,
+		"quota-max-groups-per-namespace",
+		0,
+		"Maximum number of rule groups of all LokiRules in a namespace. Unlimited when 0.",
+	)
+	flag.IntVar(
+		&quotas.PerNamespace.MaxBytes,
+		"quota-max-bytes-per-namespace",
+		0,
+		"Maximum size in bytes of the rule files rendered from all LokiRules in a namespace. Unlimited when 0.",
+	)
+
+	flag.StringVar(
+		&quarantinePolicy,
+		"quarantine-policy",
+		features.QuarantinePolicyKeep,
+		"What happens to the rule file of a LokiRule failing validation: "+
+			"keep (the last known-good rule file is kept) or omit (the rule file is removed).",
+	)
+	flag.DurationVar(
+		&loadedTimeout,
+		"loaded-timeout",
+		controllers.DefaultLoadedTimeout,
+		"How long the Loki ruler has to load the rule groups of a LokiRule written to the rules ConfigMap, "+
+			"reported by its Loaded condition. Requires -loki-url, disabled when 0.",
+	)
+	flag.StringVar(
+		&adoptionMode,
+		"adoption-mode",
+		features.AdoptionModeOff,
+		"What happens to rules found in the rules ConfigMap or the Loki ruler that no LokiRule manages: "+
+			"off (ignored), report (logged and recorded as events) or create (adopted as LokiRules).",
+	)
+	flag.StringVar(
+		&adoptionNamespace,
+		"adoption-namespace",
+		"",
+		"The namespace where adopted LokiRules are created. Defaults to the loki namespace.",
+	)
+	flag.DurationVar(
+		&adoptionInterval,
+		"adoption-interval",
+		10*time.Minute,
+		"How often unmanaged rules are looked for when adoption is enabled.",
+	)
+	flag.DurationVar(
+		&ruleHealthInterval,
+		"rule-health-interval",
+		controllers.DefaultRuleHealthInterval,
+		"How often the health of the rules and their active alerts are read from the Loki ruler into the LokiRule "+
+			"status. Requires -loki-url, disabled when 0.",
+	)
+	flag.IntVar(
+		&ruleHealthRateLimit,
+		"rule-health-rate-limit",
+		controllers.DefaultRuleHealthRateLimit,
+		"The number of LokiRule status updates per second when writing the rule health, 0 is no limit.",
+	)
+	flag.BoolVar(
+		&dryRun,
+		"dry-run",
+		false,
+		"When enabled the operator only logs the changes it would make to the rules ConfigMap, the Loki StatefulSet, "+
+			"LokiRule statuses and adopted LokiRules, sending them to the API server as dry runs.",
+	)
 
 	flag.Parse()
 
+	if lokiNamespace == "" {
+		lokiNamespace = "default"
+	}
+
+	headers, err := lokiHeaders.Split("=")
+	if err != nil {
+		log.Error(err, "invalid loki header")
+		os.Exit(1)
+	}
+
+	configMapLabels, err := rulesConfigMapLabels.Split("=")
+	if err != nil {
+		log.Error(err, "invalid rules configmap label")
+		os.Exit(1)
+	}
+
+	configMapAnnotations, err := rulesConfigMapAnnotations.Split("=")
+	if err != nil {
+		log.Error(err, "invalid rules configmap annotation")
+		os.Exit(1)
+	}
+
+	base := config.Config{
+		Version: config.Version,
+		Loki: config.Loki{
+			URL:            lokiURL,
+			Headers:        headers,
+			Namespace:      lokiNamespace,
+			LabelSelector:  lokiLabelSelector,
+			RulesMountPath: lokiRuleMountPath,
+		},
+		RulesConfigMap: config.RulesConfigMap{
+			Name:         rulesConfigMapName,
+			PreviousName: rulesConfigMapPreviousName,
+			Labels:       configMapLabels,
+			Annotations:  configMapAnnotations,
+		},
+		Rules: config.Rules{
+			NamespaceLabel:   ruleNamespaceLabel,
+			NameLabel:        ruleNameLabel,
+			CopyLabels:       ruleCopyLabels,
+			FileNameTemplate: ruleFileNameTemplate,
+		},
+		Quotas: config.Quotas{
+			PerObject:    config.Quota(quotas.PerObject),
+			PerNamespace: config.Quota(quotas.PerNamespace),
+		},
+		Features: config.Features{
+			OnlyReconcileRules:    onlyReconcileRules,
+			QuarantinePolicy:      quarantinePolicy,
+			LoadedTimeout:         loadedTimeout,
+			DryRun:                dryRun,
+			Webhooks:              enableWebhooks,
+			DependencyReadyChecks: dependencyReadyChecks,
+			Adoption: config.Adoption{
+				Mode:      adoptionMode,
+				Namespace: adoptionNamespace,
+				Interval:  adoptionInterval,
+			},
+			RuleHealth: config.RuleHealth{
+				Interval:  ruleHealthInterval,
+				RateLimit: ruleHealthRateLimit,
+			},
+		},
+	}
+
+	cfg, err := config.Load(configFile, base, os.LookupEnv)
+	if err != nil {
+		log.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+
+	lokiSelector, err := cfg.LabelSelector()
+	if err != nil {
+		log.Error(err, "unable to parse loki label selector")
+		os.Exit(1)
+	}
+
+	adoptionNamespace = cfg.Features.Adoption.Namespace
+	if adoptionNamespace == "" {
+		adoptionNamespace = cfg.Loki.Namespace
+	}
+
+	ruleSettings := func(cfg config.Config) controllers.RuleSettings {
+		return controllers.RuleSettings{
+			LokiClient:           cfg.LokiClient(),
+			LokiURL:              cfg.Loki.URL,
+			RuleOptions:          cfg.RuleOptions(),
+			Quotas:               cfg.LokiRuleQuotas(),
+			QuarantinePolicy:     cfg.Features.QuarantinePolicy,
+			LoadedTimeout:        cfg.Features.LoadedTimeout,
+			ConfigMapLabels:      cfg.RulesConfigMap.Labels,
+			ConfigMapAnnotations: cfg.RulesConfigMap.Annotations,
+			RuleHealthInterval:   cfg.Features.RuleHealth.Interval,
+			RuleHealthRateLimit:  cfg.Features.RuleHealth.RateLimit,
+		}
+	}
+	settings := ruleSettings(cfg)
+
+	// The dependency checks and the admin endpoints are served by the metrics
+	// server, which is created with the manager, before the reconciler they
+	// are served by.
+	dependencyChecks := &healthz.Handler{}
+	dependencyChecksHandler := http.StripPrefix(controllers.DependencyChecksPath, dependencyChecks)
+	adminHandler := &controllers.AdminHandler{}
 	metricsServerOpts := metricsServer.Options{
 		BindAddress: metricsAddr,
+		ExtraHandlers: map[string]http.Handler{
+			controllers.DependencyChecksPath:       dependencyChecksHandler,
+			controllers.DependencyChecksPath + "/": dependencyChecksHandler,
+			controllers.AdminRulesPath:             adminHandler,
+			controllers.AdminResyncPath:            adminHandler,
+		},
 	}
 
 	webhookServer := webhook.NewServer(webhook.Options{
 		Port: 9443,
 	})
 
+	// The operator only reads the ConfigMaps and StatefulSets of the Loki
+	// namespace, so only those are cached rather than every one in the cluster.
+	lokiNamespaceOnly := cache.ByObject{Namespaces: map[string]cache.Config{cfg.Loki.Namespace: {}}}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                        scheme,
+		Scheme: scheme,
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.ConfigMap{}:   lokiNamespaceOnly,
+				&appsv1.StatefulSet{}: lokiNamespaceOnly,
+			},
+		},
 		Metrics:                       metricsServerOpts,
 		WebhookServer:                 webhookServer,
 		HealthProbeBindAddress:        probeAddr,
@@ -173,42 +479,168 @@ func main() {
 		os.Exit(1)
 	}
 
-	lokiSelector, err := metav1.ParseToLabelSelector(lokiLabelSelector)
-	if err != nil {
-		log.Error(err, "unable to parse loki label selector")
+	// The reconciles wait for the rule files to be migrated, so the renamed
+	// rules ConfigMap is only mounted once the rule files are moved to it.
+	migrationDone := make(chan struct{})
+
+	lokiRuleReconciler := &controllers.LokiRuleReconciler{
+		Client:                mgr.GetClient(),
+		Scheme:                mgr.GetScheme(),
+		Logger:                log,
+		Recorder:              mgr.GetEventRecorderFor("loki-rule-operator"),
+		LokiClient:            settings.LokiClient,
+		LokiRulesPath:         cfg.Loki.RulesMountPath,
+		LokiLabelSelector:     lokiSelector,
+		LokiNamespace:         cfg.Loki.Namespace,
+		LokiRuleConfigMapName: cfg.RulesConfigMap.Name,
+		ConfigMapLabels:       settings.ConfigMapLabels,
+		ConfigMapAnnotations:  settings.ConfigMapAnnotations,
+		LokiURL:               settings.LokiURL,
+		RuleOptions:           settings.RuleOptions,
+		Quotas:                settings.Quotas,
+		QuarantinePolicy:      settings.QuarantinePolicy,
+		LoadedTimeout:         settings.LoadedTimeout,
+		UpdateLoki:            !cfg.Features.OnlyReconcileRules,
+		DryRun:                cfg.Features.DryRun,
+		MigrationDone:         migrationDone,
+	}
+	if err = lokiRuleReconciler.SetupWithManager(mgr); err != nil {
+		log.Error(err, "unable to create controller", "controller", "LokiRule")
 		os.Exit(1)
 	}
 
-	if lokiNamespace == "" {
-		lokiNamespace = "default"
+	adminHandler.Reconciler = lokiRuleReconciler
+
+	if err = (&controllers.RuleFileMigrator{
+		Client:                        mgr.GetClient(),
+		Logger:                        log,
+		LokiNamespace:                 cfg.Loki.Namespace,
+		LokiRuleConfigMapName:         cfg.RulesConfigMap.Name,
+		PreviousLokiRuleConfigMapName: cfg.RulesConfigMap.PreviousName,
+		ConfigMapLabels:               settings.ConfigMapLabels,
+		LokiLabelSelector:             lokiSelector,
+		LokiRulesPath:                 cfg.Loki.RulesMountPath,
+		UpdateLoki:                    !cfg.Features.OnlyReconcileRules,
+		RuleOptions:                   settings.RuleOptions,
+		DryRun:                        cfg.Features.DryRun,
+		Done:                          migrationDone,
+	}).SetupWithManager(mgr); err != nil {
+		log.Error(err, "unable to set up rule file migration")
+		os.Exit(1)
+	}
+
+	if err = (&controllers.LokiRuleTestReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+		Logger: log,
+	}).SetupWithManager(mgr); err != nil {
+		log.Error(err, "unable to create controller", "controller", "LokiRuleTest")
+		os.Exit(1)
 	}
 
-	if err = (&controllers.LokiRuleReconciler{
+	var ruleAdopter *controllers.RuleAdopter
+	if cfg.Features.Adoption.Mode != features.AdoptionModeOff {
+		ruleAdopter = &controllers.RuleAdopter{
+			Client:                mgr.GetClient(),
+			Logger:                log,
+			Recorder:              mgr.GetEventRecorderFor("loki-rule-operator"),
+			LokiClient:            settings.LokiClient,
+			LokiURL:               settings.LokiURL,
+			LokiNamespace:         cfg.Loki.Namespace,
+			LokiRuleConfigMapName: cfg.RulesConfigMap.Name,
+			RuleOptions:           settings.RuleOptions,
+			Namespace:             adoptionNamespace,
+			Mode:                  cfg.Features.Adoption.Mode,
+			Interval:              cfg.Features.Adoption.Interval,
+			DryRun:                cfg.Features.DryRun,
+		}
+		if err = ruleAdopter.SetupWithManager(mgr); err != nil {
+			log.Error(err, "unable to set up rule adoption")
+			os.Exit(1)
+		}
+	}
+
+	// The poller also runs without a Loki URL or an interval, which a reload
+	// may set.
+	ruleHealthPoller := &controllers.RuleHealthPoller{
 		Client:                mgr.GetClient(),
-		Scheme:                mgr.GetScheme(),
 		Logger:                log,
-		LokiClient:            httputil.ClientWithHeaders(&lokiHeaders),
-		LokiRulesPath:         lokiRuleMountPath,
-		LokiLabelSelector:     lokiSelector,
-		LokiNamespace:         lokiNamespace,
-		LokiRuleConfigMapName: "loki-rule-cfg",
-		LokiURL:               lokiURL,
-		UpdateLoki:            !onlyReconcileRules,
-	}).SetupWithManager(mgr); err != nil {
-		log.Error(err, "unable to create controller", "controller", "LokiRule")
+		LokiClient:            settings.LokiClient,
+		LokiURL:               settings.LokiURL,
+		LokiNamespace:         cfg.Loki.Namespace,
+		LokiRuleConfigMapName: cfg.RulesConfigMap.Name,
+		RuleOptions:           settings.RuleOptions,
+		Interval:              settings.RuleHealthInterval,
+		RateLimit:             settings.RuleHealthRateLimit,
+		DryRun:                cfg.Features.DryRun,
+	}
+	if err = ruleHealthPoller.SetupWithManager(mgr); err != nil {
+		log.Error(err, "unable to set up rule health polling")
 		os.Exit(1)
 	}
 
+	var lokiRuleValidator *controllers.LokiRuleValidator
+	if cfg.Features.Webhooks {
+		lokiRuleValidator = &controllers.LokiRuleValidator{
+			Client:      mgr.GetClient(),
+			Quotas:      settings.Quotas,
+			RuleOptions: settings.RuleOptions,
+		}
+		if err = lokiRuleValidator.SetupWebhookWithManager(mgr); err != nil {
+			log.Error(err, "unable to create webhook", "webhook", "LokiRule")
+			os.Exit(1)
+		}
+	}
+
+	if configFile != "" {
+		if err = mgr.Add(&config.Watcher{
+			Path:      configFile,
+			Base:      base,
+			LookupEnv: os.LookupEnv,
+			Logger:    log,
+			Current:   cfg,
+			OnChange: func(previous, current config.Config) {
+				if changed := config.RestartRequired(previous, current); len(changed) > 0 {
+					log.Warn("Changed settings are only applied on restart", "settings", changed)
+				}
+
+				settings := ruleSettings(current)
+				lokiRuleReconciler.ApplySettings(settings)
+				if lokiRuleValidator != nil {
+					lokiRuleValidator.ApplySettings(settings)
+				}
+				if ruleAdopter != nil {
+					ruleAdopter.ApplySettings(settings)
+				}
+				ruleHealthPoller.ApplySettings(settings)
+			},
+		}); err != nil {
+			log.Error(err, "unable to watch the config file")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		log.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+	if err := mgr.AddReadyzCheck("rules-configmap", lokiRuleReconciler.RulesConfigMapReadyCheck); err != nil {
 		log.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	// Loki and its StatefulSet are always served on the metrics port, and are
+	// readiness checks unless disabled, as the webhook fails closed.
+	dependencyChecks.Checks = lokiRuleReconciler.DependencyChecks()
+	if cfg.Features.DependencyReadyChecks {
+		for name, check := range dependencyChecks.Checks {
+			if err := mgr.AddReadyzCheck(name, check); err != nil {
+				log.Error(err, "unable to set up ready check", "check", name)
+				os.Exit(1)
+			}
+		}
+	}
 
-	log.Info("starting manager", "onlyReconcileRules", onlyReconcileRules)
+	log.Info("starting manager", "onlyReconcileRules", cfg.Features.OnlyReconcileRules, "dryRun", cfg.Features.DryRun)
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		log.Error(err, "problem running manager")
 		os.Exit(1)
@@ -0,0 +1,275 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/k8sutils"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// AdminRulesPath serves the RulesReport of the operator on the metrics
+	// server
+	AdminRulesPath = "/debug/rules"
+	// AdminResyncPath triggers a reconcile of all the LokiRules on POST
+	AdminResyncPath = "/debug/resync"
+)
+
+const (
+	// RuleFileStatePending is the state of a rule file whose LokiRule has no condition yet
+	RuleFileStatePending = "Pending"
+	// RuleFileStateQuarantined is the state of a rule file whose LokiRule failed validation
+	RuleFileStateQuarantined = "Quarantined"
+	// RuleFileStateOrphaned is the state of a rule file whose LokiRule no longer exists
+	RuleFileStateOrphaned = "Orphaned"
+)
+
+// RulesReport is the operator's view of the rules ConfigMap.
+type RulesReport struct {
+	// ConfigMap is the namespace/name of the rules ConfigMap
+	ConfigMap string `json:"configMap"`
+	// Checksum of the rule files, empty when the rules ConfigMap does not exist
+	Checksum  string           `json:"checksum,omitempty"`
+	Workload  *WorkloadReport  `json:"workload,omitempty"`
+	RuleFiles []RuleFileReport `json:"ruleFiles"`
+	// UnmanagedFiles are the rule files no LokiRule owns
+	UnmanagedFiles []string `json:"unmanagedFiles"`
+}
+
+// WorkloadReport is the Loki StatefulSet the rules ConfigMap is mounted into.
+type WorkloadReport struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Checksum of the rule files Loki was last restarted with
+	Checksum string `json:"checksum,omitempty"`
+	// Error is why the Loki StatefulSet could not be found
+	Error string `json:"error,omitempty"`
+}
+
+// RuleFileReport is a rule file of the rules ConfigMap owned by a LokiRule.
+type RuleFileReport struct {
+	FileName   string `json:"fileName"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+	SpecHash   string `json:"specHash"`
+	// Pending marks a rule file being adopted by the LokiRule
+	Pending bool `json:"pending,omitempty"`
+	// State is the validation state of the LokiRule: the reason of its
+	// Accepted condition, Quarantined, Pending or Orphaned
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+	// LastSyncTime is when a successful reconcile last wrote the rule file
+	// from the current spec of its LokiRule, or found it up to date. It is
+	// not set until then, e.g. while the LokiRule is quarantined.
+	LastSyncTime *time.Time `json:"lastSyncTime,omitempty"`
+}
+
+// recordSync records the rule files of the rules ConfigMap that the
+// reconcile converged to their LokiRule as synced now, and forgets the ones
+// no longer in it. A nil configMap forgets them all.
+func (r *LokiRuleReconciler) recordSync(configMap *corev1.ConfigMap, states []*ruleState) {
+	now := time.Now()
+
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+
+	lastSync := map[string]time.Time{}
+	if configMap != nil {
+		for fileName, syncedAt := range r.lastSync {
+			if _, ok := configMap.Data[fileName]; ok {
+				lastSync[fileName] = syncedAt
+			}
+		}
+	}
+	for _, state := range states {
+		if state.invalidErr != nil || state.validationErr != nil || state.quotaErr != nil || state.conflictErr != nil {
+			continue
+		}
+		for fileName := range state.ruleFiles {
+			lastSync[fileName] = now
+		}
+	}
+	r.lastSync = lastSync
+}
+
+// ReportRules returns the rule files of the rules ConfigMap with the LokiRule
+// each one is rendered from and its validation state.
+func (r *LokiRuleReconciler) ReportRules(ctx context.Context) (*RulesReport, error) {
+	key := types.NamespacedName{Namespace: r.LokiNamespace, Name: r.LokiRuleConfigMapName}
+	report := &RulesReport{
+		ConfigMap:      key.String(),
+		RuleFiles:      []RuleFileReport{},
+		UnmanagedFiles: []string{},
+	}
+
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}}
+	err := r.Get(ctx, key, configMap)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		if report.Checksum, err = k8sutils.HashConfigMapData(configMap); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.UpdateLoki {
+		report.Workload = r.reportWorkload(ctx)
+	}
+
+	r.settingsMu.RLock()
+	ruleOptions := r.RuleOptions
+	r.settingsMu.RUnlock()
+
+	appliedRules, err := GetAppliedRules(ctx, r.Client, configMap, ruleOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := &querocomv1alpha1.LokiRuleList{}
+	if err := r.List(ctx, rules); err != nil {
+		return nil, err
+	}
+	rulesByKey := make(map[types.NamespacedName]*querocomv1alpha1.LokiRule, len(rules.Items))
+	for i := range rules.Items {
+		rulesByKey[client.ObjectKeyFromObject(&rules.Items[i])] = &rules.Items[i]
+	}
+
+	for fileName := range configMap.Data {
+		appliedRule, ok := appliedRules[fileName]
+		if !ok {
+			report.UnmanagedFiles = append(report.UnmanagedFiles, fileName)
+			continue
+		}
+
+		ruleFile := RuleFileReport{
+			FileName:   fileName,
+			Namespace:  appliedRule.Namespace,
+			Name:       appliedRule.Name,
+			Generation: appliedRule.Generation,
+			SpecHash:   appliedRule.SpecHash,
+			Pending:    appliedRule.Pending,
+		}
+		ruleFile.State, ruleFile.Message = ruleFileState(
+			rulesByKey[types.NamespacedName{Namespace: appliedRule.Namespace, Name: appliedRule.Name}],
+		)
+		r.syncMu.Lock()
+		if syncedAt, ok := r.lastSync[fileName]; ok {
+			ruleFile.LastSyncTime = &syncedAt
+		}
+		r.syncMu.Unlock()
+		report.RuleFiles = append(report.RuleFiles, ruleFile)
+	}
+
+	sort.Slice(report.RuleFiles, func(i, j int) bool {
+		return report.RuleFiles[i].FileName < report.RuleFiles[j].FileName
+	})
+	sort.Strings(report.UnmanagedFiles)
+
+	return report, nil
+}
+
+func (r *LokiRuleReconciler) reportWorkload(ctx context.Context) *WorkloadReport {
+	workload := &WorkloadReport{Namespace: r.LokiNamespace}
+
+	lokiStatefulSet, err := getLokiStatefulSet(ctx, r.Client, r.LokiLabelSelector, r.LokiNamespace, r.Logger)
+	if err != nil {
+		workload.Error = err.Error()
+		return workload
+	}
+
+	workload.Name = lokiStatefulSet.Name
+	workload.Checksum = lokiStatefulSet.Spec.Template.Annotations[k8sutils.ChecksumAnnotation(r.LokiRuleConfigMapName)]
+	return workload
+}
+
+// ruleFileState returns the validation state of the LokiRule and its message.
+func ruleFileState(rule *querocomv1alpha1.LokiRule) (string, string) {
+	if rule == nil {
+		return RuleFileStateOrphaned, ""
+	}
+
+	quarantined := meta.FindStatusCondition(rule.Status.Conditions, querocomv1alpha1.ConditionQuarantined)
+	if quarantined != nil && quarantined.Status == metav1.ConditionTrue {
+		return RuleFileStateQuarantined, quarantined.Message
+	}
+
+	accepted := meta.FindStatusCondition(rule.Status.Conditions, querocomv1alpha1.ConditionAccepted)
+	if accepted == nil {
+		return RuleFileStatePending, ""
+	}
+	return accepted.Reason, accepted.Message
+}
+
+// ServeRules serves the RulesReport as JSON.
+func (r *LokiRuleReconciler) ServeRules(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	report, err := r.ReportRules(req.Context())
+	if err != nil {
+		r.Logger.Error(err, "Failed to report the rule files")
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// ServeResync triggers a reconcile of all the LokiRules on POST.
+func (r *LokiRuleReconciler) ServeResync(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	r.Logger.Info("Resync requested")
+	r.Resync()
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "resync requested"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// AdminHandler serves the admin endpoints of Reconciler under their path, on
+// the metrics server. The metrics server is created with the manager, before
+// the reconciler, so Reconciler is set once it is created and the endpoints
+// answer 503 until then.
+type AdminHandler struct {
+	Reconciler *LokiRuleReconciler
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.Reconciler == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "not started"})
+		return
+	}
+
+	switch req.URL.Path {
+	case AdminRulesPath:
+		h.Reconciler.ServeRules(w, req)
+	case AdminResyncPath:
+		h.Reconciler.ServeResync(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	"github.com/quero-edu/loki-rule-operator/pkg/k8sutils"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestServeRules(t *testing.T) {
+	rule := newLokiRule("default", "errors")
+	rule.Status.Conditions = []metav1.Condition{{
+		Type:    querocomv1alpha1.ConditionQuarantined,
+		Status:  metav1.ConditionTrue,
+		Reason:  querocomv1alpha1.ReasonInvalidRule,
+		Message: "Keeping the last known-good rule file",
+	}}
+
+	rulesConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "loki-rule-cfg",
+			Namespace: "loki",
+			Annotations: map[string]string{
+				lokirule.AppliedRulesAnnotation: `{"default_errors.yaml":{"namespace":"default","name":"errors","generation":1,` +
+					`"specHash":"abc"},"default_gone.yaml":{"namespace":"default","name":"gone","generation":3}}`,
+			},
+		},
+		Data: map[string]string{
+			"default_errors.yaml": unmanagedRuleFile,
+			"default_gone.yaml":   unmanagedRuleFile,
+			"manual.yaml":         unmanagedRuleFile,
+		},
+	}
+	checksum, err := k8sutils.HashConfigMapData(rulesConfigMap)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	lokiStatefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "loki", Namespace: "loki", Labels: map[string]string{"app": "loki"}},
+		Spec: appsv1.StatefulSetSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{k8sutils.ChecksumAnnotation("loki-rule-cfg"): "previous"},
+				},
+			},
+		},
+	}
+
+	r := newFakeReconciler(t, rule, rulesConfigMap, lokiStatefulSet)
+	r.LokiLabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "loki"}}
+	r.UpdateLoki = true
+
+	recorder := httptest.NewRecorder()
+	r.ServeRules(recorder, httptest.NewRequest(http.MethodGet, AdminRulesPath, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d %s", recorder.Code, recorder.Body)
+	}
+
+	report := &RulesReport{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), report); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if report.ConfigMap != "loki/loki-rule-cfg" || report.Checksum != checksum {
+		t.Errorf("Expected the rules ConfigMap checksum, got: %+v", report)
+	}
+	if *report.Workload != (WorkloadReport{Namespace: "loki", Name: "loki", Checksum: "previous"}) {
+		t.Errorf("Expected the Loki StatefulSet, got: %+v", report.Workload)
+	}
+
+	expected := []RuleFileReport{
+		{
+			FileName:   "default_errors.yaml",
+			Namespace:  "default",
+			Name:       "errors",
+			Generation: 1,
+			SpecHash:   "abc",
+			State:      RuleFileStateQuarantined,
+			Message:    "Keeping the last known-good rule file",
+		},
+		{FileName: "default_gone.yaml", Namespace: "default", Name: "gone", Generation: 3, State: RuleFileStateOrphaned},
+	}
+	if !reflect.DeepEqual(report.RuleFiles, expected) {
+		t.Errorf("Expected %+v, got: %+v", expected, report.RuleFiles)
+	}
+	if !reflect.DeepEqual(report.UnmanagedFiles, []string{"manual.yaml"}) {
+		t.Errorf("Expected manual.yaml to be unmanaged, got: %v", report.UnmanagedFiles)
+	}
+}
+
+func TestServeResync(t *testing.T) {
+	r := &LokiRuleReconciler{
+		Logger:                logger.NewNopLogger(),
+		LokiNamespace:         "loki",
+		LokiRuleConfigMapName: "loki-rule-cfg",
+		resync:                make(chan event.GenericEvent, 1),
+	}
+
+	recorder := httptest.NewRecorder()
+	r.ServeResync(recorder, httptest.NewRequest(http.MethodGet, AdminResyncPath, nil))
+	if recorder.Code != http.StatusMethodNotAllowed || len(r.resync) != 0 {
+		t.Errorf("Expected a GET not to resync, got: %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	r.ServeResync(recorder, httptest.NewRequest(http.MethodPost, AdminResyncPath, nil))
+	if recorder.Code != http.StatusAccepted || len(r.resync) != 1 {
+		t.Errorf("Expected a resync to be requested, got: %d", recorder.Code)
+	}
+}
+
+func TestReportRulesSyncTimes(t *testing.T) {
+	valid := newLokiRule("default", "errors")
+	invalid := newLokiRule("default", "invalid")
+	invalid.Spec.Groups[0].Rules[0].Record = "not a metric name"
+
+	// The invalid LokiRule was written before it was changed.
+	rulesConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "loki-rule-cfg",
+			Namespace: "loki",
+			Annotations: map[string]string{
+				lokirule.AppliedRulesAnnotation: `{"default_invalid.yaml":{"namespace":"default","name":"invalid"}}`,
+			},
+		},
+		Data: map[string]string{"default_invalid.yaml": unmanagedRuleFile},
+	}
+
+	r := newFakeReconciler(t, valid, invalid, rulesConfigMap)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}}
+	if _, err := r.Reconcile(context.TODO(), req); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	report, err := r.ReportRules(context.TODO())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	synced := map[string]bool{}
+	for _, ruleFile := range report.RuleFiles {
+		synced[ruleFile.FileName] = ruleFile.LastSyncTime != nil
+	}
+	expected := map[string]bool{"default_errors.yaml": true, "default_invalid.yaml": false}
+	if !reflect.DeepEqual(synced, expected) {
+		t.Errorf("Expected only the rule file of the valid LokiRule to be synced, got: %+v", report.RuleFiles)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	handler := &AdminHandler{}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, AdminRulesPath, nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the endpoints to be unavailable before the reconciler is created, got: %d", recorder.Code)
+	}
+
+	handler.Reconciler = &LokiRuleReconciler{
+		Logger:                logger.NewNopLogger(),
+		LokiNamespace:         "loki",
+		LokiRuleConfigMapName: "loki-rule-cfg",
+		resync:                make(chan event.GenericEvent, 1),
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, AdminResyncPath, nil))
+	if recorder.Code != http.StatusAccepted || len(handler.Reconciler.resync) != 1 {
+		t.Errorf("Expected a resync to be requested, got: %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/other", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown path not to be found, got: %d", recorder.Code)
+	}
+}
@@ -0,0 +1,290 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	"github.com/quero-edu/loki-rule-operator/pkg/features"
+	"github.com/quero-edu/loki-rule-operator/pkg/k8sutils"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AdoptedFromAnnotation is set on the LokiRules created by adoption to the
+// rule file their rules were found in, e.g. "configmap:errors.yaml".
+const AdoptedFromAnnotation = "loki-rule-operator.quero.com/adopted-from"
+
+const (
+	// RuleSourceConfigMap is a rule file of the rules ConfigMap
+	RuleSourceConfigMap = "configmap"
+	// RuleSourceRuler is a rule namespace of the Loki ruler API
+	RuleSourceRuler = "ruler"
+)
+
+const (
+	reasonUnmanagedRules = "UnmanagedRules"
+	reasonRulesAdopted   = "RulesAdopted"
+)
+
+// UnmanagedRules are rules found in the rules ConfigMap or the Loki ruler
+// that were not rendered from a LokiRule.
+type UnmanagedRules struct {
+	// Source is RuleSourceConfigMap or RuleSourceRuler
+	Source string
+	// FileName is the rules ConfigMap key or the ruler rule namespace
+	FileName string
+	// Content is the rule file
+	Content []byte
+}
+
+func (u UnmanagedRules) String() string {
+	return u.Source + ":" + u.FileName
+}
+
+// RuleAdopter periodically looks for unmanaged rules and, depending on Mode,
+// reports them or adopts them as LokiRules created in Namespace. Adopted rule
+// files are recorded as rendered from their LokiRule, so they are replaced by
+// its rule file once it is reconciled. Rules only the Loki ruler serves are
+// always reported, as they cannot be replaced.
+type RuleAdopter struct {
+	client.Client
+	Logger                logger.Logger
+	Recorder              record.EventRecorder
+	LokiClient            *http.Client
+	LokiURL               string
+	LokiNamespace         string
+	LokiRuleConfigMapName string
+	// RuleOptions are the options the LokiRules are rendered with
+	RuleOptions lokirule.Options
+	Namespace   string
+	Mode        string
+	Interval    time.Duration
+	// DryRun logs the LokiRules that would be created instead of creating them
+	DryRun bool
+
+	// settingsMu guards the settings ApplySettings replaces
+	settingsMu sync.RWMutex
+}
+
+func (a *RuleAdopter) SetupWithManager(mgr ctrl.Manager) error {
+	return mgr.Add(a)
+}
+
+// NeedLeaderElection makes only the leader adopt rules.
+func (a *RuleAdopter) NeedLeaderElection() bool {
+	return true
+}
+
+// Start runs Adopt every Interval until ctx is done.
+func (a *RuleAdopter) Start(ctx context.Context) error {
+	for {
+		if err := a.Adopt(ctx); err != nil {
+			a.Logger.Error(err, "Failed to adopt unmanaged rules")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(a.Interval):
+		}
+	}
+}
+
+func (a *RuleAdopter) recordEvent(configMap *corev1.ConfigMap, eventType, reason, message string) {
+	if a.Recorder == nil || configMap == nil {
+		return
+	}
+
+	a.Recorder.Event(configMap, eventType, reason, message)
+}
+
+// FindUnmanagedRules returns the rules ConfigMap, nil when it does not exist,
+// and the rules it or the Loki ruler hold that were not rendered from a
+// LokiRule. Rule files marked by a previous adoption but not yet replaced are
+// returned again, so an interrupted adoption is resumed.
+func (a *RuleAdopter) FindUnmanagedRules(ctx context.Context) (*corev1.ConfigMap, []UnmanagedRules, error) {
+	configMap := &corev1.ConfigMap{}
+	err := a.Get(ctx, types.NamespacedName{Namespace: a.LokiNamespace, Name: a.LokiRuleConfigMapName}, configMap)
+	if apierrors.IsNotFound(err) {
+		configMap = nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var unmanaged []UnmanagedRules
+	fileNames := map[string]bool{}
+
+	a.settingsMu.RLock()
+	lokiClient, lokiURL, ruleOptions := a.LokiClient, a.LokiURL, a.RuleOptions
+	a.settingsMu.RUnlock()
+
+	if configMap != nil {
+		appliedRules, err := GetAppliedRules(ctx, a.Client, configMap, ruleOptions)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for fileName, content := range configMap.Data {
+			fileNames[fileName] = true
+			if appliedRule, ok := appliedRules[fileName]; ok && !appliedRule.Pending {
+				continue
+			}
+			unmanaged = append(unmanaged, UnmanagedRules{
+				Source:   RuleSourceConfigMap,
+				FileName: fileName,
+				Content:  []byte(content),
+			})
+		}
+	}
+
+	if lokiURL != "" {
+		rulerGroups, err := GetRulerRuleGroups(ctx, lokiClient, lokiURL)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for namespace, groups := range rulerGroups {
+			// The local storage ruler loads the rules ConfigMap files.
+			if fileNames[namespace] {
+				continue
+			}
+
+			content, err := yaml.Marshal(lokirule.RuleGroups{Groups: groups})
+			if err != nil {
+				return nil, nil, err
+			}
+			unmanaged = append(unmanaged, UnmanagedRules{
+				Source:   RuleSourceRuler,
+				FileName: namespace,
+				Content:  content,
+			})
+		}
+	}
+
+	sort.Slice(unmanaged, func(i, j int) bool {
+		return unmanaged[i].String() < unmanaged[j].String()
+	})
+
+	return configMap, unmanaged, nil
+}
+
+// Adopt reports or adopts the unmanaged rules, depending on Mode.
+func (a *RuleAdopter) Adopt(ctx context.Context) error {
+	if a.Mode == features.AdoptionModeOff {
+		return nil
+	}
+
+	configMap, unmanaged, err := a.FindUnmanagedRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, rules := range unmanaged {
+		if err := a.adopt(ctx, configMap, rules); err != nil {
+			a.recordEvent(configMap, corev1.EventTypeWarning, reasonUnmanagedRules, fmt.Sprintf("%s: %s", rules, err))
+			errs = append(errs, fmt.Errorf("%s: %w", rules, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (a *RuleAdopter) adopt(ctx context.Context, configMap *corev1.ConfigMap, rules UnmanagedRules) error {
+	rule, err := lokirule.ImportRuleFile(rules.FileName, rules.Content, a.Namespace)
+	if err != nil {
+		return fmt.Errorf("cannot be adopted: %w", err)
+	}
+
+	if a.Mode == features.AdoptionModeReport {
+		a.Logger.Info("Found unmanaged rules", "source", rules.String(), "namespace", rule.Namespace, "name", rule.Name)
+		a.recordEvent(configMap, corev1.EventTypeNormal, reasonUnmanagedRules, fmt.Sprintf(
+			"%s is not managed by a LokiRule, it would be adopted as %s/%s", rules, rule.Namespace, rule.Name,
+		))
+		return nil
+	}
+
+	// Rules only the ruler serves live in a storage the operator cannot mark
+	// or remove them from, so a LokiRule created for them would duplicate
+	// them in the ruler. They are only reported, even in create mode.
+	if rules.Source == RuleSourceRuler {
+		a.Logger.Info("Found unmanaged ruler rules", "source", rules.String(), "namespace", rule.Namespace, "name", rule.Name)
+		a.recordEvent(configMap, corev1.EventTypeNormal, reasonUnmanagedRules, fmt.Sprintf(
+			"%s is not managed by a LokiRule and is only served by the ruler, create LokiRule %s/%s "+
+				"and remove it from the ruler storage to adopt it", rules, rule.Namespace, rule.Name,
+		))
+		return nil
+	}
+
+	rule.Annotations = map[string]string{AdoptedFromAnnotation: rules.String()}
+
+	existing := &querocomv1alpha1.LokiRule{}
+	err = a.Get(ctx, client.ObjectKeyFromObject(rule), existing)
+	if err == nil && existing.Annotations[AdoptedFromAnnotation] != rules.String() {
+		return fmt.Errorf("cannot be adopted: LokiRule %s/%s already exists", rule.Namespace, rule.Name)
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+
+	a.settingsMu.RLock()
+	ruleOptions := a.RuleOptions
+	a.settingsMu.RUnlock()
+
+	// Mark the rule file before creating the LokiRule, so its first reconcile
+	// replaces the file instead of duplicating its rules.
+	_, _, err = updateRuleFiles(
+		ctx,
+		a.Client,
+		a.LokiNamespace,
+		a.LokiRuleConfigMapName,
+		ruleOptions,
+		func(_ *corev1.ConfigMap, appliedRules map[string]AppliedRule) error {
+			markRuleFile(appliedRules, rules.FileName, rule.Namespace, rule.Name)
+			return nil
+		},
+		k8sutils.Options{Ctx: ctx, Logger: a.Logger, DryRun: a.DryRun},
+	)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	var createOpts []client.CreateOption
+	if a.DryRun {
+		createOpts = append(createOpts, client.DryRunAll)
+	}
+
+	if err := a.Create(ctx, rule, createOpts...); err != nil {
+		return err
+	}
+
+	if a.DryRun {
+		a.Logger.Info("Dry run, LokiRule not created", "source", rules.String(), "namespace", rule.Namespace, "name", rule.Name)
+		return nil
+	}
+
+	a.Logger.Info("Adopted unmanaged rules", "source", rules.String(), "namespace", rule.Namespace, "name", rule.Name)
+	a.recordEvent(configMap, corev1.EventTypeNormal, reasonRulesAdopted, fmt.Sprintf(
+		"%s adopted as LokiRule %s/%s", rules, rule.Namespace, rule.Name,
+	))
+
+	return nil
+}
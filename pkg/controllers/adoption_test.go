@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	"github.com/quero-edu/loki-rule-operator/pkg/features"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const unmanagedRuleFile = `groups:
+- name: errors
+  rules:
+  - alert: HighErrorRate
+    expr: sum(rate({app="api"} |= "error" [1m])) > 10
+`
+
+func newRuleAdopter(t *testing.T, mode string, objects ...client.Object) *RuleAdopter {
+	rulesConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "loki-rule-cfg",
+			Namespace:   "loki",
+			Annotations: map[string]string{lokirule.AppliedRulesAnnotation: `{"default_managed.yaml":{"generation":1}}`},
+		},
+		Data: map[string]string{
+			"errors.yaml":          unmanagedRuleFile,
+			"default_managed.yaml": unmanagedRuleFile,
+		},
+	}
+
+	cli := newFakeClientBuilder(t, append(objects, rulesConfigMap)...).Build()
+
+	return &RuleAdopter{
+		Client:                cli,
+		Logger:                logger.NewNopLogger(),
+		LokiNamespace:         "loki",
+		LokiRuleConfigMapName: "loki-rule-cfg",
+		Namespace:             "monitoring",
+		Mode:                  mode,
+	}
+}
+
+func getRulesConfigMap(t *testing.T, a *RuleAdopter) *corev1.ConfigMap {
+	configMap := &corev1.ConfigMap{}
+	if err := a.Get(context.TODO(), types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}, configMap); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return configMap
+}
+
+func TestRuleAdopterReport(t *testing.T) {
+	a := newRuleAdopter(t, features.AdoptionModeReport)
+
+	_, unmanaged, err := a.FindUnmanagedRules(context.TODO())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(unmanaged) != 1 || unmanaged[0].String() != "configmap:errors.yaml" {
+		t.Fatalf("Expected only errors.yaml to be unmanaged, got: %v", unmanaged)
+	}
+
+	if err := a.Adopt(context.TODO()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	err = a.Get(context.TODO(), types.NamespacedName{Namespace: "monitoring", Name: "errors"}, &querocomv1alpha1.LokiRule{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("Expected no LokiRule to be created, got: %v", err)
+	}
+}
+
+func TestRuleAdopterCreate(t *testing.T) {
+	a := newRuleAdopter(t, features.AdoptionModeCreate)
+
+	if err := a.Adopt(context.TODO()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	rule := &querocomv1alpha1.LokiRule{}
+	if err := a.Get(context.TODO(), types.NamespacedName{Namespace: "monitoring", Name: "errors"}, rule); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if rule.Annotations[AdoptedFromAnnotation] != "configmap:errors.yaml" {
+		t.Errorf("Expected the adopted-from annotation, got: %v", rule.Annotations)
+	}
+	if rule.Spec.Groups[0].Rules[0].Alert != "HighErrorRate" {
+		t.Errorf("Expected the rules to be adopted, got: %v", rule.Spec)
+	}
+
+	configMap := getRulesConfigMap(t, a)
+	appliedRules, err := GetAppliedRules(context.TODO(), a, configMap, lokirule.Options{})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if appliedRules["errors.yaml"] != (AppliedRule{Namespace: "monitoring", Name: "errors", Pending: true}) {
+		t.Errorf("Expected errors.yaml to be marked, got: %v", appliedRules)
+	}
+
+	// Adopting again resumes instead of failing on the existing LokiRule.
+	if err := a.Adopt(context.TODO()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// The adopted rule file is kept until its LokiRule is written.
+	convergeRuleFiles(configMap, appliedRules, nil, lokirule.Quotas{})
+	if _, ok := configMap.Data["errors.yaml"]; !ok {
+		t.Errorf("Expected errors.yaml to be kept, got: %v", configMap.Data)
+	}
+
+	// The first rule file written for the LokiRule replaces the adopted one.
+	convergeRuleFiles(configMap, appliedRules, []*ruleState{{
+		rule:      rule,
+		ruleFiles: map[string]string{"monitoring_errors.yaml": unmanagedRuleFile},
+		specHash:  "hash",
+	}}, lokirule.Quotas{})
+	if _, ok := configMap.Data["errors.yaml"]; ok {
+		t.Errorf("Expected errors.yaml to be replaced, got: %v", configMap.Data)
+	}
+}
+
+func TestRuleAdopterConflict(t *testing.T) {
+	existing := &querocomv1alpha1.LokiRule{ObjectMeta: metav1.ObjectMeta{Name: "errors", Namespace: "monitoring"}}
+	a := newRuleAdopter(t, features.AdoptionModeCreate, existing)
+
+	err := a.Adopt(context.TODO())
+	if err == nil || !strings.Contains(err.Error(), "LokiRule monitoring/errors already exists") {
+		t.Fatalf("Expected a conflict, got: %v", err)
+	}
+
+	appliedRules, err := GetAppliedRules(context.TODO(), a, getRulesConfigMap(t, a), lokirule.Options{})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, ok := appliedRules["errors.yaml"]; ok {
+		t.Errorf("Expected errors.yaml not to be marked, got: %v", appliedRules)
+	}
+}
+
+func TestRuleAdopterRuler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/loki/api/v1/rules" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("errors.yaml:\n- name: errors\n  rules: []\nlatency.yaml:\n" +
+			"- name: latency\n  rules:\n  - record: app:latency\n    expr: vector(1)\n"))
+	}))
+	defer server.Close()
+
+	a := newRuleAdopter(t, features.AdoptionModeCreate)
+	a.LokiClient = server.Client()
+	a.LokiURL = server.URL
+
+	_, unmanaged, err := a.FindUnmanagedRules(context.TODO())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(unmanaged) != 2 || unmanaged[1].String() != "ruler:latency.yaml" {
+		t.Fatalf("Expected latency.yaml to be found in the ruler, got: %v", unmanaged)
+	}
+
+	if err := a.Adopt(context.TODO()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	err = a.Get(context.TODO(), types.NamespacedName{Namespace: "monitoring", Name: "latency"}, &querocomv1alpha1.LokiRule{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the ruler rules to only be reported, got: %v", err)
+	}
+}
@@ -0,0 +1,563 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/k8sutils"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AppliedRule identifies the version of a LokiRule written to a rule file.
+// A zero Generation is an unknown version, e.g. for rule files written before
+// the applied rules were recorded.
+type AppliedRule struct {
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+	SpecHash   string `json:"specHash"`
+	// Pending marks a rule file being adopted by the LokiRule, which is
+	// replaced by its first rendered rule file.
+	Pending bool `json:"pending,omitempty"`
+}
+
+// RuleFileConflictError reports that the rule file of a LokiRule already
+// exists in the rules ConfigMap and is not owned by the LokiRule.
+type RuleFileConflictError struct {
+	FileName string
+	// Owner is the LokiRule owning the rule file, nil when the operator does
+	// not manage it.
+	Owner *AppliedRule
+}
+
+func (e *RuleFileConflictError) Error() string {
+	if e.Owner == nil {
+		return fmt.Sprintf("rule file %s already exists in the rules ConfigMap and is not managed by the operator", e.FileName)
+	}
+
+	return fmt.Sprintf("rule file %s is already managed by LokiRule %s/%s", e.FileName, e.Owner.Namespace, e.Owner.Name)
+}
+
+func newAppliedRule(rule *querocomv1alpha1.LokiRule, specHash string) AppliedRule {
+	return AppliedRule{
+		Namespace:  rule.Namespace,
+		Name:       rule.Name,
+		Generation: rule.Generation,
+		SpecHash:   specHash,
+	}
+}
+
+// GetAppliedRules returns the applied rules of the rules ConfigMap, keyed by
+// rule file name. They are stored in its applied rules ConfigMap, one entry
+// per rule file. A rules ConfigMap written before it existed has them in its
+// legacy applied rules annotation or, written before that, has them
+// bootstrapped from the rule files of the existing LokiRules, named with the
+// rule options.
+func GetAppliedRules(
+	ctx context.Context,
+	reader client.Reader,
+	configMap *corev1.ConfigMap,
+	options lokirule.Options,
+) (map[string]AppliedRule, error) {
+	appliedRules, _, err := loadAppliedRules(ctx, reader, configMap, options)
+	return appliedRules, err
+}
+
+// loadAppliedRules returns the applied rules of the rules ConfigMap and the
+// ones stored in its applied rules ConfigMap, none when it does not exist.
+func loadAppliedRules(
+	ctx context.Context,
+	reader client.Reader,
+	configMap *corev1.ConfigMap,
+	options lokirule.Options,
+) (map[string]AppliedRule, map[string]AppliedRule, error) {
+	stored := map[string]AppliedRule{}
+
+	appliedRulesConfigMap := &corev1.ConfigMap{}
+	err := reader.Get(ctx, types.NamespacedName{
+		Namespace: configMap.Namespace,
+		Name:      lokirule.AppliedRulesConfigMapName(configMap.Name),
+	}, appliedRulesConfigMap)
+	if err == nil {
+		for fileName, value := range appliedRulesConfigMap.Data {
+			var appliedRule AppliedRule
+			if err := json.Unmarshal([]byte(value), &appliedRule); err != nil {
+				return nil, nil, fmt.Errorf("invalid applied rule %s: %w", fileName, err)
+			}
+			stored[fileName] = appliedRule
+		}
+
+		appliedRules := make(map[string]AppliedRule, len(stored))
+		for fileName, appliedRule := range stored {
+			appliedRules[fileName] = appliedRule
+		}
+		return appliedRules, stored, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, nil, err
+	}
+
+	if value, ok := configMap.Annotations[lokirule.AppliedRulesAnnotation]; ok {
+		appliedRules := map[string]AppliedRule{}
+		if err := json.Unmarshal([]byte(value), &appliedRules); err != nil {
+			return nil, nil, fmt.Errorf("invalid %s annotation: %w", lokirule.AppliedRulesAnnotation, err)
+		}
+		return appliedRules, stored, nil
+	}
+
+	appliedRules, err := bootstrapAppliedRules(ctx, reader, configMap, options)
+	return appliedRules, stored, err
+}
+
+// writeAppliedRules sets and removes entries of the applied rules ConfigMap
+// of the rules ConfigMap, creating it when needed. Only the given entries are
+// written, so the ones written concurrently are kept. It returns the applied
+// rules ConfigMap when it was written, nil otherwise.
+func writeAppliedRules(
+	cli client.Client,
+	configMap *corev1.ConfigMap,
+	set map[string]AppliedRule,
+	remove []string,
+	options k8sutils.Options,
+) (*corev1.ConfigMap, error) {
+	if len(set) == 0 && len(remove) == 0 {
+		return nil, nil
+	}
+
+	name := lokirule.AppliedRulesConfigMapName(configMap.Name)
+	if len(set) > 0 {
+		labels := map[string]string{"app.kubernetes.io/managed-by": "loki-rule-operator"}
+		if _, err := k8sutils.CreateConfigMap(cli, configMap.Namespace, name, labels, options); err != nil {
+			return nil, err
+		}
+	}
+
+	values := make(map[string]string, len(set))
+	for fileName, appliedRule := range set {
+		value, err := json.Marshal(appliedRule)
+		if err != nil {
+			return nil, err
+		}
+		values[fileName] = string(value)
+	}
+
+	appliedRulesConfigMap, err := k8sutils.UpdateConfigMap(
+		cli,
+		configMap.Namespace,
+		name,
+		func(appliedRulesConfigMap *corev1.ConfigMap) error {
+			if appliedRulesConfigMap.Data == nil {
+				appliedRulesConfigMap.Data = map[string]string{}
+			}
+			for fileName, value := range values {
+				appliedRulesConfigMap.Data[fileName] = value
+			}
+			for _, fileName := range remove {
+				delete(appliedRulesConfigMap.Data, fileName)
+			}
+			return nil
+		},
+		options,
+	)
+	// Nothing is left to remove without the applied rules ConfigMap, and it
+	// is only created in a dry run.
+	if apierrors.IsNotFound(err) && (len(set) == 0 || options.DryRun) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return appliedRulesConfigMap, nil
+}
+
+// updateRuleFiles updates the rules ConfigMap with mutate, which is given its
+// applied rules to change along with its rule files. The applied rules are
+// written once the rules ConfigMap is, so a failed or retried write of the
+// rules ConfigMap never records rule files it does not hold. A rule file left
+// unrecorded by a failure in between is claimed back by the LokiRule it was
+// rendered from, see ruleFileConflict. The legacy applied rules annotation is
+// removed from the rules ConfigMap, as the applied rules ConfigMap replaces it.
+// It returns the rules ConfigMap and the applied rules ConfigMap when it was
+// written, nil otherwise.
+func updateRuleFiles(
+	ctx context.Context,
+	cli client.Client,
+	namespace string,
+	name string,
+	ruleOptions lokirule.Options,
+	mutate func(configMap *corev1.ConfigMap, appliedRules map[string]AppliedRule) error,
+	options k8sutils.Options,
+) (*corev1.ConfigMap, *corev1.ConfigMap, error) {
+	var (
+		changed map[string]AppliedRule
+		removed []string
+	)
+	configMap, err := k8sutils.UpdateConfigMap(
+		cli,
+		namespace,
+		name,
+		func(configMap *corev1.ConfigMap) error {
+			appliedRules, stored, err := loadAppliedRules(ctx, cli, configMap, ruleOptions)
+			if err != nil {
+				return err
+			}
+			if err := mutate(configMap, appliedRules); err != nil {
+				return err
+			}
+			delete(configMap.Annotations, lokirule.AppliedRulesAnnotation)
+
+			changed = map[string]AppliedRule{}
+			for fileName, appliedRule := range appliedRules {
+				if current, ok := stored[fileName]; !ok || current != appliedRule {
+					changed[fileName] = appliedRule
+				}
+			}
+			removed = nil
+			for fileName := range stored {
+				if _, ok := appliedRules[fileName]; !ok {
+					removed = append(removed, fileName)
+				}
+			}
+			sort.Strings(removed)
+
+			return nil
+		},
+		options,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	appliedRulesConfigMap, err := writeAppliedRules(cli, configMap, changed, removed, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return configMap, appliedRulesConfigMap, nil
+}
+
+// ownedRuleFiles returns the names of the rule files recorded as rendered
+// from the LokiRule namespace/name.
+func ownedRuleFiles(appliedRules map[string]AppliedRule, namespace, name string) []string {
+	var fileNames []string
+	for fileName, appliedRule := range appliedRules {
+		if appliedRule.Namespace == namespace && appliedRule.Name == name {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	return fileNames
+}
+
+// bootstrapAppliedRules returns the rule files of the existing LokiRules in a
+// rules ConfigMap written before the operator tracked the rule files it owns,
+// under their rule file name or, when there is none, their legacy name. Their
+// version is unknown, so they are rewritten on the next reconcile of their
+// LokiRule.
+func bootstrapAppliedRules(
+	ctx context.Context,
+	reader client.Reader,
+	configMap *corev1.ConfigMap,
+	options lokirule.Options,
+) (map[string]AppliedRule, error) {
+	appliedRules := map[string]AppliedRule{}
+	if len(configMap.Data) == 0 {
+		return appliedRules, nil
+	}
+
+	rules := &querocomv1alpha1.LokiRuleList{}
+	if err := reader.List(ctx, rules); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules.Items {
+		fileName, err := lokirule.RuleFileName(&rule, options)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := configMap.Data[fileName]; !ok {
+			fileName = lokirule.LegacyRuleFileName(&rule)
+		}
+		if _, ok := configMap.Data[fileName]; ok {
+			appliedRules[fileName] = AppliedRule{Namespace: rule.Namespace, Name: rule.Name}
+		}
+	}
+
+	return appliedRules, nil
+}
+
+// renameRuleFiles renames the rule files owned by the LokiRules to their rule
+// file name, returning the new name of every renamed file. A rule file whose
+// new name is already used by another rule file is left to the reconcile of
+// its LokiRule, which reports the conflict.
+func renameRuleFiles(
+	configMap *corev1.ConfigMap,
+	appliedRules map[string]AppliedRule,
+	rules []querocomv1alpha1.LokiRule,
+	options lokirule.Options,
+) (map[string]string, error) {
+	renamed := map[string]string{}
+	for _, rule := range rules {
+		fileName, err := lokirule.RuleFileName(&rule, options)
+		if err != nil {
+			return nil, err
+		}
+
+		ownedFileNames := ownedRuleFiles(appliedRules, rule.Namespace, rule.Name)
+		sort.Strings(ownedFileNames)
+
+		for _, ownedFileName := range ownedFileNames {
+			appliedRule := appliedRules[ownedFileName]
+			if ownedFileName == fileName || appliedRule.Pending {
+				continue
+			}
+
+			if _, ok := configMap.Data[fileName]; ok {
+				owner, ok := appliedRules[fileName]
+				if !ok || owner.Namespace != rule.Namespace || owner.Name != rule.Name {
+					continue
+				}
+			} else {
+				configMap.Data[fileName] = configMap.Data[ownedFileName]
+				appliedRules[fileName] = appliedRule
+				renamed[ownedFileName] = fileName
+			}
+
+			delete(configMap.Data, ownedFileName)
+			delete(appliedRules, ownedFileName)
+		}
+	}
+
+	return renamed, nil
+}
+
+// ruleFileConflict returns a RuleFileConflictError when a rule file of the
+// LokiRule is already claimed in this reconcile pass, exists in the rules
+// ConfigMap without being owned by the operator, or is owned by another
+// LokiRule that exists or is being adopted. A rule file not owned by the
+// operator that is exactly the rendered one was written for the LokiRule by a
+// pass that failed to record it, so it is no conflict.
+func ruleFileConflict(
+	configMap *corev1.ConfigMap,
+	appliedRules map[string]AppliedRule,
+	claimed map[string]AppliedRule,
+	existing map[types.NamespacedName]bool,
+	state *ruleState,
+) *RuleFileConflictError {
+	fileNames := make([]string, 0, len(state.ruleFiles))
+	for fileName := range state.ruleFiles {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		if owner, ok := claimed[fileName]; ok {
+			return &RuleFileConflictError{FileName: fileName, Owner: &owner}
+		}
+
+		if _, ok := configMap.Data[fileName]; !ok {
+			continue
+		}
+
+		owner, ok := appliedRules[fileName]
+		if !ok {
+			if configMap.Data[fileName] == state.ruleFiles[fileName] {
+				continue
+			}
+			return &RuleFileConflictError{FileName: fileName}
+		}
+
+		ownerKey := types.NamespacedName{Namespace: owner.Namespace, Name: owner.Name}
+		if ownerKey != client.ObjectKeyFromObject(state.rule) && (existing[ownerKey] || owner.Pending) {
+			return &RuleFileConflictError{FileName: fileName, Owner: &owner}
+		}
+	}
+
+	return nil
+}
+
+// ownedRuleFileContents returns the rule files of the rules ConfigMap owned
+// by the LokiRule namespace/name.
+func ownedRuleFileContents(
+	configMap *corev1.ConfigMap,
+	appliedRules map[string]AppliedRule,
+	namespace, name string,
+) map[string]string {
+	ruleFiles := map[string]string{}
+	for _, fileName := range ownedRuleFiles(appliedRules, namespace, name) {
+		if content, ok := configMap.Data[fileName]; ok {
+			ruleFiles[fileName] = content
+		}
+	}
+	return ruleFiles
+}
+
+// allocateQuotas sets the quotaErr field of the states whose rendered rule
+// files exceed a quota. The rule files kept in the rules ConfigMap whatever
+// the quotas are counted first, then the rendered rule files are allocated
+// what is left in the order their LokiRules were created, so whether a
+// LokiRule fits does not depend on the previous reconcile passes. A LokiRule
+// exceeding a quota keeps the rule files it owns, which are counted too.
+func allocateQuotas(
+	configMap *corev1.ConfigMap,
+	appliedRules map[string]AppliedRule,
+	states []*ruleState,
+	existing map[types.NamespacedName]bool,
+	quotas lokirule.Quotas,
+) {
+	for _, state := range states {
+		state.quotaErr = nil
+	}
+	if !quotas.IsEnabled() {
+		return
+	}
+
+	allocator := newQuotaAllocator(quotas)
+
+	var rendered []*ruleState
+	for _, state := range states {
+		switch {
+		case state.ruleFiles != nil:
+			rendered = append(rendered, state)
+		case state.keep:
+			kept := ownedRuleFileContents(configMap, appliedRules, state.rule.Namespace, state.rule.Name)
+			allocator.add(state.rule.Namespace, lokirule.UsageOfRuleFiles(kept))
+		}
+	}
+	for fileName, appliedRule := range appliedRules {
+		owner := types.NamespacedName{Namespace: appliedRule.Namespace, Name: appliedRule.Name}
+		if content, ok := configMap.Data[fileName]; ok && appliedRule.Pending && !existing[owner] {
+			allocator.add(owner.Namespace, lokirule.UsageOfRuleFiles(map[string]string{fileName: content}))
+		}
+	}
+
+	sort.Slice(rendered, func(i, j int) bool { return allocatedBefore(rendered[i].rule, rendered[j].rule) })
+	for _, state := range rendered {
+		rule := state.rule
+		err := allocator.allocate(rule.Namespace, lokirule.UsageOf(rule, state.ruleFiles))
+		var quotaErr *lokirule.QuotaExceededError
+		if errors.As(err, &quotaErr) {
+			state.quotaErr = quotaErr
+			kept := ownedRuleFileContents(configMap, appliedRules, rule.Namespace, rule.Name)
+			allocator.add(rule.Namespace, lokirule.UsageOfRuleFiles(kept))
+		}
+	}
+}
+
+// convergeRuleFiles makes the rule files of the rules ConfigMap those of the
+// LokiRules within the quotas, setting the quotaErr, conflictErr and drifted
+// fields of their states:
+//   - the rendered rule files of a LokiRule replace the rule files it owns;
+//   - a LokiRule that is not written keeps the rule files it owns when its
+//     state says so, e.g. the last known-good ones of a quarantined LokiRule;
+//   - the rule files of LokiRules that no longer exist are removed, unless
+//     they are being adopted;
+//   - rule files not owned by the operator are never changed, the LokiRule
+//     whose rule file would overwrite one keeps its own rule files instead.
+func convergeRuleFiles(
+	configMap *corev1.ConfigMap,
+	appliedRules map[string]AppliedRule,
+	states []*ruleState,
+	quotas lokirule.Quotas,
+) {
+	existing := map[types.NamespacedName]bool{}
+	for _, state := range states {
+		existing[client.ObjectKeyFromObject(state.rule)] = true
+	}
+
+	allocateQuotas(configMap, appliedRules, states, existing, quotas)
+
+	desired := map[string]string{}
+	claimed := map[string]AppliedRule{}
+	claimOwned := func(namespace, name string) {
+		for _, fileName := range ownedRuleFiles(appliedRules, namespace, name) {
+			if content, ok := configMap.Data[fileName]; ok {
+				desired[fileName] = content
+				claimed[fileName] = appliedRules[fileName]
+			}
+		}
+	}
+
+	for _, state := range states {
+		rule := state.rule
+		state.conflictErr, state.drifted = nil, false
+		state.previouslyWritten = hasRuleFiles(configMap, appliedRules, rule.Namespace, rule.Name)
+
+		if state.ruleFiles != nil && state.quotaErr == nil {
+			state.conflictErr = ruleFileConflict(configMap, appliedRules, claimed, existing, state)
+		}
+		if state.quotaErr != nil || state.conflictErr != nil || (state.ruleFiles == nil && state.keep) {
+			claimOwned(rule.Namespace, rule.Name)
+			continue
+		}
+		if state.ruleFiles == nil {
+			continue
+		}
+
+		// A LokiRule already applied at its current version should find its
+		// rule files unchanged, unless they were edited or removed outside of
+		// the operator.
+		applied := rule.Status.LastAppliedGeneration == rule.Generation && rule.Status.LastAppliedSpecHash == state.specHash
+
+		appliedRule := newAppliedRule(rule, state.specHash)
+		for fileName, content := range state.ruleFiles {
+			if current, ok := configMap.Data[fileName]; applied && (!ok || current != content) {
+				state.drifted = true
+			}
+			desired[fileName] = content
+			claimed[fileName] = appliedRule
+		}
+	}
+
+	for _, appliedRule := range appliedRules {
+		owner := types.NamespacedName{Namespace: appliedRule.Namespace, Name: appliedRule.Name}
+		if appliedRule.Pending && !existing[owner] {
+			claimOwned(owner.Namespace, owner.Name)
+		}
+	}
+
+	for fileName := range appliedRules {
+		if _, ok := desired[fileName]; !ok {
+			delete(configMap.Data, fileName)
+		}
+	}
+
+	if configMap.Data == nil && len(desired) > 0 {
+		configMap.Data = map[string]string{}
+	}
+	for fileName, content := range desired {
+		configMap.Data[fileName] = content
+	}
+
+	for fileName := range appliedRules {
+		delete(appliedRules, fileName)
+	}
+	for fileName, appliedRule := range claimed {
+		appliedRules[fileName] = appliedRule
+	}
+}
+
+// hasRuleFiles returns whether the rules ConfigMap holds rule files of the
+// LokiRule namespace/name.
+func hasRuleFiles(configMap *corev1.ConfigMap, appliedRules map[string]AppliedRule, namespace, name string) bool {
+	for _, fileName := range ownedRuleFiles(appliedRules, namespace, name) {
+		if _, ok := configMap.Data[fileName]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// markRuleFile records an existing rule file as being adopted by the LokiRule
+// namespace/name, so it is replaced by the first rule file written for the
+// LokiRule.
+func markRuleFile(appliedRules map[string]AppliedRule, fileName, namespace, name string) {
+	appliedRules[fileName] = AppliedRule{Namespace: namespace, Name: name, Pending: true}
+}
@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func reconcileWithRulesConfigMap(
+	t *testing.T,
+	rulesConfigMap *corev1.ConfigMap,
+) (ctrl.Result, *querocomv1alpha1.LokiRule, *corev1.ConfigMap, client.Client) {
+	rule := newLokiRule("default", "errors")
+	r := newFakeReconciler(t, rule, rulesConfigMap)
+
+	key := types.NamespacedName{Namespace: rule.Namespace, Name: rule.Name}
+	result, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	updated := &querocomv1alpha1.LokiRule{}
+	if err := r.Get(context.TODO(), key, updated); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	configMap := &corev1.ConfigMap{}
+	if err := r.Get(context.TODO(), client.ObjectKeyFromObject(rulesConfigMap), configMap); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	return result, updated, configMap, r.Client
+}
+
+func TestRuleFileConflict(t *testing.T) {
+	tests := map[string]struct {
+		appliedRules string
+		message      string
+	}{
+		"unmanaged rule file": {
+			appliedRules: `{}`,
+			message:      "rule file default_errors.yaml already exists in the rules ConfigMap and is not managed by the operator",
+		},
+		"rule file being adopted by another LokiRule": {
+			appliedRules: `{"default_errors.yaml":{"namespace":"monitoring","name":"errors","generation":0,"pending":true}}`,
+			message:      "rule file default_errors.yaml is already managed by LokiRule monitoring/errors",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, rule, configMap, _ := reconcileWithRulesConfigMap(t, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "loki-rule-cfg",
+					Namespace:   "loki",
+					Annotations: map[string]string{lokirule.AppliedRulesAnnotation: tt.appliedRules},
+				},
+				Data: map[string]string{"default_errors.yaml": unmanagedRuleFile},
+			})
+
+			if result.RequeueAfter != conflictRequeueInterval {
+				t.Errorf("Expected a requeue after %s, got: %+v", conflictRequeueInterval, result)
+			}
+
+			accepted := meta.FindStatusCondition(rule.Status.Conditions, querocomv1alpha1.ConditionAccepted)
+			if accepted == nil || accepted.Status != metav1.ConditionFalse ||
+				accepted.Reason != querocomv1alpha1.ReasonRuleFileConflict || accepted.Message != tt.message {
+				t.Errorf("Expected the conflict in the Accepted condition, got: %+v", accepted)
+			}
+
+			if configMap.Data["default_errors.yaml"] != unmanagedRuleFile {
+				t.Errorf("Expected the rule file to be left untouched, got: %v", configMap.Data)
+			}
+		})
+	}
+}
+
+func TestBootstrapAppliedRules(t *testing.T) {
+	result, rule, configMap, cli := reconcileWithRulesConfigMap(t, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "loki-rule-cfg", Namespace: "loki"},
+		Data: map[string]string{
+			"default-errors.yaml": unmanagedRuleFile,
+			"errors.yaml":         unmanagedRuleFile,
+		},
+	})
+
+	if result.RequeueAfter != 0 {
+		t.Errorf("Expected no requeue, got: %+v", result)
+	}
+	if !meta.IsStatusConditionTrue(rule.Status.Conditions, querocomv1alpha1.ConditionAccepted) {
+		t.Errorf("Expected the LokiRule to be accepted, got: %+v", rule.Status.Conditions)
+	}
+
+	appliedRules, err := GetAppliedRules(context.TODO(), cli, configMap, lokirule.Options{})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// The rule file written before the applied rules were recorded is owned
+	// and renamed to the default rule file name template.
+	if appliedRules["default_errors.yaml"].Generation != 1 {
+		t.Errorf("Expected default-errors.yaml to be owned and rewritten as default_errors.yaml, got: %v", appliedRules)
+	}
+	if _, ok := configMap.Data["default-errors.yaml"]; ok {
+		t.Errorf("Expected default-errors.yaml to be removed, got: %v", configMap.Data)
+	}
+	if _, ok := appliedRules["errors.yaml"]; ok {
+		t.Errorf("Expected errors.yaml to stay unmanaged, got: %v", appliedRules)
+	}
+	if configMap.Data["errors.yaml"] != unmanagedRuleFile {
+		t.Errorf("Expected errors.yaml to be left untouched, got: %v", configMap.Data)
+	}
+}
+
+func TestBootstrapAppliedRulesWithFileNameTemplate(t *testing.T) {
+	renamed := newLokiRule("default", "errors")
+	legacy := newLokiRule("default", "latency")
+	cli := newFakeClientBuilder(t, renamed, legacy).Build()
+
+	// default/errors was written with the configured template, default/latency
+	// before it was configured.
+	options := lokirule.Options{FileNameTemplate: lokirule.UniqueFileNameTemplate}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "loki-rule-cfg", Namespace: "loki"},
+		Data: map[string]string{
+			"default_errors.yaml":  unmanagedRuleFile,
+			"default-latency.yaml": unmanagedRuleFile,
+		},
+	}
+
+	appliedRules, err := bootstrapAppliedRules(context.TODO(), cli, configMap, options)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expected := map[string]AppliedRule{
+		"default_errors.yaml":  {Namespace: "default", Name: "errors"},
+		"default-latency.yaml": {Namespace: "default", Name: "latency"},
+	}
+	if !reflect.DeepEqual(appliedRules, expected) {
+		t.Errorf("Expected %v, got: %v", expected, appliedRules)
+	}
+}
+
+func TestUnrecordedRuleFileIsClaimedBack(t *testing.T) {
+	ruleFiles, err := lokirule.GenerateRuleConfigMapFile(newLokiRule("default", "errors"), lokirule.Options{})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// The rule file was written by a reconcile that failed to record it.
+	result, rule, configMap, cli := reconcileWithRulesConfigMap(t, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "loki-rule-cfg",
+			Namespace:   "loki",
+			Annotations: map[string]string{lokirule.AppliedRulesAnnotation: `{}`},
+		},
+		Data: ruleFiles,
+	})
+
+	if result.RequeueAfter != 0 {
+		t.Errorf("Expected no requeue, got: %+v", result)
+	}
+	if !meta.IsStatusConditionTrue(rule.Status.Conditions, querocomv1alpha1.ConditionAccepted) {
+		t.Errorf("Expected the LokiRule to be accepted, got: %+v", rule.Status.Conditions)
+	}
+
+	appliedRules, err := GetAppliedRules(context.TODO(), cli, configMap, lokirule.Options{})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if appliedRules["default_errors.yaml"].Generation != 1 {
+		t.Errorf("Expected default_errors.yaml to be recorded, got: %v", appliedRules)
+	}
+}
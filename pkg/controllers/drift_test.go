@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func driftRepaired(t *testing.T, resource string) float64 {
+	metric := &dto.Metric{}
+	if err := driftRepairedTotal.WithLabelValues(resource).Write(metric); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestDriftRepair(t *testing.T) {
+	rule := newLokiRule("default", "errors")
+	specHash, err := lokirule.SpecHash(rule)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	rule.Status.LastAppliedGeneration = 1
+	rule.Status.LastAppliedSpecHash = specHash
+
+	other := &querocomv1alpha1.LokiRule{ObjectMeta: metav1.ObjectMeta{Name: "latency", Namespace: "default"}}
+
+	// The rule file of the applied LokiRule was edited by hand.
+	rulesConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "loki-rule-cfg",
+			Namespace: "loki",
+			Annotations: map[string]string{
+				lokirule.AppliedRulesAnnotation: `{"default_errors.yaml":{"namespace":"default","name":"errors"}}`,
+			},
+		},
+		Data: map[string]string{"default_errors.yaml": "groups: []\n"},
+	}
+
+	r := newFakeReconciler(t, rule, other, rulesConfigMap)
+	r.LokiLabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "loki"}}
+
+	requests := r.rulesConfigMapRequest(context.TODO(), rulesConfigMap)
+	if len(requests) != 1 || requests[0].NamespacedName != client.ObjectKeyFromObject(rulesConfigMap) {
+		t.Fatalf("Expected the rules ConfigMap to be reconciled, got: %v", requests)
+	}
+
+	before := driftRepaired(t, DriftResourceConfigMap)
+
+	key := types.NamespacedName{Namespace: rule.Namespace, Name: rule.Name}
+	if _, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	configMap := &corev1.ConfigMap{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}, configMap); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected, err := lokirule.GenerateRuleConfigMapFile(rule, lokirule.Options{})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if configMap.Data["default_errors.yaml"] != expected["default_errors.yaml"] {
+		t.Errorf("Expected the rule file to be restored, got: %v", configMap.Data)
+	}
+
+	if drift := driftRepaired(t, DriftResourceConfigMap) - before; drift != 1 {
+		t.Errorf("Expected the drift to be counted once, got: %v", drift)
+	}
+
+	// The restore itself does not trigger a reconcile, another edit does.
+	if r.notOwnWrite().Update(event.UpdateEvent{ObjectOld: rulesConfigMap, ObjectNew: configMap}) {
+		t.Errorf("Expected the operator's own write not to trigger a reconcile")
+	}
+	appliedRulesConfigMap := &corev1.ConfigMap{}
+	appliedRulesKey := types.NamespacedName{Namespace: "loki", Name: lokirule.AppliedRulesConfigMapName("loki-rule-cfg")}
+	if err := r.Get(context.TODO(), appliedRulesKey, appliedRulesConfigMap); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if r.notOwnWrite().Update(event.UpdateEvent{ObjectOld: appliedRulesConfigMap, ObjectNew: appliedRulesConfigMap}) {
+		t.Errorf("Expected the operator's own write of the applied rules not to trigger a reconcile")
+	}
+	editedAppliedRules := appliedRulesConfigMap.DeepCopy()
+	delete(editedAppliedRules.Data, "default_errors.yaml")
+	if err := r.Update(context.TODO(), editedAppliedRules); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !r.notOwnWrite().Update(event.UpdateEvent{ObjectOld: appliedRulesConfigMap, ObjectNew: editedAppliedRules}) {
+		t.Errorf("Expected an edit of the applied rules ConfigMap to trigger a reconcile")
+	}
+
+	edited := configMap.DeepCopy()
+	edited.Data["manual.yaml"] = unmanagedRuleFile
+	if err := r.Update(context.TODO(), edited); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !r.notOwnWrite().Update(event.UpdateEvent{ObjectOld: configMap, ObjectNew: edited}) {
+		t.Errorf("Expected an edit of the rules ConfigMap to trigger a reconcile")
+	}
+
+	// Reconciling the restored rule file is not a drift.
+	if _, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if drift := driftRepaired(t, DriftResourceConfigMap) - before; drift != 1 {
+		t.Errorf("Expected no new drift, got: %v", drift)
+	}
+}
+
+func TestDriftWatchPredicates(t *testing.T) {
+	r := &LokiRuleReconciler{
+		LokiLabelSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"app": "loki"}},
+		LokiNamespace:         "loki",
+		LokiRuleConfigMapName: "loki-rule-cfg",
+	}
+
+	if !r.isRulesConfigMap(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "loki-rule-cfg", Namespace: "loki"}}) {
+		t.Errorf("Expected the rules ConfigMap to be watched")
+	}
+	appliedRulesConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "loki-rule-cfg-applied-rules", Namespace: "loki"},
+	}
+	if !r.isRulesConfigMap(appliedRulesConfigMap) {
+		t.Errorf("Expected the applied rules ConfigMap to be watched")
+	}
+	if r.isRulesConfigMap(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "loki-rule-cfg", Namespace: "other"}}) {
+		t.Errorf("Expected a ConfigMap of another namespace not to be watched")
+	}
+
+	lokiStatefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "loki", Namespace: "loki", Labels: map[string]string{"app": "loki"}},
+	}
+	if !r.isLokiStatefulSet(lokiStatefulSet) {
+		t.Errorf("Expected the Loki StatefulSet to be watched")
+	}
+	lokiStatefulSet.Labels = map[string]string{"app": "promtail"}
+	if r.isLokiStatefulSet(lokiStatefulSet) {
+		t.Errorf("Expected a StatefulSet not matching the selector not to be watched")
+	}
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/features"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestDryRunReconcile(t *testing.T) {
+	rule := newLokiRule("default", "errors")
+	r := newFakeReconciler(t, rule)
+	r.DryRun = true
+
+	key := types.NamespacedName{Namespace: rule.Namespace, Name: rule.Name}
+	if _, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	err := r.Get(context.TODO(), types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}, &corev1.ConfigMap{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the rules ConfigMap not to be created, got: %v", err)
+	}
+
+	updated := &querocomv1alpha1.LokiRule{}
+	if err := r.Get(context.TODO(), key, updated); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(updated.Status.Conditions) != 0 || updated.Status.LastAppliedGeneration != 0 {
+		t.Errorf("Expected the status not to be updated, got: %+v", updated.Status)
+	}
+}
+
+func TestDryRunAdopt(t *testing.T) {
+	a := newRuleAdopter(t, features.AdoptionModeCreate)
+	a.DryRun = true
+
+	if err := a.Adopt(context.TODO()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	err := a.Get(context.TODO(), types.NamespacedName{Namespace: "monitoring", Name: "errors"}, &querocomv1alpha1.LokiRule{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("Expected no LokiRule to be created, got: %v", err)
+	}
+
+	appliedRules, err := GetAppliedRules(context.TODO(), a, getRulesConfigMap(t, a), lokirule.Options{})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, ok := appliedRules["errors.yaml"]; ok {
+		t.Errorf("Expected errors.yaml not to be marked, got: %v", appliedRules)
+	}
+}
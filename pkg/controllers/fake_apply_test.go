@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// withConfigMapApply emulates the server-side applies of ConfigMaps, which
+// the fake client does not support, by merging the applied data, annotations
+// and labels into the ConfigMap. The fake client keeps no managed fields, so
+// the operator never relies on an apply to remove keys.
+func withConfigMapApply(builder *fake.ClientBuilder) *fake.ClientBuilder {
+	return builder.WithInterceptorFuncs(interceptor.Funcs{Patch: applyConfigMap})
+}
+
+// applyConfigMap is the interceptor Patch function of withConfigMapApply, for
+// tests intercepting other calls too.
+func applyConfigMap(
+	ctx context.Context,
+	c client.WithWatch,
+	obj client.Object,
+	patch client.Patch,
+	opts ...client.PatchOption,
+) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Patch(ctx, obj, patch, opts...)
+	}
+
+	applied := &corev1.ConfigMap{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.(*unstructured.Unstructured).Object, applied)
+	if err != nil {
+		return err
+	}
+
+	patchOptions := &client.PatchOptions{}
+	patchOptions.ApplyOptions(opts)
+	if len(patchOptions.DryRun) > 0 {
+		return nil
+	}
+
+	current := &corev1.ConfigMap{}
+	err = c.Get(ctx, client.ObjectKeyFromObject(applied), current)
+	if apierrors.IsNotFound(err) {
+		if err := c.Create(ctx, applied); err != nil {
+			return err
+		}
+		obj.SetResourceVersion(applied.ResourceVersion)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if applied.ResourceVersion != "" && applied.ResourceVersion != current.ResourceVersion {
+		return apierrors.NewConflict(corev1.Resource("configmaps"), current.Name, nil)
+	}
+
+	if current.Data == nil {
+		current.Data = map[string]string{}
+	}
+	for k, v := range applied.Data {
+		current.Data[k] = v
+	}
+	if current.Annotations == nil {
+		current.Annotations = map[string]string{}
+	}
+	for k, v := range applied.Annotations {
+		current.Annotations[k] = v
+	}
+	if current.Labels == nil {
+		current.Labels = map[string]string{}
+	}
+	for k, v := range applied.Labels {
+		current.Labels[k] = v
+	}
+
+	if err := c.Update(ctx, current); err != nil {
+		return err
+	}
+	obj.SetResourceVersion(current.ResourceVersion)
+	return nil
+}
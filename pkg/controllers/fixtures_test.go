@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"testing"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestScheme returns a scheme with the Kubernetes and the operator types.
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := querocomv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return scheme
+}
+
+// newFakeClientBuilder returns a fake client builder holding the objects,
+// with the status subresource of LokiRules and the server-side applies of
+// ConfigMaps emulated.
+func newFakeClientBuilder(t *testing.T, objects ...client.Object) *fake.ClientBuilder {
+	return withConfigMapApply(fake.NewClientBuilder()).
+		WithScheme(newTestScheme(t)).
+		WithObjects(objects...).
+		WithStatusSubresource(&querocomv1alpha1.LokiRule{})
+}
+
+// newFakeReconciler returns a reconciler writing the loki-rule-cfg ConfigMap
+// of the loki namespace with a fake client holding the objects.
+func newFakeReconciler(t *testing.T, objects ...client.Object) *LokiRuleReconciler {
+	return newTestReconciler(newFakeClientBuilder(t, objects...).Build())
+}
+
+// newTestReconciler returns a reconciler writing the loki-rule-cfg ConfigMap
+// of the loki namespace with the client, for tests intercepting its calls.
+func newTestReconciler(cli client.Client) *LokiRuleReconciler {
+	return &LokiRuleReconciler{
+		Client:                cli,
+		Scheme:                cli.Scheme(),
+		Logger:                logger.NewNopLogger(),
+		LokiNamespace:         "loki",
+		LokiRuleConfigMapName: "loki-rule-cfg",
+	}
+}
+
+// newLokiRule returns a LokiRule at its first generation, recording the errors
+// logged by the api app.
+func newLokiRule(namespace, name string) *querocomv1alpha1.LokiRule {
+	return &querocomv1alpha1.LokiRule{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Generation: 1},
+		Spec: querocomv1alpha1.LokiRuleSpec{
+			Groups: []querocomv1alpha1.RuleGroup{{
+				Name: "errors",
+				Rules: []querocomv1alpha1.Rule{{
+					Record: "app:errors:count1m",
+					Expr:   `sum by (app) (count_over_time({app="api"} |= "error" [1m]))`,
+				}},
+			}},
+		},
+	}
+}
@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultLoadedTimeout is how long the Loki ruler has to load the rule groups
+// of a LokiRule written to the rules ConfigMap
+const DefaultLoadedTimeout = 5 * time.Minute
+
+// loadedRequeueInterval is how often the rule groups of a LokiRule the Loki
+// ruler has not loaded yet are checked again
+const loadedRequeueInterval = 15 * time.Second
+
+// needsLoadedCheck returns whether the Loaded condition of the LokiRule is yet
+// to be settled for its generation.
+func needsLoadedCheck(rule *querocomv1alpha1.LokiRule) bool {
+	loaded := meta.FindStatusCondition(rule.Status.Conditions, querocomv1alpha1.ConditionLoaded)
+	return loaded == nil || loaded.ObservedGeneration != rule.Generation ||
+		loaded.Reason == querocomv1alpha1.ReasonLoadPending
+}
+
+// unloadedRuleGroups compares the rule groups of the rule files with the ones
+// the Loki ruler loaded, keyed by rule file name, and describes the first rule
+// group that is missing or differs, or returns "" when all were loaded.
+func unloadedRuleGroups(ruleFiles map[string]string, loaded map[string][]lokirule.RuleGroup) (string, error) {
+	fileNames := make([]string, 0, len(ruleFiles))
+	for fileName := range ruleFiles {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		desired := lokirule.RuleGroups{}
+		if err := yaml.Unmarshal([]byte(ruleFiles[fileName]), &desired); err != nil {
+			return "", err
+		}
+
+		loadedGroups := map[string]lokirule.RuleGroup{}
+		for _, group := range loaded[fileName] {
+			loadedGroups[group.Name] = group
+		}
+
+		for _, group := range desired.Groups {
+			loadedGroup, ok := loadedGroups[group.Name]
+			if !ok {
+				return fmt.Sprintf("rule group %s of %s is not loaded", group.Name, fileName), nil
+			}
+			if !sameRules(group.Rules, loadedGroup.Rules) {
+				return fmt.Sprintf("rule group %s of %s is not loaded at its current version", group.Name, fileName), nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// sameRules compares the names and expressions of the rules, which the ruler
+// returns as they were loaded.
+func sameRules(desired, loaded []lokirule.Rule) bool {
+	if len(desired) != len(loaded) {
+		return false
+	}
+
+	for i := range desired {
+		if desired[i].Alert != loaded[i].Alert || desired[i].Record != loaded[i].Record ||
+			desired[i].Expr != loaded[i].Expr {
+			return false
+		}
+	}
+
+	return true
+}
+
+// loadedCondition returns the Loaded condition of the LokiRule, from the rule
+// groups the Loki ruler loaded or the error listing them. The rule groups not
+// loaded yet are waited for until the timeout elapsed since the wait started.
+func loadedCondition(
+	state *ruleState,
+	loaded map[string][]lokirule.RuleGroup,
+	rulerErr error,
+	timeout time.Duration,
+	now time.Time,
+) (metav1.Condition, error) {
+	message := ""
+	if rulerErr != nil {
+		message = fmt.Sprintf("failed to list the rule groups of the Loki ruler: %s", rulerErr)
+	} else {
+		unloaded, err := unloadedRuleGroups(state.ruleFiles, loaded)
+		if err != nil {
+			return metav1.Condition{}, err
+		}
+		if unloaded == "" {
+			return metav1.Condition{
+				Type:    querocomv1alpha1.ConditionLoaded,
+				Status:  metav1.ConditionTrue,
+				Reason:  querocomv1alpha1.ReasonRulesLoaded,
+				Message: "Rule groups loaded by the Loki ruler",
+			}, nil
+		}
+		message = unloaded
+	}
+
+	// The wait restarts with every generation, as the rule groups of a new
+	// generation are loaded on their own schedule.
+	waitingSince := now
+	current := meta.FindStatusCondition(state.rule.Status.Conditions, querocomv1alpha1.ConditionLoaded)
+	if current != nil && current.Reason == querocomv1alpha1.ReasonLoadPending &&
+		current.ObservedGeneration == state.rule.Generation {
+		waitingSince = current.LastTransitionTime.Time
+	}
+
+	if now.Sub(waitingSince) >= timeout {
+		return metav1.Condition{
+			Type:    querocomv1alpha1.ConditionLoaded,
+			Status:  metav1.ConditionFalse,
+			Reason:  querocomv1alpha1.ReasonRulesNotLoaded,
+			Message: fmt.Sprintf("Not loaded by the Loki ruler after %s: %s", timeout, message),
+		}, nil
+	}
+
+	return metav1.Condition{
+		Type:    querocomv1alpha1.ConditionLoaded,
+		Status:  metav1.ConditionUnknown,
+		Reason:  querocomv1alpha1.ReasonLoadPending,
+		Message: fmt.Sprintf("Waiting for the Loki ruler: %s", message),
+	}, nil
+}
+
+// restartLoadWait removes the Loaded condition of an older generation of the
+// LokiRule, so the condition set for the current one starts a new transition.
+func restartLoadWait(rule *querocomv1alpha1.LokiRule) func(status *querocomv1alpha1.LokiRuleStatus) {
+	return func(status *querocomv1alpha1.LokiRuleStatus) {
+		loaded := meta.FindStatusCondition(status.Conditions, querocomv1alpha1.ConditionLoaded)
+		if loaded != nil && loaded.ObservedGeneration != rule.Generation {
+			meta.RemoveStatusCondition(&status.Conditions, querocomv1alpha1.ConditionLoaded)
+		}
+	}
+}
+
+// clearLoaded removes the Loaded condition of a LokiRule whose rule files are
+// not written, as what the Loki ruler loaded is no longer its current rules.
+func clearLoaded(status *querocomv1alpha1.LokiRuleStatus) {
+	meta.RemoveStatusCondition(&status.Conditions, querocomv1alpha1.ConditionLoaded)
+}
+
+// verifyLoaded sets the Loaded condition of the LokiRules written to the rules
+// ConfigMap from the rule groups the Loki ruler loaded. It returns how soon
+// the LokiRules still waited for are checked again, or zero.
+func (r *LokiRuleReconciler) verifyLoaded(ctx context.Context, states []*ruleState) (time.Duration, error) {
+	var written []*ruleState
+	for _, state := range states {
+		if state.ruleFiles != nil && state.quotaErr == nil && state.conflictErr == nil && needsLoadedCheck(state.rule) {
+			written = append(written, state)
+		}
+	}
+	if len(written) == 0 {
+		return 0, nil
+	}
+
+	loaded, rulerErr := GetRulerRuleGroups(ctx, r.LokiClient, r.LokiURL)
+
+	requeueAfter := time.Duration(0)
+	var errs []error
+	for _, state := range written {
+		rule := state.rule
+
+		condition, err := loadedCondition(state, loaded, rulerErr, r.LoadedTimeout, time.Now())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		eventType := corev1.EventTypeNormal
+		switch condition.Reason {
+		case querocomv1alpha1.ReasonLoadPending:
+			requeueAfter = loadedRequeueInterval
+		case querocomv1alpha1.ReasonRulesNotLoaded:
+			eventType = corev1.EventTypeWarning
+			r.Logger.Warn("LokiRule not loaded", "namespace", rule.Namespace, "name", rule.Name, "err", condition.Message)
+		}
+
+		err = r.setConditionsWithEvent(ctx, rule, eventType, restartLoadWait(rule), condition)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			r.Logger.Error(err, "Failed to update LokiRule status", "namespace", rule.Namespace, "name", rule.Name)
+			errs = append(errs, err)
+		}
+	}
+
+	return requeueAfter, errors.Join(errs...)
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestReconcileVerifiesLoadedRules(t *testing.T) {
+	tests := map[string]struct {
+		// expr is the expression of the rule loaded by the ruler, none when empty
+		expr         string
+		waitingSince time.Duration
+		// previousGeneration marks the wait as started for the previous generation
+		previousGeneration bool
+		requeueAfter       time.Duration
+		status             metav1.ConditionStatus
+		reason             string
+	}{
+		"rule groups loaded": {
+			expr:   `sum by (app) (count_over_time({app="api"} |= "error" [1m]))`,
+			status: metav1.ConditionTrue,
+			reason: querocomv1alpha1.ReasonRulesLoaded,
+		},
+		"rule groups not loaded yet": {
+			requeueAfter: loadedRequeueInterval,
+			status:       metav1.ConditionUnknown,
+			reason:       querocomv1alpha1.ReasonLoadPending,
+		},
+		"previous rule groups loaded": {
+			expr:         `count_over_time({app="api"}[1m])`,
+			waitingSince: time.Minute,
+			requeueAfter: loadedRequeueInterval,
+			status:       metav1.ConditionUnknown,
+			reason:       querocomv1alpha1.ReasonLoadPending,
+		},
+		"rule groups not loaded before the timeout": {
+			waitingSince: 10 * time.Minute,
+			status:       metav1.ConditionFalse,
+			reason:       querocomv1alpha1.ReasonRulesNotLoaded,
+		},
+		"rule groups of a new generation not loaded yet": {
+			waitingSince:       10 * time.Minute,
+			previousGeneration: true,
+			requeueAfter:       loadedRequeueInterval,
+			status:             metav1.ConditionUnknown,
+			reason:             querocomv1alpha1.ReasonLoadPending,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rule := newLokiRule("default", "errors")
+			rule.Generation = 2
+			if tt.waitingSince > 0 {
+				observedGeneration := rule.Generation
+				if tt.previousGeneration {
+					observedGeneration--
+				}
+				rule.Status.Conditions = []metav1.Condition{{
+					Type:               querocomv1alpha1.ConditionLoaded,
+					Status:             metav1.ConditionUnknown,
+					ObservedGeneration: observedGeneration,
+					Reason:             querocomv1alpha1.ReasonLoadPending,
+					LastTransitionTime: metav1.NewTime(time.Now().Add(-tt.waitingSince)),
+				}}
+			}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/loki/api/v1/rules" {
+					return
+				}
+				if tt.expr == "" {
+					http.NotFound(w, r)
+					return
+				}
+
+				loaded := map[string][]lokirule.RuleGroup{"default_errors.yaml": {{
+					Name:  "errors",
+					Rules: []lokirule.Rule{{Record: "app:errors:count1m", Expr: tt.expr}},
+				}}}
+				if err := yaml.NewEncoder(w).Encode(loaded); err != nil {
+					t.Errorf("Error: %v", err)
+				}
+			}))
+			defer server.Close()
+
+			r := newFakeReconciler(t, rule)
+			r.LokiClient = server.Client()
+			r.LokiURL = server.URL
+			r.LoadedTimeout = DefaultLoadedTimeout
+
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}}
+			result, err := r.Reconcile(context.TODO(), req)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if result.RequeueAfter != tt.requeueAfter {
+				t.Errorf("Expected a requeue after %s, got: %+v", tt.requeueAfter, result)
+			}
+
+			updated := &querocomv1alpha1.LokiRule{}
+			if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "errors"}, updated); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			loaded := meta.FindStatusCondition(updated.Status.Conditions, querocomv1alpha1.ConditionLoaded)
+			if loaded == nil || loaded.Status != tt.status || loaded.Reason != tt.reason {
+				t.Errorf("Expected the Loaded condition %s with reason %s, got: %+v", tt.status, tt.reason, loaded)
+			}
+			if tt.previousGeneration && time.Since(loaded.LastTransitionTime.Time) > time.Minute {
+				t.Errorf("Expected the wait to restart with the new generation, got: %+v", loaded)
+			}
+		})
+	}
+}
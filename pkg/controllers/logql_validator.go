@@ -1,16 +1,41 @@
 package controllers
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
-func ValidateLogQLOnServerFunc(client *http.Client, lokiURL string, logQLExpr string) (bool, error) {
+// LokiRequestTimeout bounds each request to Loki on top of the deadline of the
+// context it is sent with.
+const LokiRequestTimeout = 10 * time.Second
+
+// logQLParseError prefixes the message of the 400 responses of Loki to
+// queries it cannot parse.
+const logQLParseError = "parse error"
+
+// ValidateLogQLOnServerFunc sends the LogQL expression to Loki as an instant
+// query. It returns false only when Loki rejects it with a parse error. Any
+// other response, e.g. while Loki is starting, overloaded or refusing the
+// credentials, is an error, as it tells nothing about the expression.
+func ValidateLogQLOnServerFunc(ctx context.Context, client *http.Client, lokiURL string, logQLExpr string) (bool, error) {
 	logQLExprEscaped := url.QueryEscape(logQLExpr)
 	lokiQueryEndpoint := "/loki/api/v1/query?query=" + logQLExprEscaped
 	logQLURIWithQuery := lokiURL + lokiQueryEndpoint
 
-	response, err := client.Get(logQLURIWithQuery)
+	ctx, cancel := context.WithTimeout(ctx, LokiRequestTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, logQLURIWithQuery, nil)
+	if err != nil {
+		return false, err
+	}
+
+	response, err := client.Do(request)
 	if err != nil {
 		return false, err
 	}
@@ -21,5 +46,14 @@ func ValidateLogQLOnServerFunc(client *http.Client, lokiURL string, logQLExpr st
 		return true, nil
 	}
 
-	return false, nil
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1024))
+	if err != nil {
+		return false, err
+	}
+
+	if response.StatusCode == http.StatusBadRequest && strings.Contains(string(body), logQLParseError) {
+		return false, nil
+	}
+
+	return false, fmt.Errorf("unexpected status %d from Loki: %s", response.StatusCode, body)
 }
@@ -1,11 +1,14 @@
 package controllers
 
 import (
+	"context"
+	"errors"
 	"github.com/quero-edu/loki-rule-operator/internal/flags"
 	httputil "github.com/quero-edu/loki-rule-operator/internal/http"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestValidateLogQLOnServerFunc(t *testing.T) {
@@ -24,7 +27,7 @@ func TestValidateLogQLOnServerFunc(t *testing.T) {
 
 	defer ts.Close()
 
-	isValid, err := ValidateLogQLOnServerFunc(http.DefaultClient, ts.URL, "{job=\"loki-test\"}")
+	isValid, err := ValidateLogQLOnServerFunc(context.TODO(), http.DefaultClient, ts.URL, "{job=\"loki-test\"}")
 
 	if err != nil {
 		t.Errorf("Error: %v", err)
@@ -54,7 +57,7 @@ func TestValidateLogQLOnServerWithHeadersFunc(t *testing.T) {
 		"X-Scope-Orgid=1",
 		"Authorization=something",
 	})
-	isValid, err := ValidateLogQLOnServerFunc(client, ts.URL, "{job=\"loki-test\"}")
+	isValid, err := ValidateLogQLOnServerFunc(context.TODO(), client, ts.URL, "{job=\"loki-test\"}")
 
 	if err != nil {
 		t.Errorf("Error: %v", err)
@@ -65,14 +68,14 @@ func TestValidateLogQLOnServerWithHeadersFunc(t *testing.T) {
 	}
 }
 
-func TestValidateLogQLOnServerFuncHTTP500IsAnInvalidResponse(t *testing.T) {
+func TestValidateLogQLOnServerFuncParseErrorIsAnInvalidResponse(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(http.StatusInternalServerError)
+		http.Error(w, "parse error at line 1, col 1: syntax error: unexpected IDENTIFIER", http.StatusBadRequest)
 	}))
 
 	defer ts.Close()
 
-	isValid, err := ValidateLogQLOnServerFunc(http.DefaultClient, ts.URL, "{job=\"loki-test\"}")
+	isValid, err := ValidateLogQLOnServerFunc(context.TODO(), http.DefaultClient, ts.URL, "job")
 
 	if err != nil {
 		t.Errorf("Error: %v", err)
@@ -83,17 +86,57 @@ func TestValidateLogQLOnServerFuncHTTP500IsAnInvalidResponse(t *testing.T) {
 	}
 }
 
-func TestValidateLogQLOnServerFuncInvalidRequest(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(500)
+func TestValidateLogQLOnServerFuncUnexpectedResponseIsAnError(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		body   string
+	}{
+		"internal server error": {status: http.StatusInternalServerError, body: "rpc error"},
+		"starting":              {status: http.StatusServiceUnavailable, body: "Ingester not ready"},
+		"rate limited":          {status: http.StatusTooManyRequests, body: "too many outstanding requests"},
+		"unauthorized":          {status: http.StatusUnauthorized, body: "no org id"},
+		"forbidden":             {status: http.StatusForbidden},
+		"bad request":           {status: http.StatusBadRequest, body: "the query time range exceeds the limit"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				http.Error(w, tt.body, tt.status)
+			}))
+
+			defer ts.Close()
+
+			isValid, err := ValidateLogQLOnServerFunc(context.TODO(), http.DefaultClient, ts.URL, "{job=\"loki-test\"}")
+
+			if err == nil {
+				t.Errorf("A response to a query Loki did not run should be an error")
+			}
+
+			if isValid == true {
+				t.Errorf("A response to a query Loki did not run should not be a valid response")
+			}
+		})
+	}
+}
+
+func TestValidateLogQLOnServerFuncCanceled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
 	}))
-	isValid, err := ValidateLogQLOnServerFunc(http.DefaultClient, ts.URL, "{job=\"loki-test\"}")
 
-	if err != nil {
-		t.Errorf("Error: %v", err)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	isValid, err := ValidateLogQLOnServerFunc(ctx, http.DefaultClient, ts.URL, "{job=\"loki-test\"}")
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("The request should be canceled with its context: %v", err)
 	}
 
 	if isValid == true {
-		t.Errorf("The logQL is invalid")
+		t.Errorf("A canceled request should not be a valid response")
 	}
 }
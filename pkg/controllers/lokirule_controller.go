@@ -18,20 +18,59 @@ package controllers
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"sort"
+	"sync"
+	"time"
 
 	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
 	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	"github.com/quero-edu/loki-rule-operator/pkg/features"
 	"github.com/quero-edu/loki-rule-operator/pkg/k8sutils"
 	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// quotaRequeueInterval is how often a LokiRule exceeding a quota is checked
+// again, as freeing quota in its namespace does not trigger a reconcile
+const quotaRequeueInterval = 5 * time.Minute
+
+// conflictRequeueInterval is how often a LokiRule whose rule file conflicts
+// with another one is checked again. Removing the other rule file or its
+// LokiRule already triggers a reconcile, so this only bounds how long a missed
+// event keeps the LokiRule out of the rules ConfigMap
+const conflictRequeueInterval = 5 * time.Minute
+
+// validationRequeueInterval is how soon a LokiRule whose LogQL expressions
+// could not be validated, as Loki was unreachable, is validated again
+const validationRequeueInterval = 30 * time.Second
+
+const (
+	// logQLValidationTimeout bounds the validation of the LogQL expressions of
+	// all the LokiRules of a reconcile pass
+	logQLValidationTimeout = 30 * time.Second
+	// logQLValidationConcurrency is the number of LokiRules whose LogQL
+	// expressions are validated at the same time
+	logQLValidationConcurrency = 8
 )
 
 // LokiRuleReconciler reconciles a LokiRule object
@@ -39,24 +78,296 @@ type LokiRuleReconciler struct {
 	client.Client
 	Scheme                *runtime.Scheme
 	Logger                logger.Logger
+	Recorder              record.EventRecorder
 	LokiClient            *http.Client
 	LokiRulesPath         string
 	LokiLabelSelector     *metav1.LabelSelector
 	LokiNamespace         string
 	LokiRuleConfigMapName string
-	LokiURL               string
-	UpdateLoki            bool
+	// ConfigMapLabels and ConfigMapAnnotations are set on the rules ConfigMap
+	// on top of the labels identifying it
+	ConfigMapLabels      map[string]string
+	ConfigMapAnnotations map[string]string
+	LokiURL              string
+	RuleOptions          lokirule.Options
+	Quotas               lokirule.Quotas
+	QuarantinePolicy     string
+	// LoadedTimeout is how long the Loki ruler has to load the rule groups of
+	// a written LokiRule, the Loaded condition is not set when 0
+	LoadedTimeout time.Duration
+	UpdateLoki    bool
+	// DryRun logs the changes to the rules ConfigMap, the Loki StatefulSet
+	// and the LokiRule status instead of persisting them
+	DryRun bool
+	// MigrationDone is closed once the RuleFileMigrator is done, reconciles
+	// wait for it so the rules ConfigMap is not written or mounted before its
+	// rule files are moved and renamed. Reconciles do not wait when nil.
+	MigrationDone <-chan struct{}
+
+	// settingsMu guards the settings ApplySettings replaces
+	settingsMu sync.RWMutex
+	// resync triggers the reconciles requested by Resync
+	resync chan event.GenericEvent
+	// lokiReady caches the result of LokiCheck
+	lokiReady cachedCheck
+	// rulesConfigMapReady caches the result of RulesConfigMapReadyCheck
+	rulesConfigMapReady cachedCheck
+	// ownWrites are the rules ConfigMap and Loki StatefulSet as last written
+	ownWrites ownWrites
+	// rejectedSpecs are the specs of the LokiRules Loki rejected in the last
+	// reconcile pass, which is never run concurrently
+	rejectedSpecs map[types.NamespacedName]rejectedSpec
+	// syncMu guards lastSync, when each rule file was last synced with its
+	// LokiRule, by file name
+	syncMu   sync.Mutex
+	lastSync map[string]time.Time
 }
 
-func (r *LokiRuleReconciler) newRuleHandler(
+func (r *LokiRuleReconciler) recordEvent(rule *querocomv1alpha1.LokiRule, eventType, reason, message string) {
+	if r.Recorder == nil {
+		return
+	}
+
+	r.Recorder.Event(rule, eventType, reason, message)
+}
+
+// updateStatus applies mutate to the LokiRule status, updating it only when
+// something changed.
+func (r *LokiRuleReconciler) updateStatus(
+	ctx context.Context,
 	rule *querocomv1alpha1.LokiRule,
+	mutate func(status *querocomv1alpha1.LokiRuleStatus),
 ) error {
-	labels := map[string]string{
-		"app.kubernetes.io/component":  "loki-rule-cfg",
-		"app.kubernetes.io/managed-by": "loki-rule-operator",
+	previous := rule.Status.DeepCopy()
+	mutate(&rule.Status)
+
+	if equality.Semantic.DeepEqual(previous, &rule.Status) {
+		return nil
+	}
+
+	if r.DryRun {
+		r.Logger.Info("Dry run, LokiRule status not updated", "namespace", rule.Namespace, "name", rule.Name)
+		return nil
+	}
+
+	return r.Status().Update(ctx, rule)
+}
+
+func setConditions(
+	rule *querocomv1alpha1.LokiRule,
+	status *querocomv1alpha1.LokiRuleStatus,
+	conditions ...metav1.Condition,
+) {
+	for _, condition := range conditions {
+		condition.ObservedGeneration = rule.Generation
+		meta.SetStatusCondition(&status.Conditions, condition)
+	}
+}
+
+func (r *LokiRuleReconciler) setConditions(
+	ctx context.Context,
+	rule *querocomv1alpha1.LokiRule,
+	conditions ...metav1.Condition,
+) error {
+	return r.updateStatus(ctx, rule, func(status *querocomv1alpha1.LokiRuleStatus) {
+		setConditions(rule, status, conditions...)
+	})
+}
+
+// ruleState is what a reconcile pass decided for a LokiRule.
+type ruleState struct {
+	rule *querocomv1alpha1.LokiRule
+	// ruleFiles are the rendered rule files, nil when the LokiRule is not written
+	ruleFiles map[string]string
+	specHash  string
+	// keep keeps the rule files of a LokiRule that is not written
+	keep bool
+	// previouslyWritten is set when the rules ConfigMap held rule files of
+	// the LokiRule before the reconcile pass
+	previouslyWritten bool
+
+	invalidErr error
+	// validationErr is set when Loki could not validate the LogQL expressions
+	validationErr error
+	// quotaErr is set when the rendered rule files exceed a quota, the
+	// LokiRule then keeps the rule files it owns
+	quotaErr    *lokirule.QuotaExceededError
+	conflictErr *RuleFileConflictError
+	// drifted is set when the rule files of a LokiRule applied at its current
+	// version were edited or removed outside of the operator
+	drifted bool
+}
+
+// renderRule renders the LokiRule, quarantining it when it fails validation.
+func (r *LokiRuleReconciler) renderRule(rule *querocomv1alpha1.LokiRule) (*ruleState, error) {
+	state := &ruleState{rule: rule}
+
+	ruleFiles, err := lokirule.GenerateRuleConfigMapFile(rule, r.RuleOptions)
+	if err != nil {
+		r.quarantine(state, err)
+		return state, nil
+	}
+
+	specHash, err := lokirule.SpecHash(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	state.specHash = specHash
+	state.ruleFiles = ruleFiles
+
+	return state, nil
+}
+
+// quarantine keeps the LokiRule out of the rules ConfigMap as invalid.
+func (r *LokiRuleReconciler) quarantine(state *ruleState, err error) {
+	state.invalidErr = err
+	state.keep = r.QuarantinePolicy != features.QuarantinePolicyOmit
+	state.ruleFiles = nil
+}
+
+// rejectedSpec is a LokiRule spec whose LogQL expressions Loki rejected.
+type rejectedSpec struct {
+	specHash string
+	lokiURL  string
+	err      error
+}
+
+// validateLogQL validates the LogQL expressions of the rendered LokiRules
+// with Loki, concurrently and within logQLValidationTimeout. An expression
+// Loki rejects quarantines the LokiRule, while a request that failed holds
+// the LokiRule back, keeping its rule files, until it is validated again. The
+// first failed request stops the validation of the other LokiRules, as Loki
+// is likely unavailable.
+//
+// A spec already written passed validation and a spec Loki rejected is
+// rejected again, so Loki is only asked about new and changed LokiRules.
+func (r *LokiRuleReconciler) validateLogQL(ctx context.Context, states []*ruleState) {
+	if r.LokiURL == "" {
+		return
+	}
+
+	rejected := map[types.NamespacedName]rejectedSpec{}
+	defer func() { r.rejectedSpecs = rejected }()
+
+	var pending []*ruleState
+	for _, state := range states {
+		if state.ruleFiles == nil || state.specHash == state.rule.Status.LastAppliedSpecHash {
+			continue
+		}
+
+		key := client.ObjectKeyFromObject(state.rule)
+		previous, ok := r.rejectedSpecs[key]
+		if ok && previous.specHash == state.specHash && previous.lokiURL == r.LokiURL {
+			rejected[key] = previous
+			r.quarantine(state, previous.err)
+			continue
+		}
+
+		pending = append(pending, state)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, logQLValidationTimeout)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	invalidExprs := make([]string, len(pending))
+	validated := make([]bool, len(pending))
+	workers := make(chan struct{}, logQLValidationConcurrency)
+
+	for i, state := range pending {
+		wg.Add(1)
+		go func(i int, state *ruleState) {
+			defer wg.Done()
+
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			invalidExpr, err := r.validateExpressions(ctx, state.rule)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				cancel()
+				return
+			}
+
+			invalidExprs[i], validated[i] = invalidExpr, true
+		}(i, state)
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
 	}
 
-	options := k8sutils.Options{Ctx: context.Background(), Logger: r.Logger}
+	for i, state := range pending {
+		switch {
+		case !validated[i]:
+			state.validationErr = fmt.Errorf("failed to validate the LogQL expressions with Loki: %w", firstErr)
+			state.keep = true
+			state.ruleFiles = nil
+		case invalidExprs[i] != "":
+			err := fmt.Errorf("%q is not a valid LogQL query", invalidExprs[i])
+			rejected[client.ObjectKeyFromObject(state.rule)] = rejectedSpec{
+				specHash: state.specHash,
+				lokiURL:  r.LokiURL,
+				err:      err,
+			}
+			r.quarantine(state, err)
+		}
+	}
+}
+
+// validateExpressions sends the LogQL expressions of the LokiRule to Loki one
+// after the other. It returns the first expression Loki rejects, empty when
+// it accepts all of them.
+func (r *LokiRuleReconciler) validateExpressions(ctx context.Context, rule *querocomv1alpha1.LokiRule) (string, error) {
+	for _, queryString := range getStringQueryFromLokiRule(rule) {
+		valid, err := ValidateLogQLOnServerFunc(ctx, r.LokiClient, r.LokiURL, queryString)
+		if err != nil {
+			return "", err
+		}
+
+		if !valid {
+			return queryString, nil
+		}
+	}
+
+	return "", nil
+}
+
+// writeRuleFiles converges the rules ConfigMap to the rule files of the
+// LokiRules and returns it, as it would be written on a dry run. It returns
+// nil when there is nothing to write, i.e. neither the rules ConfigMap nor
+// LokiRules exist.
+func (r *LokiRuleReconciler) writeRuleFiles(ctx context.Context, states []*ruleState) (*corev1.ConfigMap, error) {
+	labels := rulesConfigMapLabels(r.ConfigMapLabels)
+
+	options := k8sutils.Options{Ctx: ctx, Logger: r.Logger, DryRun: r.DryRun}
+
+	if len(states) == 0 {
+		err := r.Get(ctx, types.NamespacedName{Namespace: r.LokiNamespace, Name: r.LokiRuleConfigMapName}, &corev1.ConfigMap{})
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	_, err := k8sutils.CreateConfigMap(
 		r.Client,
@@ -65,34 +376,221 @@ func (r *LokiRuleReconciler) newRuleHandler(
 		labels,
 		options,
 	)
-
 	if err != nil {
-		options.Logger.Error(err, "Failed to ensure configMap exists")
-		return err
-	}
-
-	ruleData, err := lokirule.GenerateRuleConfigMapFile(rule)
-	if err != nil {
-		r.Logger.Error(err, "Failed to generate rule groups")
-		return err
+		return nil, err
 	}
 
-	_, err = k8sutils.AddToConfigMap(
+	configMap, appliedRulesConfigMap, err := updateRuleFiles(
+		ctx,
 		r.Client,
 		r.LokiNamespace,
 		r.LokiRuleConfigMapName,
-		ruleData,
+		r.RuleOptions,
+		func(configMap *corev1.ConfigMap, appliedRules map[string]AppliedRule) error {
+			convergeRuleFiles(configMap, appliedRules, states, r.Quotas)
+			return setConfigMapMetadata(configMap, labels, r.ConfigMapAnnotations)
+		},
 		options,
 	)
+	if err != nil {
+		return nil, err
+	}
+	if !r.DryRun {
+		r.ownWrites.record(configMap)
+		if appliedRulesConfigMap != nil {
+			r.ownWrites.record(appliedRulesConfigMap)
+		}
+	}
 
+	for _, state := range states {
+		if state.drifted && !r.DryRun {
+			r.Logger.Warn("Restored the rule file of LokiRule", "namespace", state.rule.Namespace, "name", state.rule.Name)
+			driftRepairedTotal.WithLabelValues(DriftResourceConfigMap).Inc()
+		}
+	}
+
+	return configMap, nil
+}
+
+// rulesConfigMapLabels returns the labels identifying the rules ConfigMap
+// merged with the extra labels, which cannot override them.
+func rulesConfigMapLabels(extra map[string]string) map[string]string {
+	labels := make(map[string]string, len(extra)+2)
+	for k, v := range extra {
+		labels[k] = v
+	}
+	labels["app.kubernetes.io/component"] = "loki-rule-cfg"
+	labels["app.kubernetes.io/managed-by"] = "loki-rule-operator"
+	return labels
+}
+
+// setConfigMapMetadata sets the labels and annotations of the rules ConfigMap
+// and removes the ones the operator set before but are no longer configured.
+// Labels and annotations set by others are left untouched.
+func setConfigMapMetadata(configMap *corev1.ConfigMap, labels, annotations map[string]string) error {
+	owned, err := k8sutils.OwnedConfigMapKeys(configMap)
 	if err != nil {
-		r.Logger.Error(err, "Failed to ensure configMap exists")
 		return err
 	}
+
+	for k := range owned.Labels {
+		if _, ok := labels[k]; !ok {
+			delete(configMap.Labels, k)
+		}
+	}
+	for k := range owned.Annotations {
+		if _, ok := annotations[k]; !ok {
+			delete(configMap.Annotations, k)
+		}
+	}
+
+	if configMap.Labels == nil {
+		configMap.Labels = map[string]string{}
+	}
+	for k, v := range labels {
+		configMap.Labels[k] = v
+	}
+
+	if configMap.Annotations == nil && len(annotations) > 0 {
+		configMap.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		configMap.Annotations[k] = v
+	}
+
 	return nil
 }
 
+// setConditionsWithEvent sets the conditions of the LokiRule and, when the
+// first one changes, records an event, so a LokiRule in the same state on
+// every reconcile pass is reported once.
+func (r *LokiRuleReconciler) setConditionsWithEvent(
+	ctx context.Context,
+	rule *querocomv1alpha1.LokiRule,
+	eventType string,
+	mutate func(status *querocomv1alpha1.LokiRuleStatus),
+	conditions ...metav1.Condition,
+) error {
+	current := meta.FindStatusCondition(rule.Status.Conditions, conditions[0].Type)
+	if current == nil || current.Status != conditions[0].Status || current.Reason != conditions[0].Reason ||
+		current.Message != conditions[0].Message {
+		r.recordEvent(rule, eventType, conditions[0].Reason, conditions[0].Message)
+	}
+
+	return r.updateStatus(ctx, rule, func(status *querocomv1alpha1.LokiRuleStatus) {
+		if mutate != nil {
+			mutate(status)
+		}
+		setConditions(rule, status, conditions...)
+	})
+}
+
+// reportRuleState updates the status of the LokiRule with the outcome of the
+// reconcile pass. It returns how soon the LokiRule needs to be checked again,
+// or zero, as what prevents it from being written does not trigger a
+// reconcile.
+func (r *LokiRuleReconciler) reportRuleState(ctx context.Context, state *ruleState) (time.Duration, error) {
+	rule := state.rule
+
+	switch {
+	case state.invalidErr != nil:
+		message := fmt.Sprintf("Rule file not written: %s", state.invalidErr)
+		switch {
+		case state.previouslyWritten && state.keep:
+			message = fmt.Sprintf("Keeping the last known-good rule file: %s", state.invalidErr)
+		case state.previouslyWritten:
+			message = fmt.Sprintf("Rule file removed: %s", state.invalidErr)
+		}
+
+		r.Logger.Warn("LokiRule quarantined", "namespace", rule.Namespace, "name", rule.Name, "err", state.invalidErr.Error())
+		return 0, r.setConditionsWithEvent(
+			ctx,
+			rule,
+			corev1.EventTypeWarning,
+			clearLoaded,
+			metav1.Condition{
+				Type:    querocomv1alpha1.ConditionQuarantined,
+				Status:  metav1.ConditionTrue,
+				Reason:  querocomv1alpha1.ReasonInvalidRule,
+				Message: message,
+			},
+			metav1.Condition{
+				Type:    querocomv1alpha1.ConditionAccepted,
+				Status:  metav1.ConditionFalse,
+				Reason:  querocomv1alpha1.ReasonInvalidRule,
+				Message: state.invalidErr.Error(),
+			},
+		)
+
+	case state.validationErr != nil:
+		r.Logger.Warn(
+			"LokiRule not validated",
+			"namespace", rule.Namespace,
+			"name", rule.Name,
+			"err", state.validationErr.Error(),
+		)
+		return validationRequeueInterval, r.setConditionsWithEvent(
+			ctx,
+			rule,
+			corev1.EventTypeWarning,
+			clearLoaded,
+			metav1.Condition{
+				Type:    querocomv1alpha1.ConditionAccepted,
+				Status:  metav1.ConditionFalse,
+				Reason:  querocomv1alpha1.ReasonLokiUnavailable,
+				Message: state.validationErr.Error(),
+			},
+		)
+
+	case state.quotaErr != nil:
+		r.Logger.Warn("LokiRule exceeds quota", "namespace", rule.Namespace, "name", rule.Name, "err", state.quotaErr.Error())
+		return quotaRequeueInterval, r.setConditionsWithEvent(ctx, rule, corev1.EventTypeWarning, clearLoaded, metav1.Condition{
+			Type:    querocomv1alpha1.ConditionAccepted,
+			Status:  metav1.ConditionFalse,
+			Reason:  querocomv1alpha1.ReasonQuotaExceeded,
+			Message: state.quotaErr.Error(),
+		})
+
+	case state.conflictErr != nil:
+		r.Logger.Warn(
+			"LokiRule rule file conflicts",
+			"namespace", rule.Namespace,
+			"name", rule.Name,
+			"err", state.conflictErr.Error(),
+		)
+		return conflictRequeueInterval, r.setConditionsWithEvent(ctx, rule, corev1.EventTypeWarning, clearLoaded, metav1.Condition{
+			Type:    querocomv1alpha1.ConditionAccepted,
+			Status:  metav1.ConditionFalse,
+			Reason:  querocomv1alpha1.ReasonRuleFileConflict,
+			Message: state.conflictErr.Error(),
+		})
+	}
+
+	return 0, r.setConditionsWithEvent(
+		ctx,
+		rule,
+		corev1.EventTypeNormal,
+		func(status *querocomv1alpha1.LokiRuleStatus) {
+			status.LastAppliedGeneration = rule.Generation
+			status.LastAppliedSpecHash = state.specHash
+		},
+		metav1.Condition{
+			Type:    querocomv1alpha1.ConditionAccepted,
+			Status:  metav1.ConditionTrue,
+			Reason:  querocomv1alpha1.ReasonAccepted,
+			Message: "LokiRule written to the rules ConfigMap",
+		},
+		metav1.Condition{
+			Type:    querocomv1alpha1.ConditionQuarantined,
+			Status:  metav1.ConditionFalse,
+			Reason:  querocomv1alpha1.ReasonValidRule,
+			Message: "LokiRule passed validation",
+		},
+	)
+}
+
 func getLokiStatefulSet(
+	ctx context.Context,
 	client client.Client,
 	labelSelector *metav1.LabelSelector,
 	namespace string,
@@ -102,7 +600,7 @@ func getLokiStatefulSet(
 		client,
 		labelSelector,
 		namespace,
-		k8sutils.Options{Ctx: context.Background(), Logger: logger},
+		k8sutils.Options{Ctx: ctx, Logger: logger},
 	)
 
 	if err != nil {
@@ -112,23 +610,6 @@ func getLokiStatefulSet(
 	return statefulSet, nil
 }
 
-func (r *LokiRuleReconciler) handleValidateLogQLResult(queryStringArray []string) bool {
-	for _, queryString := range queryStringArray {
-		valid, err := ValidateLogQLOnServerFunc(r.LokiClient, r.LokiURL, queryString)
-
-		if err != nil {
-			r.Logger.Error(err, "Failed to send request to Loki server")
-			return false
-		}
-
-		if !valid {
-			r.Logger.Warn("The query string:", queryString, "is not a valid LogQL query")
-			return false
-		}
-	}
-	return true
-}
-
 func getStringQueryFromLokiRule(rule *querocomv1alpha1.LokiRule) []string {
 
 	var queryArray []string
@@ -142,107 +623,205 @@ func getStringQueryFromLokiRule(rule *querocomv1alpha1.LokiRule) []string {
 	return queryArray
 }
 
-func handleByEventType(r *LokiRuleReconciler) predicate.Predicate {
-	return predicate.Funcs{
-		CreateFunc: func(e event.CreateEvent) bool {
-			queryStringArray := getStringQueryFromLokiRule(e.Object.(*querocomv1alpha1.LokiRule))
-			return r.handleValidateLogQLResult(queryStringArray)
-		},
-		UpdateFunc: func(e event.UpdateEvent) bool {
-			queryStringArray := getStringQueryFromLokiRule(e.ObjectNew.(*querocomv1alpha1.LokiRule))
-			return r.handleValidateLogQLResult(queryStringArray)
-		},
-		DeleteFunc: func(e event.DeleteEvent) bool {
-			options := k8sutils.Options{Ctx: context.TODO(), Logger: r.Logger}
-			deletedInstance := e.Object.(*querocomv1alpha1.LokiRule)
-
-			r.Logger.Info(
-				"Reconciling deleted LokiRule",
-				"namespace",
-				deletedInstance.Namespace,
-				"name",
-				deletedInstance.Name,
-			)
-
-			configMapFileToRemove, err := lokirule.GenerateRuleConfigMapFile(deletedInstance)
-			if err != nil {
-				r.Logger.Error(err, "Failed to generate rule groups")
-			}
+// rulesConfigMapRequest is the single request of the reconciler: every
+// reconcile rebuilds the whole rules ConfigMap, named by the request, from
+// all the LokiRules.
+func (r *LokiRuleReconciler) rulesConfigMapRequest(context.Context, client.Object) []reconcile.Request {
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{Namespace: r.LokiNamespace, Name: r.LokiRuleConfigMapName},
+	}}
+}
 
-			_, err = k8sutils.RemoveFromConfigMap(
-				r.Client,
-				r.LokiNamespace,
-				r.LokiRuleConfigMapName,
-				configMapFileToRemove,
-				options,
-			)
-			if err != nil {
-				r.Logger.Error(err, "Failed to ensure configMap exists")
-			}
+// isRulesConfigMap selects the rules ConfigMap and its applied rules
+// ConfigMap, which tells the rule files the operator owns apart.
+func (r *LokiRuleReconciler) isRulesConfigMap(obj client.Object) bool {
+	return obj.GetNamespace() == r.LokiNamespace &&
+		(obj.GetName() == r.LokiRuleConfigMapName ||
+			obj.GetName() == lokirule.AppliedRulesConfigMapName(r.LokiRuleConfigMapName))
+}
 
-			if r.UpdateLoki {
-				lokiStatefulset, err := getLokiStatefulSet(
-					r.Client,
-					r.LokiLabelSelector,
-					r.LokiNamespace,
-					r.Logger,
-				)
-				if err != nil {
-					r.Logger.Error(err, "Failed to get Loki statefulSet")
-				}
+// isLokiStatefulSet selects the Loki StatefulSets matched by LokiLabelSelector.
+func (r *LokiRuleReconciler) isLokiStatefulSet(obj client.Object) bool {
+	selector, err := metav1.LabelSelectorAsSelector(r.LokiLabelSelector)
+	if err != nil {
+		return false
+	}
+	return obj.GetNamespace() == r.LokiNamespace && selector.Matches(labels.Set(obj.GetLabels()))
+}
 
-				err = k8sutils.MountConfigMap(
-					r.Client,
-					r.LokiNamespace,
-					r.LokiRuleConfigMapName,
-					r.LokiRulesPath,
-					lokiStatefulset,
-					options,
-				)
-
-				if err != nil {
-					r.Logger.Error(err, "ConfigMap not attached")
-				}
-			}
+// ownWrites holds the resource version of the objects the operator last
+// wrote, so the watch events of its own writes do not trigger a reconcile.
+type ownWrites struct {
+	mu       sync.Mutex
+	versions map[string]string
+}
+
+func ownWriteKey(obj client.Object) string {
+	return fmt.Sprintf("%T/%s/%s", obj, obj.GetNamespace(), obj.GetName())
+}
+
+func (w *ownWrites) record(obj client.Object) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.versions == nil {
+		w.versions = map[string]string{}
+	}
+	w.versions[ownWriteKey(obj)] = obj.GetResourceVersion()
+}
+
+// isOwnWrite returns whether obj is the object as the operator last wrote it.
+func (w *ownWrites) isOwnWrite(obj client.Object) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-			r.Logger.Info("LokiRule Reconciled")
+	version, ok := w.versions[ownWriteKey(obj)]
+	return ok && version != "" && version == obj.GetResourceVersion()
+}
 
-			return false
+// notOwnWrite filters out the updates of the rules ConfigMap and of the Loki
+// StatefulSet made by the operator itself.
+func (r *LokiRuleReconciler) notOwnWrite() predicate.Funcs {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return !r.ownWrites.isOwnWrite(e.ObjectNew)
 		},
 	}
 }
 
+// SetupWithManager reconciles the rules ConfigMap whenever a LokiRule, the
+// rules ConfigMap, its applied rules ConfigMap or the Loki StatefulSet change,
+// or a resync is requested, so missed events and changes made outside of the
+// operator are caught up with by the next reconcile. The operator's own writes
+// are not changes, nor are updates of the Loki StatefulSet leaving its spec,
+// where the rules volume, mount and checksum annotation are, unchanged, e.g.
+// its status updates during a rollout.
 func (r *LokiRuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&querocomv1alpha1.LokiRule{}).
-		WithEventFilter(handleByEventType(r)).
-		Complete(r)
+	r.resync = make(chan event.GenericEvent, 1)
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named("lokirule").
+		WatchesRawSource(
+			&source.Channel{Source: r.resync},
+			handler.EnqueueRequestsFromMapFunc(r.rulesConfigMapRequest),
+		).
+		Watches(
+			&querocomv1alpha1.LokiRule{},
+			handler.EnqueueRequestsFromMapFunc(r.rulesConfigMapRequest),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		).
+		Watches(
+			&corev1.ConfigMap{},
+			handler.EnqueueRequestsFromMapFunc(r.rulesConfigMapRequest),
+			builder.WithPredicates(predicate.NewPredicateFuncs(r.isRulesConfigMap), r.notOwnWrite()),
+		)
+
+	if r.UpdateLoki {
+		b = b.Watches(
+			&appsv1.StatefulSet{},
+			handler.EnqueueRequestsFromMapFunc(r.rulesConfigMapRequest),
+			builder.WithPredicates(
+				predicate.NewPredicateFuncs(r.isLokiStatefulSet),
+				predicate.GenerationChangedPredicate{},
+				r.notOwnWrite(),
+			),
+		)
+	}
+
+	return b.Complete(r)
 }
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
 //
+// Reconcile is level-based: it renders every LokiRule and converges the rules
+// ConfigMap, the LokiRule statuses and the Loki StatefulSet in one pass,
+// whichever object changed, so it does not depend on the order of events nor
+// on seeing all of them.
+//
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.13.0/pkg/reconcile
 func (r *LokiRuleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	options := k8sutils.Options{Ctx: ctx, Logger: r.Logger}
+	if r.MigrationDone != nil {
+		select {
+		case <-r.MigrationDone:
+		case <-ctx.Done():
+			return reconcile.Result{}, ctx.Err()
+		}
+	}
 
-	r.Logger.Info("Reconciling LokiRule", "namespace", req.NamespacedName)
+	r.settingsMu.RLock()
+	defer r.settingsMu.RUnlock()
 
-	instance := &querocomv1alpha1.LokiRule{}
-	err := r.Get(ctx, req.NamespacedName, instance)
-	if err != nil {
+	options := k8sutils.Options{Ctx: ctx, Logger: r.Logger, DryRun: r.DryRun}
+
+	r.Logger.Info("Reconciling LokiRules", "configMap", req.NamespacedName)
+
+	rules := &querocomv1alpha1.LokiRuleList{}
+	if err := r.List(ctx, rules); err != nil {
 		return reconcile.Result{}, err
 	}
 
-	err = r.newRuleHandler(instance)
+	states := make([]*ruleState, 0, len(rules.Items))
+	for i := range rules.Items {
+		rule := &rules.Items[i]
+		if !rule.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		state, err := r.renderRule(rule)
+		if err != nil {
+			r.Logger.Error(err, "Failed to render LokiRule", "namespace", rule.Namespace, "name", rule.Name)
+			return reconcile.Result{}, err
+		}
+		states = append(states, state)
+	}
+
+	r.validateLogQL(ctx, states)
 
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].rule.Namespace != states[j].rule.Namespace {
+			return states[i].rule.Namespace < states[j].rule.Namespace
+		}
+		return states[i].rule.Name < states[j].rule.Name
+	})
+
+	configMap, err := r.writeRuleFiles(ctx, states)
 	if err != nil {
-		r.Logger.Error(err, "Failed to handle LokiRule")
+		r.Logger.Error(err, "Failed to write the rules ConfigMap")
+		return reconcile.Result{}, err
+	}
+	if configMap == nil {
+		r.Logger.Info("No LokiRules to reconcile")
+		r.recordSync(nil, nil)
+		return reconcile.Result{}, nil
+	}
+
+	result := reconcile.Result{}
+	var errs []error
+	for _, state := range states {
+		requeueAfter, err := r.reportRuleState(ctx, state)
+		// A LokiRule deleted since it was listed has nothing left to report,
+		// its deletion triggers another reconcile removing its rule files.
+		if apierrors.IsNotFound(err) {
+			r.Logger.Debug("LokiRule deleted during reconcile", "namespace", state.rule.Namespace, "name", state.rule.Name)
+			continue
+		}
+		if err != nil {
+			r.Logger.Error(err, "Failed to update LokiRule status", "namespace", state.rule.Namespace, "name", state.rule.Name)
+			errs = append(errs, err)
+		}
+		if requeueAfter > 0 && (result.RequeueAfter == 0 || requeueAfter < result.RequeueAfter) {
+			result.RequeueAfter = requeueAfter
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return reconcile.Result{}, err
 	}
 
 	if r.UpdateLoki {
 		lokiStatefulset, err := getLokiStatefulSet(
+			ctx,
 			r.Client,
 			r.LokiLabelSelector,
 			r.LokiNamespace,
@@ -253,10 +832,11 @@ func (r *LokiRuleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 			return reconcile.Result{}, err
 		}
 
+		drifted := k8sutils.ConfigMapMountDrifted(r.LokiRuleConfigMapName, lokiStatefulset)
+
 		err = k8sutils.MountConfigMap(
 			r.Client,
-			r.LokiNamespace,
-			r.LokiRuleConfigMapName,
+			configMap,
 			r.LokiRulesPath,
 			lokiStatefulset,
 			options,
@@ -265,9 +845,29 @@ func (r *LokiRuleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 			r.Logger.Error(err, "ConfigMap not attached")
 			return reconcile.Result{}, err
 		}
+		if !r.DryRun {
+			r.ownWrites.record(lokiStatefulset)
+		}
+
+		if drifted && !r.DryRun {
+			r.Logger.Warn("Restored the rules volume of the Loki StatefulSet", "name", lokiStatefulset.Name)
+			driftRepairedTotal.WithLabelValues(DriftResourceStatefulSet).Inc()
+		}
+	}
+
+	// The Loki ruler is checked last, once the rules ConfigMap is mounted.
+	if r.LokiURL != "" && r.LoadedTimeout > 0 {
+		requeueAfter, err := r.verifyLoaded(ctx, states)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if requeueAfter > 0 && (result.RequeueAfter == 0 || requeueAfter < result.RequeueAfter) {
+			result.RequeueAfter = requeueAfter
+		}
 	}
 
-	r.Logger.Info("LokiRule Reconciled")
+	r.Logger.Info("LokiRules Reconciled", "count", len(states))
+	r.recordSync(configMap, states)
 
-	return ctrl.Result{}, nil
+	return result, nil
 }
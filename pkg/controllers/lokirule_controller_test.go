@@ -16,8 +16,10 @@ import (
 
 	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
 	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -202,7 +204,7 @@ var _ = Describe("LokiRuleController", func() {
 						}
 
 						unmarshaledCfgMapData := map[string]interface{}{}
-						err = yaml.Unmarshal([]byte(configMap.Data["default-test-lokirule.yaml"]), &unmarshaledCfgMapData)
+						err = yaml.Unmarshal([]byte(configMap.Data["default_test-lokirule.yaml"]), &unmarshaledCfgMapData)
 						if err != nil {
 							GinkgoWriter.Printf("Error unmarshaling configMap data, %v", err)
 							return false
@@ -270,7 +272,7 @@ var _ = Describe("LokiRuleController", func() {
 					}
 
 					// generated from lokirule.data
-					const expectedAnnotationHash = "3866fad9d3a968d9a28648397af7c83d57b93e629652b1962631eae56790f75a"
+					const expectedAnnotationHash = "125616ba09f7834f546716172521e482fdbe8dbb6599caaf165d46a5ae8531e7"
 					expectedAnnotationName := fmt.Sprintf("checksum/config-%s", lokiRuleConfigMapMutableName)
 
 					if resultStatefulSet.Spec.Template.Annotations == nil {
@@ -394,7 +396,7 @@ var _ = Describe("LokiRuleController", func() {
 
 							lokiRuleOneUnmarshaledCfgMapData := map[string]interface{}{}
 							err = yaml.Unmarshal(
-								[]byte(configMap.Data["default-test-lokirule.yaml"]),
+								[]byte(configMap.Data["default_test-lokirule.yaml"]),
 								&lokiRuleOneUnmarshaledCfgMapData,
 							)
 							if err != nil {
@@ -429,7 +431,7 @@ var _ = Describe("LokiRuleController", func() {
 							lokiRuleTwoUnmarshaledCfgMapData := map[string]interface{}{}
 
 							err = yaml.Unmarshal(
-								[]byte(configMap.Data["default-test-lokirule-2.yaml"]),
+								[]byte(configMap.Data["default_test-lokirule-2.yaml"]),
 								&lokiRuleTwoUnmarshaledCfgMapData,
 							)
 							if err != nil {
@@ -547,7 +549,7 @@ var _ = Describe("LokiRuleController", func() {
 						}
 
 						unmarshaledCfgMapData := map[string]interface{}{}
-						err = yaml.Unmarshal([]byte(configMap.Data["default-test2-lokirule.yaml"]), &unmarshaledCfgMapData)
+						err = yaml.Unmarshal([]byte(configMap.Data["default_test2-lokirule.yaml"]), &unmarshaledCfgMapData)
 						if err != nil {
 							GinkgoWriter.Printf("Error unmarshaling configMap data, %v", err)
 							return false
@@ -610,7 +612,7 @@ var _ = Describe("LokiRuleController", func() {
 						}
 
 						unmarshaledRuleFile := map[string][]map[string]interface{}{}
-						ruleFileByteData := []byte(configMap.Data["default-test-lokirule-update.yaml"])
+						ruleFileByteData := []byte(configMap.Data["default_test-lokirule-update.yaml"])
 						err = yaml.Unmarshal(ruleFileByteData, &unmarshaledRuleFile)
 						if err != nil {
 							GinkgoWriter.Printf("Error unmarshaling rules, %v\n%v", err, string(ruleFileByteData))
@@ -650,6 +652,123 @@ var _ = Describe("LokiRuleController", func() {
 				}
 			})
 		})
+
+		Context("When a LokiRule fails validation", func() {
+			const lokiRuleName = "test-lokirule-quarantine"
+
+			BeforeEach(func() {
+				lokiRule := &querocomv1alpha1.LokiRule{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      lokiRuleName,
+						Namespace: namespaceName,
+					},
+					Spec: querocomv1alpha1.LokiRuleSpec{
+						Groups: []querocomv1alpha1.RuleGroup{
+							{
+								Name: "test_group",
+								Rules: []querocomv1alpha1.Rule{
+									{
+										Alert: "TestAlert",
+										Expr:  "test_expr",
+										Annotations: map[string]string{
+											"summary": "{{ $labels.job }}",
+										},
+									},
+								},
+							},
+						},
+					},
+				}
+				err := k8sClient.Create(context.TODO(), lokiRule)
+				Expect(err).To(BeNil())
+
+				Eventually(func() bool {
+					configMap := &corev1.ConfigMap{}
+					err := k8sClient.Get(context.TODO(), client.ObjectKey{
+						Name:      lokiRuleConfigMapMutableName,
+						Namespace: lokiSTSNamespaceName,
+					}, configMap)
+					if err != nil {
+						return false
+					}
+
+					_, ok := configMap.Data["default_test-lokirule-quarantine.yaml"]
+					return ok
+				}, timeout, interval).Should(BeTrue())
+
+				Eventually(func() error {
+					err := k8sClient.Get(context.TODO(), client.ObjectKey{
+						Name:      lokiRuleName,
+						Namespace: namespaceName,
+					}, lokiRule)
+					if err != nil {
+						return err
+					}
+
+					lokiRule.Spec.Groups[0].Rules[0].Annotations["summary"] = "{{ $labels.job "
+					return k8sClient.Update(context.TODO(), lokiRule)
+				}, timeout, interval).Should(Succeed())
+			})
+
+			AfterEach(func() {
+				lokiRule := &querocomv1alpha1.LokiRule{}
+				err := k8sClient.Get(context.TODO(), client.ObjectKey{
+					Name:      lokiRuleName,
+					Namespace: namespaceName,
+				}, lokiRule)
+				Expect(err).To(BeNil())
+
+				err = k8sClient.Delete(context.TODO(), lokiRule)
+				Expect(err).To(BeNil())
+			})
+
+			It("Should quarantine the LokiRule and keep the last known-good rule file", func() {
+				Eventually(func() bool {
+					lokiRule := &querocomv1alpha1.LokiRule{}
+					err := k8sClient.Get(context.TODO(), client.ObjectKey{
+						Name:      lokiRuleName,
+						Namespace: namespaceName,
+					}, lokiRule)
+					if err != nil {
+						GinkgoWriter.Printf("Error getting LokiRule: %v\n", err)
+						return false
+					}
+
+					condition := meta.FindStatusCondition(lokiRule.Status.Conditions, querocomv1alpha1.ConditionQuarantined)
+					if condition == nil || condition.Status != metav1.ConditionTrue {
+						GinkgoWriter.Printf("LokiRule is not quarantined, conditions: %v\n", lokiRule.Status.Conditions)
+						return false
+					}
+
+					return condition.Reason == querocomv1alpha1.ReasonInvalidRule
+				}, timeout, interval).Should(BeTrue())
+
+				configMap := &corev1.ConfigMap{}
+				err := k8sClient.Get(context.TODO(), client.ObjectKey{
+					Name:      lokiRuleConfigMapMutableName,
+					Namespace: lokiSTSNamespaceName,
+				}, configMap)
+				Expect(err).To(BeNil())
+				Expect(configMap.Data["default_test-lokirule-quarantine.yaml"]).To(ContainSubstring("{{ $labels.job }}"))
+
+				lokiRule := &querocomv1alpha1.LokiRule{}
+				err = k8sClient.Get(context.TODO(), client.ObjectKey{
+					Name:      lokiRuleName,
+					Namespace: namespaceName,
+				}, lokiRule)
+				Expect(err).To(BeNil())
+				Expect(lokiRule.Status.LastAppliedGeneration).To(BeNumerically("<", lokiRule.Generation))
+
+				appliedRules, err := GetAppliedRules(context.TODO(), k8sClient, configMap, lokirule.Options{})
+				Expect(err).To(BeNil())
+				Expect(appliedRules).To(HaveKeyWithValue("default_test-lokirule-quarantine.yaml", AppliedRule{
+					Namespace:  namespaceName,
+					Name:       lokiRuleName,
+					Generation: lokiRule.Status.LastAppliedGeneration,
+					SpecHash:   lokiRule.Status.LastAppliedSpecHash,
+				}))
+			})
+		})
 	})
 })
 
@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// quotaAllocator allocates the quotas to LokiRules one after the other,
+// keeping the usage of every namespace.
+type quotaAllocator struct {
+	quotas lokirule.Quotas
+	used   map[string]lokirule.Usage
+}
+
+func newQuotaAllocator(quotas lokirule.Quotas) *quotaAllocator {
+	return &quotaAllocator{quotas: quotas, used: map[string]lokirule.Usage{}}
+}
+
+// add counts usage in the namespace whatever the quotas, e.g. for the rule
+// files kept in the rules ConfigMap.
+func (a *quotaAllocator) add(namespace string, usage lokirule.Usage) {
+	a.used[namespace] = a.used[namespace].Add(usage)
+}
+
+// allocate counts the usage of a LokiRule in its namespace when it is within
+// the per object quota and the quota left in the namespace, and returns a
+// *lokirule.QuotaExceededError otherwise.
+func (a *quotaAllocator) allocate(namespace string, usage lokirule.Usage) error {
+	if err := a.quotas.PerObject.Check(lokirule.QuotaScopeObject, usage); err != nil {
+		return err
+	}
+
+	used := a.used[namespace].Add(usage)
+	if err := a.quotas.PerNamespace.Check(lokirule.QuotaScopeNamespace, used); err != nil {
+		return err
+	}
+
+	a.used[namespace] = used
+	return nil
+}
+
+// allocatedBefore orders LokiRules the way quotas are allocated to them, the
+// oldest first, so an existing LokiRule is never pushed out of the quota by a
+// newer one.
+func allocatedBefore(a, b *querocomv1alpha1.LokiRule) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
+
+// checkQuota verifies the LokiRule against the quotas the way the reconciler
+// allocates them: the other valid LokiRules of its namespace created before it
+// are allocated their quota first, in order, and the LokiRule gets what is
+// left. A LokiRule being created is the newest.
+func checkQuota(
+	ctx context.Context,
+	reader client.Reader,
+	rule *querocomv1alpha1.LokiRule,
+	quotas lokirule.Quotas,
+	options lokirule.Options,
+) error {
+	if !quotas.IsEnabled() {
+		return nil
+	}
+
+	ruleFile, err := lokirule.GenerateRuleConfigMapFile(rule, options)
+	if err != nil {
+		return err
+	}
+
+	usage := lokirule.UsageOf(rule, ruleFile)
+	if quotas.PerNamespace == (lokirule.Quota{}) {
+		return quotas.PerObject.Check(lokirule.QuotaScopeObject, usage)
+	}
+
+	rules := &querocomv1alpha1.LokiRuleList{}
+	if err := reader.List(ctx, rules, client.InNamespace(rule.Namespace)); err != nil {
+		return err
+	}
+
+	rule = rule.DeepCopy()
+	if rule.CreationTimestamp.IsZero() {
+		rule.CreationTimestamp = metav1.Now()
+	}
+
+	candidates := []*querocomv1alpha1.LokiRule{rule}
+	for i := range rules.Items {
+		if rules.Items[i].Name != rule.Name {
+			candidates = append(candidates, &rules.Items[i])
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return allocatedBefore(candidates[i], candidates[j]) })
+
+	allocator := newQuotaAllocator(quotas)
+	for _, candidate := range candidates {
+		if candidate == rule {
+			return allocator.allocate(rule.Namespace, usage)
+		}
+
+		otherRuleFile, err := lokirule.GenerateRuleConfigMapFile(candidate, options)
+		if err != nil {
+			// invalid LokiRules are never written to the rules ConfigMap
+			continue
+		}
+
+		// a LokiRule exceeding a quota is not written, so it is not counted
+		_ = allocator.allocate(candidate.Namespace, lokirule.UsageOf(candidate, otherRuleFile))
+	}
+
+	return nil
+}
+
+//+kubebuilder:webhook:path=/validate-quero-com-v1alpha1-lokirule,mutating=false,failurePolicy=fail,sideEffects=None,groups=quero.com,resources=lokirules,verbs=create;update,versions=v1alpha1,name=vlokirule.quero.com,admissionReviewVersions=v1
+
+// LokiRuleValidator rejects invalid LokiRules and LokiRules exceeding the configured quotas
+type LokiRuleValidator struct {
+	Client      client.Reader
+	Quotas      lokirule.Quotas
+	RuleOptions lokirule.Options
+
+	// settingsMu guards the settings ApplySettings replaces
+	settingsMu sync.RWMutex
+}
+
+var _ admission.CustomValidator = &LokiRuleValidator{}
+
+func (v *LokiRuleValidator) validate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	rule, ok := obj.(*querocomv1alpha1.LokiRule)
+	if !ok {
+		return nil, fmt.Errorf("expected a LokiRule but got a %T", obj)
+	}
+
+	if err := lokirule.Validate(rule); err != nil {
+		return nil, err
+	}
+
+	v.settingsMu.RLock()
+	defer v.settingsMu.RUnlock()
+
+	return nil, checkQuota(ctx, v.Client, rule, v.Quotas, v.RuleOptions)
+}
+
+func (v *LokiRuleValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return v.validate(ctx, obj)
+}
+
+func (v *LokiRuleValidator) ValidateUpdate(
+	ctx context.Context,
+	_ runtime.Object,
+	newObj runtime.Object,
+) (admission.Warnings, error) {
+	return v.validate(ctx, newObj)
+}
+
+func (v *LokiRuleValidator) ValidateDelete(_ context.Context, _ runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *LokiRuleValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&querocomv1alpha1.LokiRule{}).
+		WithValidator(v).
+		Complete()
+}
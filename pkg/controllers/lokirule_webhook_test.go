@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newQuotaTestRule(namespace string, name string, rules int) *querocomv1alpha1.LokiRule {
+	group := querocomv1alpha1.RuleGroup{Name: name}
+	for i := 0; i < rules; i++ {
+		group.Rules = append(group.Rules, querocomv1alpha1.Rule{Record: "test_record", Expr: "test_expr"})
+	}
+
+	return &querocomv1alpha1.LokiRule{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       querocomv1alpha1.LokiRuleSpec{Groups: []querocomv1alpha1.RuleGroup{group}},
+	}
+}
+
+func newQuotaTestValidator(t *testing.T, quotas lokirule.Quotas, objects ...*querocomv1alpha1.LokiRule) *LokiRuleValidator {
+	builder := newFakeClientBuilder(t)
+	for _, obj := range objects {
+		builder = builder.WithObjects(obj)
+	}
+
+	return &LokiRuleValidator{Client: builder.Build(), Quotas: quotas}
+}
+
+func TestLokiRuleValidatorPerObjectQuota(t *testing.T) {
+	validator := newQuotaTestValidator(t, lokirule.Quotas{PerObject: lokirule.Quota{MaxRules: 2}})
+
+	_, err := validator.ValidateCreate(context.TODO(), newQuotaTestRule("default", "within", 2))
+	if err != nil {
+		t.Errorf("The LokiRule should be accepted: %v", err)
+	}
+
+	_, err = validator.ValidateCreate(context.TODO(), newQuotaTestRule("default", "exceeding", 3))
+	quotaErr := &lokirule.QuotaExceededError{}
+	if !errors.As(err, &quotaErr) || quotaErr.Scope != lokirule.QuotaScopeObject {
+		t.Errorf("The LokiRule should exceed the object quota, got: %v", err)
+	}
+}
+
+func TestLokiRuleValidatorPerNamespaceQuota(t *testing.T) {
+	quotaExceeded := newQuotaTestRule("default", "quota-exceeded", 5)
+	quotaExceeded.Status.Conditions = []metav1.Condition{{
+		Type:   querocomv1alpha1.ConditionAccepted,
+		Status: metav1.ConditionFalse,
+		Reason: querocomv1alpha1.ReasonQuotaExceeded,
+	}}
+
+	validator := newQuotaTestValidator(
+		t,
+		lokirule.Quotas{PerNamespace: lokirule.Quota{MaxRules: 4}},
+		newQuotaTestRule("default", "existing", 2),
+		newQuotaTestRule("other", "other-namespace", 5),
+		quotaExceeded,
+	)
+
+	_, err := validator.ValidateCreate(context.TODO(), newQuotaTestRule("default", "within", 2))
+	if err != nil {
+		t.Errorf("The LokiRule should be accepted: %v", err)
+	}
+
+	_, err = validator.ValidateUpdate(
+		context.TODO(),
+		newQuotaTestRule("default", "existing", 2),
+		newQuotaTestRule("default", "existing", 4),
+	)
+	if err != nil {
+		t.Errorf("The updated LokiRule should not be counted twice: %v", err)
+	}
+
+	_, err = validator.ValidateCreate(context.TODO(), newQuotaTestRule("default", "exceeding", 3))
+	quotaErr := &lokirule.QuotaExceededError{}
+	if !errors.As(err, &quotaErr) || quotaErr.Scope != lokirule.QuotaScopeNamespace {
+		t.Errorf("The LokiRule should exceed the namespace quota, got: %v", err)
+	}
+}
+
+func TestLokiRuleValidatorAllocatesNamespaceQuotaByCreation(t *testing.T) {
+	created := metav1.Now()
+	older := newQuotaTestRule("default", "older", 3)
+	older.CreationTimestamp = created
+	newer := newQuotaTestRule("default", "newer", 1)
+	newer.CreationTimestamp = metav1.NewTime(created.Add(time.Minute))
+
+	validator := newQuotaTestValidator(t, lokirule.Quotas{PerNamespace: lokirule.Quota{MaxRules: 4}}, older, newer)
+
+	// Growing the newer LokiRule only competes with the LokiRules created
+	// before it.
+	grownNewer := newQuotaTestRule("default", "newer", 2)
+	grownNewer.CreationTimestamp = newer.CreationTimestamp
+	_, err := validator.ValidateUpdate(context.TODO(), newer, grownNewer)
+	quotaErr := &lokirule.QuotaExceededError{}
+	if !errors.As(err, &quotaErr) || quotaErr.Scope != lokirule.QuotaScopeNamespace {
+		t.Errorf("The newer LokiRule should exceed the namespace quota, got: %v", err)
+	}
+
+	// The older LokiRule is allocated its quota first, so it may grow and
+	// push the newer one out of the quota.
+	grownOlder := newQuotaTestRule("default", "older", 4)
+	grownOlder.CreationTimestamp = older.CreationTimestamp
+	if _, err := validator.ValidateUpdate(context.TODO(), older, grownOlder); err != nil {
+		t.Errorf("The older LokiRule should be accepted: %v", err)
+	}
+}
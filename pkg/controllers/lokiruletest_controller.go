@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// LokiRuleTestReconciler runs the tests of LokiRuleTests against the LokiRule
+// they reference, whenever either of them changes.
+type LokiRuleTestReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	Logger logger.Logger
+}
+
+// testsForLokiRule enqueues the LokiRuleTests referencing the LokiRule.
+func (r *LokiRuleTestReconciler) testsForLokiRule(ctx context.Context, obj client.Object) []reconcile.Request {
+	tests := &querocomv1alpha1.LokiRuleTestList{}
+	if err := r.List(ctx, tests, client.InNamespace(obj.GetNamespace())); err != nil {
+		r.Logger.Error(err, "Failed to list LokiRuleTests", "namespace", obj.GetNamespace())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, test := range tests.Items {
+		if test.Spec.LokiRuleName == obj.GetName() {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: test.Namespace, Name: test.Name},
+			})
+		}
+	}
+
+	return requests
+}
+
+func (r *LokiRuleTestReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&querocomv1alpha1.LokiRuleTest{}).
+		Watches(&querocomv1alpha1.LokiRule{}, handler.EnqueueRequestsFromMapFunc(r.testsForLokiRule)).
+		Complete(r)
+}
+
+func (r *LokiRuleTestReconciler) setResult(
+	ctx context.Context,
+	test *querocomv1alpha1.LokiRuleTest,
+	specHash string,
+	failures []string,
+	condition metav1.Condition,
+) error {
+	previous := test.Status.DeepCopy()
+
+	condition.Type = querocomv1alpha1.ConditionPassed
+	condition.ObservedGeneration = test.Generation
+	meta.SetStatusCondition(&test.Status.Conditions, condition)
+	test.Status.Failures = failures
+	test.Status.TestedSpecHash = specHash
+
+	if equality.Semantic.DeepEqual(previous, &test.Status) {
+		return nil
+	}
+
+	return r.Status().Update(ctx, test)
+}
+
+// Reconcile evaluates the rules of the referenced LokiRule against the input
+// streams of the LokiRuleTest and reports the result in its status.
+func (r *LokiRuleTestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	r.Logger.Info("Reconciling LokiRuleTest", "namespace", req.NamespacedName)
+
+	test := &querocomv1alpha1.LokiRuleTest{}
+	err := r.Get(ctx, req.NamespacedName, test)
+	if err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+
+	rule := &querocomv1alpha1.LokiRule{}
+	err = r.Get(ctx, types.NamespacedName{Namespace: test.Namespace, Name: test.Spec.LokiRuleName}, rule)
+	if apierrors.IsNotFound(err) {
+		return reconcile.Result{}, r.setResult(ctx, test, "", nil, metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  querocomv1alpha1.ReasonLokiRuleNotFound,
+			Message: fmt.Sprintf("LokiRule %q not found", test.Spec.LokiRuleName),
+		})
+	}
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	specHash, err := lokirule.SpecHash(rule)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	ruleTest, err := lokirule.ToRuleTest(test)
+	if err != nil {
+		return reconcile.Result{}, r.setResult(ctx, test, specHash, nil, metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  querocomv1alpha1.ReasonInvalidTest,
+			Message: err.Error(),
+		})
+	}
+
+	ruleGroups, err := lokirule.ToRuleGroups(rule, lokirule.Options{})
+	if err != nil {
+		return reconcile.Result{}, r.setResult(ctx, test, specHash, nil, metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  querocomv1alpha1.ReasonInvalidRule,
+			Message: err.Error(),
+		})
+	}
+
+	failures := lokirule.Failures(ruleTest.Run(ruleGroups))
+	if len(failures) > 0 {
+		r.Logger.Info("LokiRuleTest failed", "namespace", req.NamespacedName, "failures", len(failures))
+
+		return reconcile.Result{}, r.setResult(ctx, test, specHash, failures, metav1.Condition{
+			Status:  metav1.ConditionFalse,
+			Reason:  querocomv1alpha1.ReasonTestsFailed,
+			Message: fmt.Sprintf("%d tests failed: %s", len(failures), strings.SplitN(failures[0], "\n", 2)[0]),
+		})
+	}
+
+	r.Logger.Info("LokiRuleTest passed", "namespace", req.NamespacedName)
+
+	return reconcile.Result{}, r.setResult(ctx, test, specHash, nil, metav1.Condition{
+		Status:  metav1.ConditionTrue,
+		Reason:  querocomv1alpha1.ReasonTestsPassed,
+		Message: fmt.Sprintf("%d tests passed", len(test.Spec.AlertRuleTests)+len(test.Spec.RecordingRuleTests)),
+	})
+}
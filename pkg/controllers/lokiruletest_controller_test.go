@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newRuleTestReconciler(t *testing.T, objects ...client.Object) *LokiRuleTestReconciler {
+	cli := newFakeClientBuilder(t, objects...).
+		WithStatusSubresource(&querocomv1alpha1.LokiRuleTest{}).
+		Build()
+
+	return &LokiRuleTestReconciler{Client: cli, Scheme: cli.Scheme(), Logger: logger.NewNopLogger()}
+}
+
+func newRuleTestFixture(expectedCount string) (*querocomv1alpha1.LokiRule, *querocomv1alpha1.LokiRuleTest) {
+	rule := newLokiRule("default", "errors")
+
+	test := &querocomv1alpha1.LokiRuleTest{
+		ObjectMeta: metav1.ObjectMeta{Name: "errors-test", Namespace: "default"},
+		Spec: querocomv1alpha1.LokiRuleTestSpec{
+			LokiRuleName: "errors",
+			InputStreams: []querocomv1alpha1.InputStream{{
+				Labels:  map[string]string{"app": "api"},
+				Entries: []querocomv1alpha1.InputEntry{{At: "10s", Line: "error", Repeat: 2, Interval: "10s"}},
+			}},
+			RecordingRuleTests: []querocomv1alpha1.RecordingRuleTest{{
+				EvalTime:   "1m",
+				Record:     "app:errors:count1m",
+				ExpSamples: []querocomv1alpha1.ExpectedSample{{Labels: map[string]string{"app": "api"}, Value: expectedCount}},
+			}},
+		},
+	}
+
+	return rule, test
+}
+
+func reconcileRuleTest(t *testing.T, r *LokiRuleTestReconciler) *querocomv1alpha1.LokiRuleTest {
+	key := types.NamespacedName{Namespace: "default", Name: "errors-test"}
+
+	_, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	test := &querocomv1alpha1.LokiRuleTest{}
+	if err := r.Get(context.TODO(), key, test); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	return test
+}
+
+func TestLokiRuleTestReconcilerPassed(t *testing.T) {
+	rule, test := newRuleTestFixture("3")
+	r := newRuleTestReconciler(t, rule, test)
+
+	result := reconcileRuleTest(t, r)
+
+	if !meta.IsStatusConditionTrue(result.Status.Conditions, querocomv1alpha1.ConditionPassed) {
+		t.Errorf("The tests should pass, got: %v", result.Status)
+	}
+
+	if result.Status.TestedSpecHash == "" {
+		t.Errorf("The tested spec hash should be set")
+	}
+}
+
+func TestLokiRuleTestReconcilerFailed(t *testing.T) {
+	rule, test := newRuleTestFixture("4")
+	r := newRuleTestReconciler(t, rule, test)
+
+	result := reconcileRuleTest(t, r)
+
+	condition := meta.FindStatusCondition(result.Status.Conditions, querocomv1alpha1.ConditionPassed)
+	if condition == nil || condition.Reason != querocomv1alpha1.ReasonTestsFailed {
+		t.Errorf("The tests should fail, got: %v", result.Status)
+	}
+
+	if len(result.Status.Failures) != 1 {
+		t.Errorf("Expected 1 failure, got: %v", result.Status.Failures)
+	}
+}
+
+func TestLokiRuleTestReconcilerLokiRuleNotFound(t *testing.T) {
+	_, test := newRuleTestFixture("3")
+	r := newRuleTestReconciler(t, test)
+
+	result := reconcileRuleTest(t, r)
+
+	condition := meta.FindStatusCondition(result.Status.Conditions, querocomv1alpha1.ConditionPassed)
+	if condition == nil || condition.Reason != querocomv1alpha1.ReasonLokiRuleNotFound {
+		t.Errorf("The LokiRule should not be found, got: %v", result.Status)
+	}
+}
+
+func TestLokiRuleTestReconcilerEnqueuesTestsOfLokiRule(t *testing.T) {
+	rule, test := newRuleTestFixture("3")
+	r := newRuleTestReconciler(t, rule, test)
+
+	requests := r.testsForLokiRule(context.TODO(), rule)
+	if len(requests) != 1 || requests[0].Name != test.Name {
+		t.Errorf("Expected the LokiRuleTest to be enqueued, got: %v", requests)
+	}
+}
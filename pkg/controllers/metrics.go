@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// DriftResourceConfigMap counts the rule files found changed or removed
+	// from the rules ConfigMap
+	DriftResourceConfigMap = "configmap"
+	// DriftResourceStatefulSet counts the Loki StatefulSets found without the
+	// rules volume or its mount
+	DriftResourceStatefulSet = "statefulset"
+)
+
+// driftRepairedTotal counts the changes made outside of the operator to the
+// objects it manages, and that it reverted.
+var driftRepairedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "loki_rule_operator_drift_repaired_total",
+	Help: "Number of changes made outside of the operator to the rules ConfigMap or the Loki StatefulSet " +
+		"that the operator reverted, by resource.",
+}, []string{"resource"})
+
+func init() {
+	metrics.Registry.MustRegister(driftRepairedTotal)
+}
@@ -0,0 +1,264 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	"github.com/quero-edu/loki-rule-operator/pkg/k8sutils"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RuleFileMigrator renames the rule files of the rules ConfigMap to the rule
+// file name template once the operator starts, e.g. the "<namespace>-<name>.yaml"
+// files written by previous versions, in a single ConfigMap write. When the
+// rules ConfigMap itself was renamed, the rule files of the previous one are
+// moved to it first.
+type RuleFileMigrator struct {
+	client.Client
+	Logger                logger.Logger
+	LokiNamespace         string
+	LokiRuleConfigMapName string
+	// PreviousLokiRuleConfigMapName is the rules ConfigMap the rule files are
+	// moved from, none when empty
+	PreviousLokiRuleConfigMapName string
+	// ConfigMapLabels are set on the rules ConfigMap when moving the rule
+	// files creates it, on top of the labels identifying it
+	ConfigMapLabels   map[string]string
+	LokiLabelSelector *metav1.LabelSelector
+	LokiRulesPath     string
+	// UpdateLoki mounts the rules ConfigMap in Loki in place of the previous
+	// one, which is then deleted
+	UpdateLoki  bool
+	RuleOptions lokirule.Options
+	// DryRun logs the rule files that would be renamed instead of renaming them
+	DryRun bool
+	// Done is closed once Start is done migrating, whether it succeeded or not
+	Done chan struct{}
+}
+
+func (m *RuleFileMigrator) SetupWithManager(mgr ctrl.Manager) error {
+	return mgr.Add(m)
+}
+
+// NeedLeaderElection makes only the leader rename rule files.
+func (m *RuleFileMigrator) NeedLeaderElection() bool {
+	return true
+}
+
+// Start runs Migrate once, then closes Done. A failed migration is only
+// logged, the reconcile of every LokiRule replaces its rule file anyway.
+func (m *RuleFileMigrator) Start(ctx context.Context) error {
+	if m.Done != nil {
+		defer close(m.Done)
+	}
+
+	if err := m.Migrate(ctx); err != nil {
+		m.Logger.Error(err, "Failed to migrate rule files")
+	}
+	return nil
+}
+
+// Migrate moves the rule files of the previous rules ConfigMap, if any, and
+// renames the rule files owned by the existing LokiRules to their rule file
+// name.
+func (m *RuleFileMigrator) Migrate(ctx context.Context) error {
+	if err := m.moveRuleFiles(ctx); err != nil {
+		return fmt.Errorf("failed to move the rule files of ConfigMap %s: %w", m.PreviousLokiRuleConfigMapName, err)
+	}
+
+	err := m.Get(ctx, types.NamespacedName{Namespace: m.LokiNamespace, Name: m.LokiRuleConfigMapName}, &corev1.ConfigMap{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	rules := &querocomv1alpha1.LokiRuleList{}
+	if err := m.List(ctx, rules); err != nil {
+		return err
+	}
+
+	var renamed map[string]string
+	_, _, err = updateRuleFiles(
+		ctx,
+		m.Client,
+		m.LokiNamespace,
+		m.LokiRuleConfigMapName,
+		m.RuleOptions,
+		func(configMap *corev1.ConfigMap, appliedRules map[string]AppliedRule) error {
+			renamed, err = renameRuleFiles(configMap, appliedRules, rules.Items, m.RuleOptions)
+			return err
+		},
+		k8sutils.Options{Ctx: ctx, Logger: m.Logger, DryRun: m.DryRun},
+	)
+	if err != nil {
+		return err
+	}
+
+	for from, to := range renamed {
+		m.Logger.Info("Renamed rule file", "from", from, "to", to)
+	}
+
+	return nil
+}
+
+// moveRuleFiles copies the rule files of the previous rules ConfigMap missing
+// from the rules ConfigMap, with their applied rules entries, so the files
+// written since the rename win. The previous rules ConfigMap is only deleted
+// once Loki no longer mounts it, so Loki never loses its rules, along with its
+// applied rules ConfigMap.
+func (m *RuleFileMigrator) moveRuleFiles(ctx context.Context) error {
+	if m.PreviousLokiRuleConfigMapName == "" || m.PreviousLokiRuleConfigMapName == m.LokiRuleConfigMapName {
+		return nil
+	}
+
+	options := k8sutils.Options{Ctx: ctx, Logger: m.Logger, DryRun: m.DryRun}
+
+	previous := &corev1.ConfigMap{}
+	err := m.Get(ctx, types.NamespacedName{Namespace: m.LokiNamespace, Name: m.PreviousLokiRuleConfigMapName}, previous)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	previousRules, err := GetAppliedRules(ctx, m.Client, previous, m.RuleOptions)
+	if err != nil {
+		return err
+	}
+
+	_, err = k8sutils.CreateConfigMap(
+		m.Client,
+		m.LokiNamespace,
+		m.LokiRuleConfigMapName,
+		rulesConfigMapLabels(m.ConfigMapLabels),
+		options,
+	)
+	if err != nil {
+		return err
+	}
+
+	var moved []string
+	configMap, _, err := updateRuleFiles(
+		ctx,
+		m.Client,
+		m.LokiNamespace,
+		m.LokiRuleConfigMapName,
+		m.RuleOptions,
+		func(configMap *corev1.ConfigMap, appliedRules map[string]AppliedRule) error {
+			moved = nil
+			for fileName, content := range previous.Data {
+				if _, ok := configMap.Data[fileName]; ok {
+					continue
+				}
+				if configMap.Data == nil {
+					configMap.Data = map[string]string{}
+				}
+				configMap.Data[fileName] = content
+				if appliedRule, ok := previousRules[fileName]; ok {
+					appliedRules[fileName] = appliedRule
+				}
+				moved = append(moved, fileName)
+			}
+
+			return nil
+		},
+		options,
+	)
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(moved)
+	m.Logger.Info(
+		"Moved rule files to the rules ConfigMap",
+		"from", m.PreviousLokiRuleConfigMapName,
+		"to", m.LokiRuleConfigMapName,
+		"files", moved,
+	)
+
+	if !m.UpdateLoki {
+		m.Logger.Warn(
+			"Mount the rules ConfigMap in Loki, then delete the previous one",
+			"previous", m.PreviousLokiRuleConfigMapName,
+			"name", m.LokiRuleConfigMapName,
+		)
+		return nil
+	}
+
+	lokiStatefulSet, err := getLokiStatefulSet(ctx, m.Client, m.LokiLabelSelector, m.LokiNamespace, m.Logger)
+	if err != nil {
+		return err
+	}
+
+	// The volume of the previous rules ConfigMap is removed first, as the
+	// volume of the rules ConfigMap is mounted at the same path. Applying the
+	// rules ConfigMap volume would only remove it when the operator applied
+	// it, not when an operator version predating server-side apply updated it.
+	err = k8sutils.UnmountConfigMap(m.Client, m.PreviousLokiRuleConfigMapName, lokiStatefulSet, options)
+	if err != nil {
+		return err
+	}
+
+	err = k8sutils.MountConfigMap(
+		m.Client,
+		configMap,
+		m.LokiRulesPath,
+		lokiStatefulSet,
+		options,
+	)
+	if err != nil {
+		return err
+	}
+
+	if configMapMounted(m.PreviousLokiRuleConfigMapName, lokiStatefulSet) {
+		m.Logger.Warn(
+			"The previous rules ConfigMap is still mounted in Loki, not deleting it",
+			"previous", m.PreviousLokiRuleConfigMapName,
+			"statefulSet", lokiStatefulSet.Name,
+		)
+		return nil
+	}
+
+	if m.DryRun {
+		m.Logger.Info("Dry run, previous rules ConfigMap not deleted", "previous", m.PreviousLokiRuleConfigMapName)
+		return nil
+	}
+
+	if err := m.Delete(ctx, previous); client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	previousAppliedRules := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Namespace: m.LokiNamespace,
+		Name:      lokirule.AppliedRulesConfigMapName(m.PreviousLokiRuleConfigMapName),
+	}}
+	if err := m.Delete(ctx, previousAppliedRules); client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	m.Logger.Info("Deleted the previous rules ConfigMap", "previous", m.PreviousLokiRuleConfigMapName)
+
+	return nil
+}
+
+// configMapMounted returns whether a volume of the StatefulSet is the
+// ConfigMap.
+func configMapMounted(configMapName string, statefulSet *appsv1.StatefulSet) bool {
+	for _, volume := range statefulSet.Spec.Template.Spec.Volumes {
+		if volume.ConfigMap != nil && volume.ConfigMap.Name == configMapName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,346 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestRuleFileMigrator(t *testing.T) {
+	rules := []*querocomv1alpha1.LokiRule{
+		newLokiRule("default", "errors"),
+		newLokiRule("default", "latency"),
+	}
+
+	// Written before the applied rules annotation existed.
+	rulesConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "loki-rule-cfg", Namespace: "loki"},
+		Data: map[string]string{
+			"default-errors.yaml":  "errors",
+			"default-latency.yaml": "latency",
+			"default_latency.yaml": "foreign",
+			"manual.yaml":          "manual",
+		},
+	}
+
+	cli := newFakeClientBuilder(t, rules[0], rules[1], rulesConfigMap).Build()
+
+	m := &RuleFileMigrator{
+		Client:                cli,
+		Logger:                logger.NewNopLogger(),
+		LokiNamespace:         "loki",
+		LokiRuleConfigMapName: "loki-rule-cfg",
+		RuleOptions:           lokirule.Options{FileNameTemplate: lokirule.UniqueFileNameTemplate},
+	}
+
+	if err := m.Migrate(context.TODO()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	configMap := &corev1.ConfigMap{}
+	if err := cli.Get(context.TODO(), types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}, configMap); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expected := map[string]string{
+		"default_errors.yaml": "errors",
+		// The new name is taken by a file the operator does not own.
+		"default-latency.yaml": "latency",
+		"default_latency.yaml": "foreign",
+		"manual.yaml":          "manual",
+	}
+	if len(configMap.Data) != len(expected) {
+		t.Fatalf("Expected %v, got: %v", expected, configMap.Data)
+	}
+	for key, value := range expected {
+		if configMap.Data[key] != value {
+			t.Errorf("Expected %s to be %q, got: %v", key, value, configMap.Data)
+		}
+	}
+
+	appliedRules, err := GetAppliedRules(context.TODO(), cli, configMap, lokirule.Options{})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if appliedRules["default_errors.yaml"] != (AppliedRule{Namespace: "default", Name: "errors"}) {
+		t.Errorf("Expected default_errors.yaml to be owned by default/errors, got: %v", appliedRules)
+	}
+	if _, ok := appliedRules["default-errors.yaml"]; ok {
+		t.Errorf("Expected default-errors.yaml not to be recorded anymore, got: %v", appliedRules)
+	}
+	if len(appliedRules) != 2 {
+		t.Errorf("Expected only the rule files of the LokiRules to be recorded, got: %v", appliedRules)
+	}
+}
+
+func TestRuleFileMigratorMovesRuleFiles(t *testing.T) {
+	tests := map[string]struct {
+		updateLoki      bool
+		previousDeleted bool
+	}{
+		"without updating Loki": {},
+		"updating Loki":         {updateLoki: true, previousDeleted: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rule := newLokiRule("default", "errors")
+
+			previous := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "loki-rule-cfg", Namespace: "loki"},
+				Data: map[string]string{
+					"default-errors.yaml": "errors",
+					"manual.yaml":         "manual",
+				},
+			}
+			previousAppliedRules := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "loki-rule-cfg-applied-rules", Namespace: "loki"},
+				Data: map[string]string{
+					"default-errors.yaml": `{"namespace":"default","name":"errors","generation":1}`,
+				},
+			}
+
+			// Written by the operator since the rename.
+			rulesConfigMap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "loki-rules", Namespace: "loki"},
+				Data:       map[string]string{"manual.yaml": "manual v2"},
+			}
+
+			lokiStatefulSet := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "loki", Namespace: "loki", Labels: map[string]string{"app": "loki"}},
+				Spec: appsv1.StatefulSetSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "loki"}}},
+					},
+				},
+			}
+
+			var mounted string
+			cli := newFakeClientBuilder(t, rule, previous, previousAppliedRules, rulesConfigMap, lokiStatefulSet).
+				WithInterceptorFuncs(interceptor.Funcs{
+					Patch: func(
+						ctx context.Context,
+						c client.WithWatch,
+						obj client.Object,
+						patch client.Patch,
+						opts ...client.PatchOption,
+					) error {
+						if obj.GetObjectKind().GroupVersionKind().Kind == "StatefulSet" {
+							mounted = obj.GetName()
+							return nil
+						}
+						return applyConfigMap(ctx, c, obj, patch, opts...)
+					},
+				}).
+				Build()
+
+			m := &RuleFileMigrator{
+				Client:                        cli,
+				Logger:                        logger.NewNopLogger(),
+				LokiNamespace:                 "loki",
+				LokiRuleConfigMapName:         "loki-rules",
+				PreviousLokiRuleConfigMapName: "loki-rule-cfg",
+				LokiLabelSelector:             &metav1.LabelSelector{MatchLabels: map[string]string{"app": "loki"}},
+				LokiRulesPath:                 "/etc/loki/rules",
+				UpdateLoki:                    tt.updateLoki,
+			}
+
+			if err := m.Migrate(context.TODO()); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+
+			configMap := &corev1.ConfigMap{}
+			if err := cli.Get(context.TODO(), types.NamespacedName{Namespace: "loki", Name: "loki-rules"}, configMap); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+
+			// The rule file is renamed to the default rule file name template.
+			expected := map[string]string{"default_errors.yaml": "errors", "manual.yaml": "manual v2"}
+			if !reflect.DeepEqual(configMap.Data, expected) {
+				t.Errorf("Expected %v, got: %v", expected, configMap.Data)
+			}
+
+			appliedRules, err := GetAppliedRules(context.TODO(), cli, configMap, lokirule.Options{})
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if appliedRules["default_errors.yaml"].Name != "errors" || len(appliedRules) != 1 {
+				t.Errorf("Expected only default_errors.yaml to be recorded, got: %v", appliedRules)
+			}
+
+			if tt.updateLoki && mounted != "loki" {
+				t.Errorf("Expected the rules ConfigMap to be mounted in Loki")
+			}
+
+			for _, previousName := range []string{"loki-rule-cfg", "loki-rule-cfg-applied-rules"} {
+				err = cli.Get(context.TODO(), types.NamespacedName{Namespace: "loki", Name: previousName}, &corev1.ConfigMap{})
+				if deleted := apierrors.IsNotFound(err); deleted != tt.previousDeleted {
+					t.Errorf("Expected %s to be deleted: %t, got: %v", previousName, tt.previousDeleted, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRuleFileMigratorUnmountsUpdatedVolume(t *testing.T) {
+	previous := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "loki-rule-cfg", Namespace: "loki"},
+		Data:       map[string]string{"default-errors.yaml": "errors"},
+	}
+
+	// Mounted by an operator version predating server-side apply, so the
+	// volume, mount and checksum annotation are owned by its Update.
+	lokiStatefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "loki",
+			Namespace: "loki",
+			Labels:    map[string]string{"app": "loki"},
+			ManagedFields: []metav1.ManagedFieldsEntry{{
+				Manager:    "manager",
+				Operation:  metav1.ManagedFieldsOperationUpdate,
+				APIVersion: "apps/v1",
+			}},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"checksum/config-loki-rule-cfg": "outdated",
+						"team":                          "observability",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{
+						{Name: "data"},
+						{
+							Name: "loki-rule-cfg-volume",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: "loki-rule-cfg"},
+								},
+							},
+						},
+					},
+					Containers: []corev1.Container{{
+						Name: "loki",
+						VolumeMounts: []corev1.VolumeMount{
+							{Name: "loki-rule-cfg-volume", MountPath: "/etc/loki/rules"},
+							{Name: "data", MountPath: "/data"},
+						},
+					}},
+				},
+			},
+		},
+	}
+
+	var applied bool
+	cli := newFakeClientBuilder(t, newLokiRule("default", "errors"), previous, lokiStatefulSet).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(
+				ctx context.Context,
+				c client.WithWatch,
+				obj client.Object,
+				patch client.Patch,
+				opts ...client.PatchOption,
+			) error {
+				// The fake client does not support server-side applies of
+				// StatefulSets, the JSON patch unmounting the previous rules
+				// ConfigMap is let through.
+				if patch.Type() == types.ApplyPatchType && obj.GetObjectKind().GroupVersionKind().Kind == "StatefulSet" {
+					applied = true
+					return nil
+				}
+				return applyConfigMap(ctx, c, obj, patch, opts...)
+			},
+		}).
+		Build()
+
+	m := &RuleFileMigrator{
+		Client:                        cli,
+		Logger:                        logger.NewNopLogger(),
+		LokiNamespace:                 "loki",
+		LokiRuleConfigMapName:         "loki-rules",
+		PreviousLokiRuleConfigMapName: "loki-rule-cfg",
+		LokiLabelSelector:             &metav1.LabelSelector{MatchLabels: map[string]string{"app": "loki"}},
+		LokiRulesPath:                 "/etc/loki/rules",
+		UpdateLoki:                    true,
+	}
+
+	if err := m.Migrate(context.TODO()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !applied {
+		t.Errorf("Expected the rules ConfigMap to be mounted in Loki")
+	}
+
+	updated := &appsv1.StatefulSet{}
+	if err := cli.Get(context.TODO(), client.ObjectKeyFromObject(lokiStatefulSet), updated); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	podSpec := updated.Spec.Template.Spec
+	if len(podSpec.Volumes) != 1 || podSpec.Volumes[0].Name != "data" {
+		t.Errorf("Expected only the volume of the previous rules ConfigMap to be removed, got: %v", podSpec.Volumes)
+	}
+	mounts := podSpec.Containers[0].VolumeMounts
+	if len(mounts) != 1 || mounts[0].Name != "data" {
+		t.Errorf("Expected only the mount of the previous rules ConfigMap to be removed, got: %v", mounts)
+	}
+	expectedAnnotations := map[string]string{"team": "observability"}
+	if !reflect.DeepEqual(updated.Spec.Template.Annotations, expectedAnnotations) {
+		t.Errorf("Expected %v, got: %v", expectedAnnotations, updated.Spec.Template.Annotations)
+	}
+
+	err := cli.Get(context.TODO(), client.ObjectKeyFromObject(previous), &corev1.ConfigMap{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("Expected the previous rules ConfigMap to be deleted once unmounted, got: %v", err)
+	}
+}
+
+func TestReconcileWaitsForMigration(t *testing.T) {
+	r := newFakeReconciler(t, newLokiRule("default", "errors"))
+
+	m := &RuleFileMigrator{
+		Client:                r.Client,
+		Logger:                logger.NewNopLogger(),
+		LokiNamespace:         "loki",
+		LokiRuleConfigMapName: "loki-rule-cfg",
+		Done:                  make(chan struct{}),
+	}
+	r.MigrationDone = m.Done
+
+	key := types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the reconcile to wait for the migration, got: %v", err)
+	}
+	if err := r.Get(context.TODO(), key, &corev1.ConfigMap{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("Expected the rules ConfigMap not to be written before the migration, got: %v", err)
+	}
+
+	if err := m.Start(context.TODO()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if _, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := r.Get(context.TODO(), key, &corev1.ConfigMap{}); err != nil {
+		t.Errorf("Expected the rules ConfigMap to be written after the migration, got: %v", err)
+	}
+}
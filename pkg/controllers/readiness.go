@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quero-edu/loki-rule-operator/pkg/k8sutils"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+const (
+	// DependencyChecksPath is where the metrics server serves the checks of
+	// the dependencies of the operator, each one also on its own path, e.g.
+	// /checks/loki, like the readiness checks under /readyz
+	DependencyChecksPath = "/checks"
+
+	// lokiCheckCacheTTL is how long the result of the Loki check is reused, so
+	// frequent requests do not load Loki
+	lokiCheckCacheTTL = 10 * time.Second
+	// rulesConfigMapCheckCacheTTL is how long the result of the rules
+	// ConfigMap readiness check is reused, so probes do not each send a write
+	// to the API server
+	rulesConfigMapCheckCacheTTL = time.Minute
+)
+
+// cachedCheck runs a check at most once per ttl and key, concurrent callers
+// waiting for the check in progress.
+type cachedCheck struct {
+	mu        sync.Mutex
+	key       string
+	checkedAt time.Time
+	err       error
+}
+
+func (c *cachedCheck) do(key string, ttl time.Duration, check func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.key == key && !c.checkedAt.IsZero() && time.Since(c.checkedAt) < ttl {
+		return c.err
+	}
+
+	c.key, c.err, c.checkedAt = key, check(), time.Now()
+	return c.err
+}
+
+// GetLokiReady returns an error unless the /ready endpoint of Loki answers 200.
+func GetLokiReady(ctx context.Context, client *http.Client, lokiURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, LokiRequestTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, lokiURL+"/ready", nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("loki is not ready, status %d: %s", response.StatusCode, body)
+	}
+
+	return nil
+}
+
+// DependencyChecks returns the checks of Loki and of its StatefulSet by name,
+// served under DependencyChecksPath and registered as readiness checks unless
+// disabled: the LokiRule webhook fails closed, so an unready operator rejects
+// every LokiRule write while Loki is down.
+func (r *LokiRuleReconciler) DependencyChecks() map[string]healthz.Checker {
+	return map[string]healthz.Checker{
+		"loki":     r.LokiCheck,
+		"workload": r.WorkloadCheck,
+	}
+}
+
+// LokiCheck passes once Loki is ready to validate LogQL expressions. It always
+// passes without a Loki URL.
+func (r *LokiRuleReconciler) LokiCheck(req *http.Request) error {
+	r.settingsMu.RLock()
+	lokiClient, lokiURL := r.LokiClient, r.LokiURL
+	r.settingsMu.RUnlock()
+
+	if lokiURL == "" {
+		return nil
+	}
+	if lokiClient == nil {
+		lokiClient = http.DefaultClient
+	}
+
+	return r.lokiReady.do(lokiURL, lokiCheckCacheTTL, func() error {
+		return GetLokiReady(req.Context(), lokiClient, lokiURL)
+	})
+}
+
+// WorkloadCheck passes when exactly one StatefulSet matches the Loki label
+// selector. It always passes when the operator does not update Loki.
+func (r *LokiRuleReconciler) WorkloadCheck(req *http.Request) error {
+	if !r.UpdateLoki {
+		return nil
+	}
+
+	_, err := getLokiStatefulSet(req.Context(), r.Client, r.LokiLabelSelector, r.LokiNamespace, r.Logger)
+	if err != nil {
+		return fmt.Errorf("loki StatefulSet selector %q: %w", metav1.FormatLabelSelector(r.LokiLabelSelector), err)
+	}
+
+	return nil
+}
+
+// RulesConfigMapReadyCheck is the readiness check of the rules ConfigMap,
+// passing when the operator may write it, which a dry run checks without
+// changing it. The result is reused for a minute.
+func (r *LokiRuleReconciler) RulesConfigMapReadyCheck(req *http.Request) error {
+	key := types.NamespacedName{Namespace: r.LokiNamespace, Name: r.LokiRuleConfigMapName}
+
+	return r.rulesConfigMapReady.do(key.String(), rulesConfigMapCheckCacheTTL, func() error {
+		return r.checkRulesConfigMapWritable(req.Context(), key)
+	})
+}
+
+func (r *LokiRuleReconciler) checkRulesConfigMapWritable(ctx context.Context, key types.NamespacedName) error {
+	ctx, cancel := context.WithTimeout(ctx, k8sutils.DefaultTimeout)
+	defer cancel()
+
+	configMap := &corev1.ConfigMap{}
+	err := r.Get(ctx, key, configMap)
+	switch {
+	case apierrors.IsNotFound(err):
+		configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}}
+		err = r.Create(ctx, configMap, client.DryRunAll)
+	case err == nil:
+		err = r.Update(ctx, configMap, client.DryRunAll)
+	}
+
+	// A conflict only means the ConfigMap changed since it was read.
+	if err != nil && !apierrors.IsConflict(err) {
+		return fmt.Errorf("rules ConfigMap %s is not writable: %w", key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func newReadinessReconciler(cli client.Client) *LokiRuleReconciler {
+	r := newTestReconciler(cli)
+	r.LokiLabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "loki"}}
+	r.UpdateLoki = true
+	return r
+}
+
+func TestCachedLokiCheck(t *testing.T) {
+	requests := 0
+	newLoki := func(status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.URL.Path != "/ready" {
+				t.Errorf("Expected a request to /ready, got: %s", r.URL.Path)
+			}
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte("Ingester not ready"))
+		}))
+	}
+	unready := newLoki(http.StatusServiceUnavailable)
+	defer unready.Close()
+	ready := newLoki(http.StatusOK)
+	defer ready.Close()
+
+	r := newReadinessReconciler(newFakeClientBuilder(t).Build())
+
+	req := httptest.NewRequest(http.MethodGet, "/checks/loki", nil)
+	if err := r.LokiCheck(req); err != nil {
+		t.Fatalf("Expected the check to pass without a Loki URL, got: %v", err)
+	}
+
+	r.LokiURL = unready.URL
+
+	err := r.LokiCheck(req)
+	if err == nil || !strings.Contains(err.Error(), "Ingester not ready") {
+		t.Fatalf("Expected Loki not to be ready, got: %v", err)
+	}
+
+	// The result is reused until it expires.
+	if err := r.LokiCheck(req); err == nil || requests != 1 {
+		t.Errorf("Expected the cached result, got: %v after %d requests", err, requests)
+	}
+
+	// A changed Loki URL is checked right away.
+	r.LokiURL = ready.URL
+	if err := r.LokiCheck(req); err != nil || requests != 2 {
+		t.Errorf("Expected Loki to be ready, got: %v after %d requests", err, requests)
+	}
+}
+
+func TestWorkloadCheck(t *testing.T) {
+	lokiStatefulSet := func(name string) *appsv1.StatefulSet {
+		return &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "loki",
+			Labels:    map[string]string{"app": "loki"},
+		}}
+	}
+
+	tests := map[string]struct {
+		objects    []client.Object
+		updateLoki bool
+		err        string
+	}{
+		"one StatefulSet":   {objects: []client.Object{lokiStatefulSet("loki")}, updateLoki: true},
+		"no StatefulSet":    {updateLoki: true, err: "no statefulSets found"},
+		"not updating Loki": {},
+		"too many StatefulSets": {
+			objects:    []client.Object{lokiStatefulSet("loki"), lokiStatefulSet("loki-canary")},
+			updateLoki: true,
+			err:        "more than one statefulSet found",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := newReadinessReconciler(newFakeClientBuilder(t, tt.objects...).Build())
+			r.UpdateLoki = tt.updateLoki
+
+			err := r.WorkloadCheck(httptest.NewRequest(http.MethodGet, "/checks/workload", nil))
+			if tt.err == "" && err != nil {
+				t.Errorf("Expected the check to pass, got: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("Expected %q, got: %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestRulesConfigMapReadyCheck(t *testing.T) {
+	rulesConfigMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "loki-rule-cfg", Namespace: "loki"}}
+	forbidden := apierrors.NewForbidden(corev1.Resource("configmaps"), "loki-rule-cfg", nil)
+
+	tests := map[string]struct {
+		objects   []client.Object
+		forbidden bool
+	}{
+		"existing ConfigMap":             {objects: []client.Object{rulesConfigMap}},
+		"missing ConfigMap":              {},
+		"existing ConfigMap not allowed": {objects: []client.Object{rulesConfigMap}, forbidden: true},
+		"missing ConfigMap not allowed":  {forbidden: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			writes := 0
+			builder := newFakeClientBuilder(t, tt.objects...).WithInterceptorFuncs(interceptor.Funcs{
+				Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+					writes++
+					if tt.forbidden {
+						return forbidden
+					}
+					return c.Create(ctx, obj, opts...)
+				},
+				Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+					writes++
+					if tt.forbidden {
+						return forbidden
+					}
+					return c.Update(ctx, obj, opts...)
+				},
+			})
+			r := newReadinessReconciler(builder.Build())
+
+			// The result of the first check is reused by the second one.
+			for i := 0; i < 2; i++ {
+				err := r.RulesConfigMapReadyCheck(httptest.NewRequest(http.MethodGet, "/readyz/rules-configmap", nil))
+				if tt.forbidden != (err != nil) {
+					t.Errorf("Expected the check to fail: %t, got: %v", tt.forbidden, err)
+				}
+			}
+			if writes != 1 {
+				t.Errorf("Expected a single dry run, got: %d", writes)
+			}
+
+			// The dry run leaves the ConfigMap untouched.
+			configMaps := &corev1.ConfigMapList{}
+			if err := r.List(context.TODO(), configMaps); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if len(configMaps.Items) != len(tt.objects) {
+				t.Errorf("Expected no ConfigMap to be created, got: %v", configMaps.Items)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/features"
+	"github.com/quero-edu/loki-rule-operator/pkg/k8sutils"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestReconcileConvergesAllLokiRules(t *testing.T) {
+	errorsRule := newLokiRule("default", "errors")
+	latencyRule := errorsRule.DeepCopy()
+	latencyRule.Namespace = "team-a"
+	invalidRule := errorsRule.DeepCopy()
+	invalidRule.Name = "invalid"
+	invalidRule.Spec.Groups[0].Rules[0] = querocomv1alpha1.Rule{
+		Alert:       "HighErrorRate",
+		Expr:        `sum(rate({app="api"} |= "error" [1m])) > 10`,
+		Annotations: map[string]string{"summary": "{{ $labels.app"},
+	}
+
+	rulesConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "loki-rule-cfg",
+			Namespace: "loki",
+			Annotations: map[string]string{lokirule.AppliedRulesAnnotation: `{` +
+				`"default_deleted.yaml":{"namespace":"default","name":"deleted","generation":1},` +
+				`"default_invalid.yaml":{"namespace":"default","name":"invalid","generation":1}}`},
+		},
+		Data: map[string]string{
+			"default_deleted.yaml": unmanagedRuleFile,
+			"default_invalid.yaml": unmanagedRuleFile,
+			"manual.yaml":          unmanagedRuleFile,
+		},
+	}
+
+	r := newFakeReconciler(t, errorsRule, latencyRule, invalidRule, rulesConfigMap)
+	r.QuarantinePolicy = features.QuarantinePolicyOmit
+
+	getConfigMap := func() *corev1.ConfigMap {
+		configMap := &corev1.ConfigMap{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}, configMap); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return configMap
+	}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}}
+	if _, err := r.Reconcile(context.TODO(), req); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	configMap := getConfigMap()
+	for _, fileName := range []string{"default_errors.yaml", "team-a_errors.yaml", "manual.yaml"} {
+		if _, ok := configMap.Data[fileName]; !ok {
+			t.Errorf("Expected %s in the rules ConfigMap, got: %v", fileName, configMap.Data)
+		}
+	}
+	for _, fileName := range []string{"default_deleted.yaml", "default_invalid.yaml"} {
+		if _, ok := configMap.Data[fileName]; ok {
+			t.Errorf("Expected %s to be removed, got: %v", fileName, configMap.Data)
+		}
+	}
+
+	for _, rule := range []*querocomv1alpha1.LokiRule{errorsRule, latencyRule} {
+		updated := &querocomv1alpha1.LokiRule{}
+		if err := r.Get(context.TODO(), types.NamespacedName{Namespace: rule.Namespace, Name: rule.Name}, updated); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !meta.IsStatusConditionTrue(updated.Status.Conditions, querocomv1alpha1.ConditionAccepted) {
+			t.Errorf("Expected %s/%s to be accepted, got: %+v", rule.Namespace, rule.Name, updated.Status.Conditions)
+		}
+	}
+
+	updated := &querocomv1alpha1.LokiRule{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "invalid"}, updated); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !meta.IsStatusConditionTrue(updated.Status.Conditions, querocomv1alpha1.ConditionQuarantined) {
+		t.Errorf("Expected default/invalid to be quarantined, got: %+v", updated.Status.Conditions)
+	}
+
+	// The applied rules are moved from the legacy annotation to the applied
+	// rules ConfigMap.
+	if _, ok := configMap.Annotations[lokirule.AppliedRulesAnnotation]; ok {
+		t.Errorf("Expected the applied rules annotation to be removed, got: %v", configMap.Annotations)
+	}
+	appliedRulesConfigMap := &corev1.ConfigMap{}
+	appliedRulesKey := types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg-applied-rules"}
+	if err := r.Get(context.TODO(), appliedRulesKey, appliedRulesConfigMap); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expectedFileNames := []string{"default_errors.yaml", "team-a_errors.yaml"}
+	if len(appliedRulesConfigMap.Data) != len(expectedFileNames) {
+		t.Errorf("Expected the applied rules of %v, got: %v", expectedFileNames, appliedRulesConfigMap.Data)
+	}
+	for _, fileName := range expectedFileNames {
+		if _, ok := appliedRulesConfigMap.Data[fileName]; !ok {
+			t.Errorf("Expected the applied rule of %s, got: %v", fileName, appliedRulesConfigMap.Data)
+		}
+	}
+
+	// Reconciling again changes nothing.
+	if _, err := r.Reconcile(context.TODO(), req); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	again := getConfigMap()
+	if !reflect.DeepEqual(again.Data, configMap.Data) {
+		t.Errorf("Expected the rules ConfigMap not to change, got: %v", again.Data)
+	}
+	appliedRulesAgain := &corev1.ConfigMap{}
+	if err := r.Get(context.TODO(), appliedRulesKey, appliedRulesAgain); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(appliedRulesAgain.Data, appliedRulesConfigMap.Data) {
+		t.Errorf("Expected the applied rules ConfigMap not to change, got: %v", appliedRulesAgain.Data)
+	}
+}
+
+func TestReconcileWithoutLokiRules(t *testing.T) {
+	r := newFakeReconciler(t)
+	r.UpdateLoki = true
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}}
+	if _, err := r.Reconcile(context.TODO(), req); err != nil {
+		t.Fatalf("Expected nothing to reconcile, got: %v", err)
+	}
+
+	configMaps := &corev1.ConfigMapList{}
+	if err := r.List(context.TODO(), configMaps); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(configMaps.Items) != 0 {
+		t.Errorf("Expected no rules ConfigMap to be created, got: %v", configMaps.Items)
+	}
+}
+
+func TestReconcileDeletedLokiRules(t *testing.T) {
+	rule := newLokiRule("default", "errors")
+
+	// default/deleted was deleted before the operator saw it.
+	rulesConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "loki-rule-cfg",
+			Namespace: "loki",
+			Annotations: map[string]string{
+				lokirule.AppliedRulesAnnotation: `{"default_deleted.yaml":{"namespace":"default","name":"deleted"}}`,
+			},
+		},
+		Data: map[string]string{"default_deleted.yaml": unmanagedRuleFile},
+	}
+
+	// default/errors is deleted once listed, before its status is updated.
+	cli := newFakeClientBuilder(t, rule, rulesConfigMap).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Patch: applyConfigMap,
+			SubResourceUpdate: func(
+				ctx context.Context,
+				c client.Client,
+				subResourceName string,
+				obj client.Object,
+				opts ...client.SubResourceUpdateOption,
+			) error {
+				return apierrors.NewNotFound(querocomv1alpha1.GroupVersion.WithResource("lokirules").GroupResource(),
+					obj.GetName())
+			},
+		}).
+		Build()
+
+	r := newTestReconciler(cli)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}}
+	if _, err := r.Reconcile(context.TODO(), req); err != nil {
+		t.Fatalf("Expected deleted LokiRules not to fail the reconcile, got: %v", err)
+	}
+
+	configMap := &corev1.ConfigMap{}
+	if err := cli.Get(context.TODO(), req.NamespacedName, configMap); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, ok := configMap.Data["default_deleted.yaml"]; ok {
+		t.Errorf("Expected the rule file of the deleted LokiRule to be removed, got: %v", configMap.Data)
+	}
+}
+
+func TestReconcileAllocatesNamespaceQuotaByCreation(t *testing.T) {
+	created := metav1.Now()
+	var rules []client.Object
+	for i, name := range []string{"c-oldest", "b-older", "a-newest"} {
+		rule := newLokiRule("default", name)
+		rule.CreationTimestamp = metav1.NewTime(created.Add(time.Duration(i) * time.Minute))
+		rules = append(rules, rule)
+	}
+
+	r := newFakeReconciler(t, rules...)
+	r.Quotas = lokirule.Quotas{PerNamespace: lokirule.Quota{MaxRules: 2}}
+
+	// The quota is allocated the same way on every reconcile pass, whatever
+	// the LokiRules were reported on the previous one.
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}}
+	for pass := 0; pass < 3; pass++ {
+		if _, err := r.Reconcile(context.TODO(), req); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		for _, rule := range rules {
+			updated := &querocomv1alpha1.LokiRule{}
+			if err := r.Get(context.TODO(), client.ObjectKeyFromObject(rule), updated); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+
+			reason := querocomv1alpha1.ReasonAccepted
+			if rule.GetName() == "a-newest" {
+				reason = querocomv1alpha1.ReasonQuotaExceeded
+			}
+			accepted := meta.FindStatusCondition(updated.Status.Conditions, querocomv1alpha1.ConditionAccepted)
+			if accepted == nil || accepted.Reason != reason {
+				t.Errorf("Expected %s to be reported %s on pass %d, got: %+v", rule.GetName(), reason, pass, accepted)
+			}
+		}
+	}
+
+	configMap := &corev1.ConfigMap{}
+	if err := r.Get(context.TODO(), req.NamespacedName, configMap); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, ok := configMap.Data["default_a-newest.yaml"]; ok || len(configMap.Data) != 2 {
+		t.Errorf("Expected the rule files of the two oldest LokiRules, got: %v", configMap.Data)
+	}
+}
+
+func TestReconcileReturnsWriteErrors(t *testing.T) {
+	rule := newLokiRule("default", "errors")
+	lokiStatefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "loki", Namespace: "loki", Labels: map[string]string{"app": "loki"}},
+	}
+
+	var patched []string
+	cli := newFakeClientBuilder(t, rule, lokiStatefulSet).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(
+				ctx context.Context,
+				c client.WithWatch,
+				obj client.Object,
+				patch client.Patch,
+				opts ...client.PatchOption,
+			) error {
+				patched = append(patched, obj.GetObjectKind().GroupVersionKind().Kind)
+				return errors.New("patch failed")
+			},
+		}).
+		Build()
+
+	r := newTestReconciler(cli)
+	r.LokiLabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "loki"}}
+	r.UpdateLoki = true
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}}
+	if _, err := r.Reconcile(context.TODO(), req); err == nil || !strings.Contains(err.Error(), "patch failed") {
+		t.Fatalf("Expected the rules ConfigMap write to fail the reconcile, got: %v", err)
+	}
+
+	for _, kind := range patched {
+		if kind == "StatefulSet" {
+			t.Errorf("Expected the Loki StatefulSet not to be patched, got patches of: %v", patched)
+		}
+	}
+
+	updated := &querocomv1alpha1.LokiRule{}
+	if err := cli.Get(context.TODO(), client.ObjectKeyFromObject(rule), updated); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(updated.Status.Conditions) != 0 {
+		t.Errorf("Expected the LokiRule not to be reported as written, got: %+v", updated.Status.Conditions)
+	}
+
+	appliedRulesKey := types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg-applied-rules"}
+	if err := cli.Get(context.TODO(), appliedRulesKey, &corev1.ConfigMap{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected no applied rules to be recorded for the failed write, got: %v", err)
+	}
+}
+
+func TestSetConfigMapMetadata(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "loki-rule-cfg",
+			Namespace:   "loki",
+			Labels:      map[string]string{"team": "a", "other": "x"},
+			Annotations: map[string]string{"owner": "me", lokirule.AppliedRulesAnnotation: "{}", "note": "y"},
+			ManagedFields: []metav1.ManagedFieldsEntry{{
+				Manager:    k8sutils.FieldManager,
+				Operation:  metav1.ManagedFieldsOperationApply,
+				APIVersion: "v1",
+				FieldsType: "FieldsV1",
+				FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:labels":{"f:team":{}},` +
+					`"f:annotations":{"f:owner":{},"f:loki-rule-operator.quero.com/applied-rules":{}}}}`)},
+			}},
+		},
+	}
+
+	err := setConfigMapMetadata(configMap, rulesConfigMapLabels(map[string]string{"env": "prod"}), map[string]string{
+		"contact": "ops",
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expectedLabels := map[string]string{
+		"app.kubernetes.io/component":  "loki-rule-cfg",
+		"app.kubernetes.io/managed-by": "loki-rule-operator",
+		"env":                          "prod",
+		"other":                        "x",
+	}
+	if !reflect.DeepEqual(configMap.Labels, expectedLabels) {
+		t.Errorf("Expected labels %v, got: %v", expectedLabels, configMap.Labels)
+	}
+
+	expectedAnnotations := map[string]string{"note": "y", "contact": "ops"}
+	if !reflect.DeepEqual(configMap.Annotations, expectedAnnotations) {
+		t.Errorf("Expected annotations %v, got: %v", expectedAnnotations, configMap.Annotations)
+	}
+}
@@ -0,0 +1,310 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/flowcontrol"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// DefaultRuleHealthInterval is how often the rule health is read from the Loki ruler
+	DefaultRuleHealthInterval = time.Minute
+	// DefaultRuleHealthRateLimit is the number of LokiRule status updates per second
+	DefaultRuleHealthRateLimit = 10
+
+	// ruleHealthRefreshPolls is after how many polls the last evaluation of a
+	// rule whose state did not change is refreshed in its status
+	ruleHealthRefreshPolls = 10
+)
+
+// RuleHealthPoller periodically reads the health of the rules and the active
+// alerts from the Loki ruler and writes them to the status of the LokiRules
+// they are rendered from.
+type RuleHealthPoller struct {
+	client.Client
+	Logger                logger.Logger
+	LokiClient            *http.Client
+	LokiURL               string
+	LokiNamespace         string
+	LokiRuleConfigMapName string
+	// RuleOptions are the options the LokiRules are rendered with
+	RuleOptions lokirule.Options
+	// Interval is how often the Loki ruler is polled, it is not polled when 0
+	Interval time.Duration
+	// RateLimit is the number of LokiRule status updates per second, 0 is no limit
+	RateLimit int
+	// DryRun logs the LokiRule statuses that would be updated instead of updating them
+	DryRun bool
+
+	// settingsMu guards the settings ApplySettings replaces and the limiter
+	// built from RateLimit
+	settingsMu sync.RWMutex
+	limiter    flowcontrol.RateLimiter
+	// settingsChanged wakes Start up when ApplySettings changes the interval
+	settingsChanged chan struct{}
+}
+
+func (p *RuleHealthPoller) SetupWithManager(mgr ctrl.Manager) error {
+	return mgr.Add(p)
+}
+
+// NeedLeaderElection makes only the leader poll the Loki ruler.
+func (p *RuleHealthPoller) NeedLeaderElection() bool {
+	return true
+}
+
+// Start runs Poll every Interval until ctx is done. Nothing is polled while
+// Interval is 0, until ApplySettings sets one.
+func (p *RuleHealthPoller) Start(ctx context.Context) error {
+	p.settingsMu.Lock()
+	if p.settingsChanged == nil {
+		p.settingsChanged = make(chan struct{}, 1)
+	}
+	settingsChanged := p.settingsChanged
+	p.settingsMu.Unlock()
+
+	for {
+		p.settingsMu.RLock()
+		interval := p.Interval
+		p.settingsMu.RUnlock()
+
+		var tick <-chan time.Time
+		if interval > 0 {
+			if err := p.Poll(ctx); err != nil {
+				p.Logger.Error(err, "Failed to poll the rule health")
+			}
+			tick = time.After(interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick:
+		case <-settingsChanged:
+		}
+	}
+}
+
+// Poll writes the health of the rules and their active alerts, as listed by
+// the Loki ruler, to the status of every LokiRule. Statuses are only updated
+// when the health, error or alerts of a rule change, or to refresh a last
+// evaluation ruleHealthRefreshPolls intervals old, so the LokiRules are not
+// patched on every evaluation. Nothing is polled without a Loki URL.
+func (p *RuleHealthPoller) Poll(ctx context.Context) error {
+	p.settingsMu.Lock()
+	lokiClient, lokiURL, interval, ruleOptions := p.LokiClient, p.LokiURL, p.Interval, p.RuleOptions
+	if p.limiter == nil && p.RateLimit > 0 {
+		p.limiter = flowcontrol.NewTokenBucketRateLimiter(float32(p.RateLimit), 1)
+	}
+	limiter := p.limiter
+	p.settingsMu.Unlock()
+
+	if lokiURL == "" {
+		return nil
+	}
+
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: p.LokiNamespace, Name: p.LokiRuleConfigMapName}}
+	err := p.Get(ctx, client.ObjectKeyFromObject(configMap), configMap)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	appliedRules, err := GetAppliedRules(ctx, p.Client, configMap, ruleOptions)
+	if err != nil {
+		return err
+	}
+
+	fileNames := map[types.NamespacedName][]string{}
+	for fileName, appliedRule := range appliedRules {
+		key := types.NamespacedName{Namespace: appliedRule.Namespace, Name: appliedRule.Name}
+		fileNames[key] = append(fileNames[key], fileName)
+	}
+
+	groups, err := GetRulerRuleStates(ctx, lokiClient, lokiURL)
+	if err != nil {
+		return err
+	}
+
+	alerts, err := GetRulerAlerts(ctx, lokiClient, lokiURL)
+	if err != nil {
+		return err
+	}
+
+	rules := &querocomv1alpha1.LokiRuleList{}
+	if err := p.List(ctx, rules); err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := range rules.Items {
+		rule := &rules.Items[i]
+		if !rule.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		statuses := ruleStatuses(rule, fileNames[client.ObjectKeyFromObject(rule)], groups, alerts)
+		if !ruleStatusesChanged(rule.Status.Rules, statuses, ruleHealthRefreshPolls*interval) {
+			continue
+		}
+
+		if p.DryRun {
+			p.Logger.Info("Dry run, LokiRule rule health not updated", "namespace", rule.Namespace, "name", rule.Name)
+			continue
+		}
+
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return errors.Join(append(errs, err)...)
+			}
+		}
+
+		patch := client.MergeFrom(rule.DeepCopy())
+		rule.Status.Rules = statuses
+		err := p.Status().Patch(ctx, rule, patch)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			p.Logger.Error(err, "Failed to update LokiRule status", "namespace", rule.Namespace, "name", rule.Name)
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ruleStatusesChanged returns whether statuses should replace current: when
+// the rules, their health, error or alerts changed, or when a last evaluation
+// moved refreshAfter or more past the one in current.
+func ruleStatusesChanged(current, statuses []querocomv1alpha1.RuleStatus, refreshAfter time.Duration) bool {
+	if len(current) != len(statuses) {
+		return true
+	}
+
+	for i := range statuses {
+		previous, status := current[i], statuses[i]
+		if previous.LastEvaluation == nil || status.LastEvaluation == nil {
+			if previous.LastEvaluation != status.LastEvaluation {
+				return true
+			}
+		} else if status.LastEvaluation.Sub(previous.LastEvaluation.Time) >= refreshAfter {
+			return true
+		}
+
+		previous.LastEvaluation, status.LastEvaluation = nil, nil
+		if !equality.Semantic.DeepEqual(previous, status) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ruleStatuses returns the state of every rule of the LokiRule, from the rule
+// groups the Loki ruler evaluates out of its rule files and the active alerts.
+// A rule the ruler does not list at the same position in its group has an
+// unknown health. It returns nil when the LokiRule has no rule file.
+func ruleStatuses(
+	rule *querocomv1alpha1.LokiRule,
+	fileNames []string,
+	groups []RulerRuleGroup,
+	alerts []RulerAlert,
+) []querocomv1alpha1.RuleStatus {
+	if len(fileNames) == 0 {
+		return nil
+	}
+
+	files := map[string]bool{}
+	for _, fileName := range fileNames {
+		files[fileName] = true
+	}
+
+	loadedGroups := map[string]RulerRuleGroup{}
+	for _, group := range groups {
+		if files[group.File] {
+			loadedGroups[group.Name] = group
+		}
+	}
+
+	var statuses []querocomv1alpha1.RuleStatus
+	for _, group := range rule.Spec.Groups {
+		loadedGroup := loadedGroups[group.Name]
+
+		for i, r := range group.Rules {
+			status := querocomv1alpha1.RuleStatus{
+				Group:  group.Name,
+				Name:   r.Alert + r.Record,
+				Health: querocomv1alpha1.RuleHealthUnknown,
+			}
+
+			if i < len(loadedGroup.Rules) && loadedGroup.Rules[i].Name == status.Name {
+				setRuleStatus(&status, loadedGroup.Rules[i], alerts)
+			}
+
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+func setRuleStatus(status *querocomv1alpha1.RuleStatus, loaded RulerRule, alerts []RulerAlert) {
+	switch loaded.Health {
+	case querocomv1alpha1.RuleHealthOK, querocomv1alpha1.RuleHealthErr:
+		status.Health = loaded.Health
+	}
+	status.LastError = loaded.LastError
+
+	// The status only keeps seconds, so an unchanged evaluation time is not
+	// mistaken for a new one.
+	if !loaded.LastEvaluation.IsZero() {
+		lastEvaluation := metav1.NewTime(loaded.LastEvaluation).Rfc3339Copy()
+		status.LastEvaluation = &lastEvaluation
+	}
+
+	if loaded.Type != "alerting" {
+		return
+	}
+
+	for _, alert := range alerts {
+		if alert.Labels["alertname"] != loaded.Name || !hasLabels(alert.Labels, loaded.Labels) {
+			continue
+		}
+
+		switch alert.State {
+		case "pending":
+			status.PendingAlerts++
+		case "firing":
+			status.FiringAlerts++
+		}
+	}
+}
+
+// hasLabels returns whether labels holds all of the expected labels, which is
+// how the alerts of an alerting rule are told apart from the alerts of other
+// rules with the same name. Templated labels are expanded by the ruler, so
+// they match any value.
+func hasLabels(labels, expected map[string]string) bool {
+	for name, value := range expected {
+		if !strings.Contains(value, "{{") && labels[name] != value {
+			return false
+		}
+	}
+
+	return true
+}
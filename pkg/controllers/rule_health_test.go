@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/internal/logger"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+const rulerRulesResponse = `{"status":"success","data":{"groups":[{"name":"errors","file":"default_errors.yaml","rules":[
+{"name":"app:errors:count1m","type":"recording","health":"ok","lastError":"",
+ "lastEvaluation":"2024-05-01T10:00:00.123456789Z"},
+{"name":"HighErrors","type":"alerting","labels":{"severity":"page"},"health":"err",
+ "lastError":"query timed out","lastEvaluation":"2024-05-01T10:00:01.5Z"}
+]}]}}`
+
+const rulerAlertsResponse = `{"status":"success","data":{"alerts":[
+{"labels":{"alertname":"HighErrors","severity":"page","app":"api"},"state":"firing"},
+{"labels":{"alertname":"HighErrors","severity":"page","app":"web"},"state":"firing"},
+{"labels":{"alertname":"HighErrors","severity":"page","app":"db"},"state":"pending"},
+{"labels":{"alertname":"HighErrors","severity":"ticket","app":"api"},"state":"firing"}
+]}}`
+
+func TestPollRuleHealth(t *testing.T) {
+	rule := newLokiRule("default", "errors")
+	rule.Spec.Groups[0].Rules = append(rule.Spec.Groups[0].Rules,
+		querocomv1alpha1.Rule{Alert: "HighErrors", Expr: `sum(count_over_time({app="api"} |= "error" [1m])) > 10`},
+		querocomv1alpha1.Rule{Alert: "NoLogs", Expr: `absent_over_time({app="api"}[5m])`},
+	)
+	unwritten := &querocomv1alpha1.LokiRule{ObjectMeta: metav1.ObjectMeta{Name: "unwritten", Namespace: "default"}}
+
+	rulesConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "loki-rule-cfg",
+			Namespace: "loki",
+			Annotations: map[string]string{
+				lokirule.AppliedRulesAnnotation: `{"default_errors.yaml":{"namespace":"default","name":"errors","generation":1}}`,
+			},
+		},
+		Data: map[string]string{"default_errors.yaml": unmanagedRuleFile},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/prometheus/api/v1/rules":
+			_, _ = w.Write([]byte(rulerRulesResponse))
+		case "/prometheus/api/v1/alerts":
+			_, _ = w.Write([]byte(rulerAlertsResponse))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	patches := 0
+	cli := newFakeClientBuilder(t, rule, unwritten, rulesConfigMap).
+		WithInterceptorFuncs(interceptor.Funcs{
+			SubResourcePatch: func(
+				ctx context.Context,
+				c client.Client,
+				subResourceName string,
+				obj client.Object,
+				patch client.Patch,
+				opts ...client.SubResourcePatchOption,
+			) error {
+				patches++
+				return c.SubResource(subResourceName).Patch(ctx, obj, patch, opts...)
+			},
+		}).
+		Build()
+
+	p := &RuleHealthPoller{
+		Client:                cli,
+		Logger:                logger.NewNopLogger(),
+		LokiClient:            server.Client(),
+		LokiURL:               server.URL,
+		LokiNamespace:         "loki",
+		LokiRuleConfigMapName: "loki-rule-cfg",
+		Interval:              DefaultRuleHealthInterval,
+		RateLimit:             DefaultRuleHealthRateLimit,
+	}
+
+	// The second poll finds the statuses unchanged.
+	for i := 0; i < 2; i++ {
+		if err := p.Poll(context.TODO()); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if patches != 1 {
+		t.Errorf("Expected the LokiRule status to be updated once, got: %d updates", patches)
+	}
+
+	updated := &querocomv1alpha1.LokiRule{}
+	if err := cli.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "errors"}, updated); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	recordEvaluation := metav1.NewTime(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	alertEvaluation := metav1.NewTime(time.Date(2024, 5, 1, 10, 0, 1, 0, time.UTC))
+	expected := []querocomv1alpha1.RuleStatus{
+		{Group: "errors", Name: "app:errors:count1m", Health: "ok", LastEvaluation: &recordEvaluation},
+		{
+			Group:          "errors",
+			Name:           "HighErrors",
+			Health:         "err",
+			LastError:      "query timed out",
+			LastEvaluation: &alertEvaluation,
+			PendingAlerts:  1,
+			FiringAlerts:   2,
+		},
+		{Group: "errors", Name: "NoLogs", Health: "unknown"},
+	}
+	if len(updated.Status.Rules) != len(expected) {
+		t.Fatalf("Expected %+v, got: %+v", expected, updated.Status.Rules)
+	}
+	for i := range expected {
+		got := updated.Status.Rules[i]
+		if got.LastEvaluation != nil && expected[i].LastEvaluation != nil && got.LastEvaluation.Equal(expected[i].LastEvaluation) {
+			got.LastEvaluation = expected[i].LastEvaluation
+		}
+		if !reflect.DeepEqual(got, expected[i]) {
+			t.Errorf("Expected %+v, got: %+v", expected[i], got)
+		}
+	}
+
+	if err := cli.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "unwritten"}, unwritten); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if unwritten.Status.Rules != nil {
+		t.Errorf("Expected no rule health without a rule file, got: %+v", unwritten.Status.Rules)
+	}
+}
+
+func TestRuleStatusesChanged(t *testing.T) {
+	evaluatedAt := func(minute int) *metav1.Time {
+		t := metav1.NewTime(time.Date(2024, 5, 1, 10, minute, 0, 0, time.UTC))
+		return &t
+	}
+	current := []querocomv1alpha1.RuleStatus{
+		{Group: "errors", Name: "HighErrors", Health: "ok", LastEvaluation: evaluatedAt(0), FiringAlerts: 1},
+	}
+
+	tests := map[string]struct {
+		status  querocomv1alpha1.RuleStatus
+		changed bool
+	}{
+		"evaluated again": {
+			status: querocomv1alpha1.RuleStatus{
+				Group: "errors", Name: "HighErrors", Health: "ok", LastEvaluation: evaluatedAt(1), FiringAlerts: 1,
+			},
+		},
+		"evaluation to refresh": {
+			status: querocomv1alpha1.RuleStatus{
+				Group: "errors", Name: "HighErrors", Health: "ok", LastEvaluation: evaluatedAt(10), FiringAlerts: 1,
+			},
+			changed: true,
+		},
+		"health changed": {
+			status: querocomv1alpha1.RuleStatus{
+				Group: "errors", Name: "HighErrors", Health: "err", LastEvaluation: evaluatedAt(1), FiringAlerts: 1,
+			},
+			changed: true,
+		},
+		"alerts changed": {
+			status: querocomv1alpha1.RuleStatus{
+				Group: "errors", Name: "HighErrors", Health: "ok", LastEvaluation: evaluatedAt(1),
+			},
+			changed: true,
+		},
+		"no longer evaluated": {
+			status:  querocomv1alpha1.RuleStatus{Group: "errors", Name: "HighErrors", Health: "unknown"},
+			changed: true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			statuses := []querocomv1alpha1.RuleStatus{tt.status}
+			if changed := ruleStatusesChanged(current, statuses, 10*time.Minute); changed != tt.changed {
+				t.Errorf("Expected changed to be %t, got: %t", tt.changed, changed)
+			}
+		})
+	}
+}
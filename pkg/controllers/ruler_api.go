@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	"gopkg.in/yaml.v2"
+)
+
+// GetRulerRuleGroups lists the rule groups loaded by the Loki ruler, keyed by
+// rule namespace, which is the rule file name for the local storage.
+func GetRulerRuleGroups(
+	ctx context.Context,
+	client *http.Client,
+	lokiURL string,
+) (map[string][]lokirule.RuleGroup, error) {
+	ctx, cancel := context.WithTimeout(ctx, LokiRequestTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, lokiURL+"/loki/api/v1/rules", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ruler answers 404 when no rule group is loaded.
+	if response.StatusCode == http.StatusNotFound {
+		return map[string][]lokirule.RuleGroup{}, nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d listing ruler rules: %s", response.StatusCode, body)
+	}
+
+	ruleGroups := map[string][]lokirule.RuleGroup{}
+	if err := yaml.Unmarshal(body, &ruleGroups); err != nil {
+		return nil, fmt.Errorf("invalid ruler rules: %w", err)
+	}
+
+	return ruleGroups, nil
+}
+
+// RulerRuleGroup is a rule group evaluated by the Loki ruler, as listed by its
+// Prometheus compatible API.
+type RulerRuleGroup struct {
+	Name string `json:"name"`
+	// File is the rule namespace of the group, the rule file name for the
+	// local storage
+	File  string      `json:"file"`
+	Rules []RulerRule `json:"rules"`
+}
+
+// RulerRule is the evaluation state of a rule of a RulerRuleGroup.
+type RulerRule struct {
+	// Name is the alert or record name of the rule
+	Name string `json:"name"`
+	// Type is alerting or recording
+	Type      string            `json:"type"`
+	Labels    map[string]string `json:"labels"`
+	Health    string            `json:"health"`
+	LastError string            `json:"lastError"`
+	// LastEvaluation is zero when the rule was not evaluated yet
+	LastEvaluation time.Time `json:"lastEvaluation"`
+}
+
+// RulerAlert is an active alert of the Loki ruler.
+type RulerAlert struct {
+	Labels map[string]string `json:"labels"`
+	// State is pending or firing
+	State string `json:"state"`
+}
+
+// GetRulerRuleStates lists the rule groups evaluated by the Loki ruler with
+// the health of their rules.
+func GetRulerRuleStates(ctx context.Context, client *http.Client, lokiURL string) ([]RulerRuleGroup, error) {
+	data := struct {
+		Groups []RulerRuleGroup `json:"groups"`
+	}{}
+	if err := getPrometheusAPI(ctx, client, lokiURL+"/prometheus/api/v1/rules", &data); err != nil {
+		return nil, err
+	}
+
+	return data.Groups, nil
+}
+
+// GetRulerAlerts lists the pending and firing alerts of the Loki ruler.
+func GetRulerAlerts(ctx context.Context, client *http.Client, lokiURL string) ([]RulerAlert, error) {
+	data := struct {
+		Alerts []RulerAlert `json:"alerts"`
+	}{}
+	if err := getPrometheusAPI(ctx, client, lokiURL+"/prometheus/api/v1/alerts", &data); err != nil {
+		return nil, err
+	}
+
+	return data.Alerts, nil
+}
+
+// getPrometheusAPI decodes the data of a response of the Prometheus compatible
+// API of the Loki ruler into data, left empty when the ruler answers 404.
+func getPrometheusAPI(ctx context.Context, client *http.Client, endpoint string, data interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, LokiRequestTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	// The ruler answers 404 when no rule group is loaded.
+	if response.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s: %s", response.StatusCode, request.URL.Path, body)
+	}
+
+	envelope := struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+		Error  string          `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", request.URL.Path, err)
+	}
+	if envelope.Status != "success" {
+		return fmt.Errorf("%s failed: %s", request.URL.Path, envelope.Error)
+	}
+
+	if err := json.Unmarshal(envelope.Data, data); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", request.URL.Path, err)
+	}
+
+	return nil
+}
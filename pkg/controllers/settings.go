@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// RuleSettings are the settings of the LokiRule reconciliation and validation
+// that can change while the operator runs, e.g. when its config file is
+// reloaded.
+type RuleSettings struct {
+	LokiClient           *http.Client
+	LokiURL              string
+	RuleOptions          lokirule.Options
+	Quotas               lokirule.Quotas
+	QuarantinePolicy     string
+	LoadedTimeout        time.Duration
+	ConfigMapLabels      map[string]string
+	ConfigMapAnnotations map[string]string
+	// RuleHealthInterval and RuleHealthRateLimit are the interval and rate
+	// limit of the RuleHealthPoller
+	RuleHealthInterval  time.Duration
+	RuleHealthRateLimit int
+}
+
+// ApplySettings replaces the settings of the reconciler once the reconcile in
+// progress, if any, is done, and reconciles the LokiRules with them.
+func (r *LokiRuleReconciler) ApplySettings(settings RuleSettings) {
+	r.settingsMu.Lock()
+	r.LokiClient = settings.LokiClient
+	r.LokiURL = settings.LokiURL
+	r.RuleOptions = settings.RuleOptions
+	r.Quotas = settings.Quotas
+	r.QuarantinePolicy = settings.QuarantinePolicy
+	r.LoadedTimeout = settings.LoadedTimeout
+	r.ConfigMapLabels = settings.ConfigMapLabels
+	r.ConfigMapAnnotations = settings.ConfigMapAnnotations
+	r.settingsMu.Unlock()
+
+	r.Resync()
+}
+
+// Resync triggers a reconcile of all the LokiRules. A resync requested while
+// another one is pending is merged into it.
+func (r *LokiRuleReconciler) Resync() {
+	if r.resync == nil {
+		return
+	}
+
+	select {
+	case r.resync <- event.GenericEvent{Object: &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: r.LokiNamespace, Name: r.LokiRuleConfigMapName},
+	}}:
+	default:
+	}
+}
+
+// ApplySettings replaces the quotas and rule options LokiRules are validated
+// with.
+func (v *LokiRuleValidator) ApplySettings(settings RuleSettings) {
+	v.settingsMu.Lock()
+	defer v.settingsMu.Unlock()
+
+	v.Quotas = settings.Quotas
+	v.RuleOptions = settings.RuleOptions
+}
+
+// ApplySettings replaces the Loki URL and client the Loki ruler is read with,
+// and the rule options.
+func (a *RuleAdopter) ApplySettings(settings RuleSettings) {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+
+	a.LokiClient = settings.LokiClient
+	a.LokiURL = settings.LokiURL
+	a.RuleOptions = settings.RuleOptions
+}
+
+// ApplySettings replaces the Loki URL and client the Loki ruler is read with,
+// the rule options, and the interval and rate limit it is polled with. A
+// changed interval is applied right away, starting a new poll.
+func (p *RuleHealthPoller) ApplySettings(settings RuleSettings) {
+	p.settingsMu.Lock()
+	defer p.settingsMu.Unlock()
+
+	p.LokiClient = settings.LokiClient
+	p.LokiURL = settings.LokiURL
+	p.RuleOptions = settings.RuleOptions
+	if p.RateLimit != settings.RuleHealthRateLimit {
+		p.RateLimit = settings.RuleHealthRateLimit
+		p.limiter = nil
+	}
+	if p.Interval != settings.RuleHealthInterval {
+		p.Interval = settings.RuleHealthInterval
+		select {
+		case p.settingsChanged <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quero-edu/loki-rule-operator/pkg/features"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestApplySettings(t *testing.T) {
+	r := &LokiRuleReconciler{
+		LokiNamespace:         "loki",
+		LokiRuleConfigMapName: "loki-rule-cfg",
+		QuarantinePolicy:      features.QuarantinePolicyKeep,
+		resync:                make(chan event.GenericEvent, 1),
+	}
+
+	settings := RuleSettings{
+		LokiURL:          "http://loki:3100",
+		RuleOptions:      lokirule.Options{NameLabel: "lokirule_name"},
+		Quotas:           lokirule.Quotas{PerObject: lokirule.Quota{MaxRules: 10}},
+		QuarantinePolicy: features.QuarantinePolicyOmit,
+	}
+	r.ApplySettings(settings)
+	// A resync requested while another one is pending is merged into it.
+	r.ApplySettings(settings)
+
+	if r.LokiURL != settings.LokiURL || r.RuleOptions.NameLabel != "lokirule_name" ||
+		r.Quotas != settings.Quotas || r.QuarantinePolicy != features.QuarantinePolicyOmit {
+		t.Errorf("Expected the settings to be applied, got: %+v", r)
+	}
+
+	if len(r.resync) != 1 {
+		t.Fatalf("Expected a single resync, got: %d", len(r.resync))
+	}
+	e := <-r.resync
+	if e.Object.GetNamespace() != "loki" || e.Object.GetName() != "loki-rule-cfg" {
+		t.Errorf("Expected a resync of the rules ConfigMap, got: %s/%s", e.Object.GetNamespace(), e.Object.GetName())
+	}
+}
+
+func TestApplySettingsToRulerReaders(t *testing.T) {
+	a := &RuleAdopter{}
+	p := &RuleHealthPoller{}
+
+	// Without a Loki URL, the poller reads neither Loki nor the API server.
+	if err := p.Poll(context.TODO()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	settings := RuleSettings{
+		LokiClient:          &http.Client{},
+		LokiURL:             "http://loki:3100",
+		RuleHealthInterval:  time.Minute,
+		RuleHealthRateLimit: 5,
+	}
+	a.ApplySettings(settings)
+	p.ApplySettings(settings)
+
+	if a.LokiURL != settings.LokiURL || a.LokiClient != settings.LokiClient {
+		t.Errorf("Expected the settings to be applied to the adopter, got: %+v", a)
+	}
+	if p.LokiURL != settings.LokiURL || p.LokiClient != settings.LokiClient || p.Interval != time.Minute ||
+		p.RateLimit != 5 {
+		t.Errorf("Expected the settings to be applied to the poller, got: %+v", p)
+	}
+}
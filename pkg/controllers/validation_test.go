@@ -0,0 +1,214 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"github.com/quero-edu/loki-rule-operator/pkg/lokirule"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestReconcileValidatesLogQL(t *testing.T) {
+	tests := map[string]struct {
+		status      int
+		body        string
+		unreachable bool
+		// unwritten starts without a rule file of the LokiRule
+		unwritten    bool
+		requeueAfter time.Duration
+		condition    string
+		reason       string
+		message      string
+		written      bool
+		// revalidated sends the spec to Loki again on the next reconcile
+		revalidated bool
+	}{
+		"valid expressions": {
+			status:    http.StatusOK,
+			condition: querocomv1alpha1.ConditionAccepted,
+			reason:    querocomv1alpha1.ReasonAccepted,
+			written:   true,
+		},
+		"expression rejected by Loki": {
+			status:    http.StatusBadRequest,
+			body:      logQLParseError + " at line 1, col 1: syntax error",
+			condition: querocomv1alpha1.ConditionQuarantined,
+			reason:    querocomv1alpha1.ReasonInvalidRule,
+			message:   "Keeping the last known-good rule file",
+		},
+		"expression rejected by Loki before the first write": {
+			status:    http.StatusBadRequest,
+			body:      logQLParseError + " at line 1, col 1: syntax error",
+			unwritten: true,
+			condition: querocomv1alpha1.ConditionQuarantined,
+			reason:    querocomv1alpha1.ReasonInvalidRule,
+			message:   "Rule file not written",
+		},
+		"Loki failing": {
+			status:       http.StatusServiceUnavailable,
+			body:         "Ingester not ready",
+			requeueAfter: validationRequeueInterval,
+			condition:    querocomv1alpha1.ConditionAccepted,
+			reason:       querocomv1alpha1.ReasonLokiUnavailable,
+			message:      "failed to validate the LogQL expressions with Loki: unexpected status 503",
+			revalidated:  true,
+		},
+		"Loki unreachable": {
+			unreachable:  true,
+			requeueAfter: validationRequeueInterval,
+			condition:    querocomv1alpha1.ConditionAccepted,
+			reason:       querocomv1alpha1.ReasonLokiUnavailable,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			if tt.unreachable {
+				server.Close()
+			}
+
+			rule := newLokiRule("default", "errors")
+			rule.Generation = 2
+			rule.Status.Conditions = []metav1.Condition{{
+				Type:               querocomv1alpha1.ConditionLoaded,
+				Status:             metav1.ConditionTrue,
+				ObservedGeneration: 1,
+				Reason:             querocomv1alpha1.ReasonRulesLoaded,
+				LastTransitionTime: metav1.Now(),
+			}}
+
+			rulesConfigMap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "loki-rule-cfg",
+					Namespace: "loki",
+					Annotations: map[string]string{
+						lokirule.AppliedRulesAnnotation: `{"default_errors.yaml":{"namespace":"default","name":"errors","generation":1}}`,
+					},
+				},
+				Data: map[string]string{"default_errors.yaml": unmanagedRuleFile},
+			}
+			if tt.unwritten {
+				rulesConfigMap.Annotations, rulesConfigMap.Data = nil, nil
+			}
+
+			r := newFakeReconciler(t, rule, rulesConfigMap)
+			r.LokiClient = server.Client()
+			r.LokiURL = server.URL
+
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}}
+			result, err := r.Reconcile(context.TODO(), req)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if result.RequeueAfter != tt.requeueAfter {
+				t.Errorf("Expected a requeue after %s, got: %+v", tt.requeueAfter, result)
+			}
+
+			updated := &querocomv1alpha1.LokiRule{}
+			if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "errors"}, updated); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			condition := meta.FindStatusCondition(updated.Status.Conditions, tt.condition)
+			if condition == nil || condition.Reason != tt.reason || !strings.HasPrefix(condition.Message, tt.message) {
+				t.Errorf("Expected the %s condition with reason %s, got: %+v", tt.condition, tt.reason, updated.Status.Conditions)
+			}
+			accepted := meta.IsStatusConditionTrue(updated.Status.Conditions, querocomv1alpha1.ConditionAccepted)
+			if accepted != tt.written {
+				t.Errorf("Expected the LokiRule to be accepted: %t, got: %+v", tt.written, updated.Status.Conditions)
+			}
+			loaded := meta.FindStatusCondition(updated.Status.Conditions, querocomv1alpha1.ConditionLoaded)
+			if !tt.written && loaded != nil {
+				t.Errorf("Expected the Loaded condition to be cleared, got: %+v", loaded)
+			}
+
+			configMap := &corev1.ConfigMap{}
+			if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}, configMap); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			content, ok := configMap.Data["default_errors.yaml"]
+			if written := ok && content != unmanagedRuleFile; written != tt.written {
+				t.Errorf("Expected the rule file to be written: %t, got: %v", tt.written, configMap.Data)
+			}
+
+			if tt.unreachable {
+				return
+			}
+
+			// A spec already written or rejected is not validated again, one
+			// Loki failed to validate is.
+			sent := requests
+			if _, err := r.Reconcile(context.TODO(), req); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if revalidated := requests != sent; revalidated != tt.revalidated {
+				t.Errorf("Expected the spec to be sent to Loki again: %t, got %d requests", tt.revalidated, requests-sent)
+			}
+		})
+	}
+}
+
+// failingTransport fails every request, counting them.
+type failingTransport struct {
+	mu       sync.Mutex
+	requests int
+}
+
+func (f *failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests++
+	return nil, errors.New("connection refused")
+}
+
+func TestReconcileStopsValidatingAfterFailedRequest(t *testing.T) {
+	var rules []client.Object
+	for i := 0; i < 4*logQLValidationConcurrency; i++ {
+		rules = append(rules, newLokiRule("default", fmt.Sprintf("errors-%d", i)))
+	}
+
+	transport := &failingTransport{}
+	r := newFakeReconciler(t, rules...)
+	r.LokiClient = &http.Client{Transport: transport}
+	r.LokiURL = "http://loki:3100"
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "loki", Name: "loki-rule-cfg"}}
+	if _, err := r.Reconcile(context.TODO(), req); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if transport.requests > logQLValidationConcurrency {
+		t.Errorf("Expected at most %d requests to Loki, got: %d", logQLValidationConcurrency, transport.requests)
+	}
+
+	list := &querocomv1alpha1.LokiRuleList{}
+	if err := r.List(context.TODO(), list); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, rule := range list.Items {
+		accepted := meta.FindStatusCondition(rule.Status.Conditions, querocomv1alpha1.ConditionAccepted)
+		if accepted == nil || accepted.Reason != querocomv1alpha1.ReasonLokiUnavailable ||
+			!strings.Contains(accepted.Message, "connection refused") {
+			t.Errorf("Expected LokiRule %s not to be validated, got: %+v", rule.Name, accepted)
+		}
+	}
+}
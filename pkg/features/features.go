@@ -0,0 +1,19 @@
+// Package features holds the values of the feature settings of the operator,
+// shared by its config and its controllers.
+package features
+
+const (
+	// QuarantinePolicyKeep keeps the last known-good rule file of a quarantined LokiRule
+	QuarantinePolicyKeep = "keep"
+	// QuarantinePolicyOmit removes the rule file of a quarantined LokiRule
+	QuarantinePolicyOmit = "omit"
+)
+
+const (
+	// AdoptionModeOff ignores rules not rendered from a LokiRule
+	AdoptionModeOff = "off"
+	// AdoptionModeReport logs and records an event for rules not rendered from a LokiRule
+	AdoptionModeReport = "report"
+	// AdoptionModeCreate creates a LokiRule for rules not rendered from a LokiRule
+	AdoptionModeCreate = "create"
+)
@@ -5,19 +5,41 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/quero-edu/loki-rule-operator/internal/logger"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// FieldManager is the field manager of the server-side applies of the
+// operator.
+const FieldManager = "loki-rule-operator"
+
+// DefaultTimeout bounds each operation, including its retries, when
+// Options.Timeout is not set.
+const DefaultTimeout = 30 * time.Second
+
 type Options struct {
 	Logger logger.Logger
 	Ctx    context.Context
+	// Timeout bounds each operation on top of the deadline of Ctx, so a
+	// stalled API server does not hold the reconcile forever
+	Timeout time.Duration
+	// DryRun sends every write as a server-side dry run, which validates it
+	// without persisting it, and logs the changes it would make.
+	DryRun bool
 }
 
 func sanitizeOptions(args Options) Options {
@@ -29,18 +51,31 @@ func sanitizeOptions(args Options) Options {
 		args.Ctx = context.TODO()
 	}
 
+	if args.Timeout <= 0 {
+		args.Timeout = DefaultTimeout
+	}
+
 	return args
 }
 
+// withTimeout returns the context of an operation, canceled when args.Ctx is
+// or once args.Timeout elapsed.
+func withTimeout(args Options) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(args.Ctx, args.Timeout)
+}
+
 func genVolumeNameFromConfigMap(configMapName string) string {
 	return fmt.Sprintf("%s-volume", configMapName)
 }
 
-func genHashAnnotation(configMapName string) string {
+// ChecksumAnnotation is the pod template annotation of the Loki StatefulSet
+// holding the checksum of the mounted ConfigMap, so Loki restarts when it changes.
+func ChecksumAnnotation(configMapName string) string {
 	return fmt.Sprintf("checksum/config-%s", configMapName)
 }
 
-func hashConfigMapData(configMap *corev1.ConfigMap) (string, error) {
+// HashConfigMapData returns the checksum of the data of the ConfigMap.
+func HashConfigMapData(configMap *corev1.ConfigMap) (string, error) {
 	data, err := json.Marshal(configMap.Data)
 	if err != nil {
 		return "", err
@@ -67,6 +102,39 @@ func volumeIsMounted(volumeName string, lokiStatefulSet *appsv1.StatefulSet) boo
 	return false
 }
 
+// volumeMatches reports whether the StatefulSet has the volume of the ConfigMap.
+func volumeMatches(volume corev1.Volume, lokiStatefulSet *appsv1.StatefulSet) bool {
+	for _, v := range lokiStatefulSet.Spec.Template.Spec.Volumes {
+		if v.Name == volume.Name {
+			return v.ConfigMap != nil && v.ConfigMap.Name == volume.ConfigMap.Name
+		}
+	}
+	return false
+}
+
+// volumeMountMatches reports whether the first container of the StatefulSet
+// mounts the volume at the mount path.
+func volumeMountMatches(volumeMount corev1.VolumeMount, lokiStatefulSet *appsv1.StatefulSet) bool {
+	for _, vm := range lokiStatefulSet.Spec.Template.Spec.Containers[0].VolumeMounts {
+		if vm.Name == volumeMount.Name {
+			return vm.MountPath == volumeMount.MountPath
+		}
+	}
+	return false
+}
+
+// ConfigMapMountDrifted reports whether the StatefulSet has the checksum
+// annotation of the ConfigMap, so the ConfigMap was mounted into it, but lost
+// its volume or volume mount, e.g. to an upgrade of its Helm release.
+func ConfigMapMountDrifted(configMapName string, lokiStatefulSet *appsv1.StatefulSet) bool {
+	if _, ok := lokiStatefulSet.Spec.Template.Annotations[ChecksumAnnotation(configMapName)]; !ok {
+		return false
+	}
+
+	volumeName := genVolumeNameFromConfigMap(configMapName)
+	return !volumeExists(volumeName, lokiStatefulSet) || !volumeIsMounted(volumeName, lokiStatefulSet)
+}
+
 func generateVolumeMounts(
 	mountPath string,
 	configMapName string,
@@ -92,6 +160,48 @@ func generateVolumeMounts(
 	return volume, volumeMount
 }
 
+// mapChanges lists the keys added, changed and removed from before to after.
+func mapChanges(before, after map[string]string) ([]string, []string, []string) {
+	var added, changed, removed []string
+
+	for k, v := range after {
+		previous, ok := before[k]
+		if !ok {
+			added = append(added, k)
+		} else if previous != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(changed)
+	sort.Strings(removed)
+
+	return added, changed, removed
+}
+
+func logConfigMapDryRun(log logger.Logger, before, after *corev1.ConfigMap) {
+	added, changed, removed := mapChanges(before.Data, after.Data)
+	annotationsAdded, annotationsChanged, annotationsRemoved := mapChanges(before.Annotations, after.Annotations)
+	labelsAdded, labelsChanged, labelsRemoved := mapChanges(before.Labels, after.Labels)
+
+	log.Info(
+		"Dry run, ConfigMap not persisted",
+		"ConfigMap.Namespace", after.Namespace,
+		"ConfigMap.Name", after.Name,
+		"keysAdded", added,
+		"keysChanged", changed,
+		"keysRemoved", removed,
+		"annotationsChanged", append(append(annotationsAdded, annotationsChanged...), annotationsRemoved...),
+		"labelsChanged", append(append(labelsAdded, labelsChanged...), labelsRemoved...),
+	)
+}
+
 func mergeStringMaps(a, b map[string]string) map[string]string {
 	for k, v := range b {
 		a[k] = v
@@ -106,7 +216,10 @@ func GetStatefulSet(
 	args Options,
 ) (*appsv1.StatefulSet, error) {
 	args = sanitizeOptions(args)
-	ctx, log := args.Ctx, args.Logger
+	log := args.Logger
+
+	ctx, cancel := withTimeout(args)
+	defer cancel()
 
 	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
 	if err != nil {
@@ -139,32 +252,274 @@ func GetStatefulSet(
 	return &statefulSets.Items[0], nil
 }
 
-func AddToConfigMap(
+// ConfigMapKeys are keys of the data, annotations and labels of a ConfigMap.
+type ConfigMapKeys struct {
+	Data        map[string]bool
+	Annotations map[string]bool
+	Labels      map[string]bool
+}
+
+// OwnedConfigMapKeys returns the keys of the ConfigMap written by
+// FieldManager, with a server-side apply or a patch.
+func OwnedConfigMapKeys(configMap *corev1.ConfigMap) (ConfigMapKeys, error) {
+	return managedConfigMapKeys(configMap, func(entry metav1.ManagedFieldsEntry) bool {
+		return entry.Manager == FieldManager
+	})
+}
+
+// managedConfigMapKeys returns the keys of the ConfigMap owned by the managed
+// fields entries selected by owner.
+func managedConfigMapKeys(
+	configMap *corev1.ConfigMap,
+	owner func(entry metav1.ManagedFieldsEntry) bool,
+) (ConfigMapKeys, error) {
+	keys := ConfigMapKeys{Data: map[string]bool{}, Annotations: map[string]bool{}, Labels: map[string]bool{}}
+
+	for _, entry := range configMap.ManagedFields {
+		if entry.FieldsV1 == nil || !owner(entry) {
+			continue
+		}
+
+		var fields struct {
+			Data     map[string]json.RawMessage `json:"f:data"`
+			Metadata struct {
+				Annotations map[string]json.RawMessage `json:"f:annotations"`
+				Labels      map[string]json.RawMessage `json:"f:labels"`
+			} `json:"f:metadata"`
+		}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			return keys, fmt.Errorf("invalid managed fields of %s: %w", entry.Manager, err)
+		}
+
+		addFieldKeys(keys.Data, fields.Data)
+		addFieldKeys(keys.Annotations, fields.Metadata.Annotations)
+		addFieldKeys(keys.Labels, fields.Metadata.Labels)
+	}
+
+	return keys, nil
+}
+
+// addFieldKeys adds the map keys of a managed fields set, "f:<key>", to keys.
+func addFieldKeys(keys map[string]bool, fields map[string]json.RawMessage) {
+	for field := range fields {
+		if key, ok := strings.CutPrefix(field, "f:"); ok {
+			keys[key] = true
+		}
+	}
+}
+
+// removableByApply returns whether an apply of FieldManager removes the keys,
+// which it only does for the keys no other field manager owns.
+func removableByApply(configMap *corev1.ConfigMap, data, annotations, labels []string) (bool, error) {
+	applied, err := managedConfigMapKeys(configMap, func(entry metav1.ManagedFieldsEntry) bool {
+		return entry.Manager == FieldManager && entry.Operation == metav1.ManagedFieldsOperationApply
+	})
+	if err != nil {
+		return false, err
+	}
+	others, err := managedConfigMapKeys(configMap, func(entry metav1.ManagedFieldsEntry) bool {
+		return entry.Manager != FieldManager || entry.Operation != metav1.ManagedFieldsOperationApply
+	})
+	if err != nil {
+		return false, err
+	}
+
+	removable := func(applied, others map[string]bool, keys []string) bool {
+		for _, k := range keys {
+			if !applied[k] || others[k] {
+				return false
+			}
+		}
+		return true
+	}
+
+	return removable(applied.Data, others.Data, data) &&
+		removable(applied.Annotations, others.Annotations, annotations) &&
+		removable(applied.Labels, others.Labels, labels), nil
+}
+
+// appliedStringMap returns the entries of desired FieldManager keeps owning:
+// those it owned and those it added or changed.
+func appliedStringMap(owned map[string]bool, added, changed []string, desired map[string]string) map[string]string {
+	applied := map[string]string{}
+
+	for k := range owned {
+		if v, ok := desired[k]; ok {
+			applied[k] = v
+		}
+	}
+	for _, k := range append(added, changed...) {
+		applied[k] = desired[k]
+	}
+
+	return applied
+}
+
+func toUnstructured(obj interface{}) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return &unstructured.Unstructured{Object: content}, nil
+}
+
+// patchConfigMap writes the changes from current to desired with a merge
+// patch, setting the added and changed keys and deleting the removed ones.
+// The resource version makes the patch fail with a conflict if the ConfigMap
+// changed since it was read.
+func patchConfigMap(
+	ctx context.Context,
+	cli client.Client,
+	current, desired *corev1.ConfigMap,
+	opts []client.PatchOption,
+) error {
+	changes := func(before, after map[string]string) map[string]interface{} {
+		added, changed, removed := mapChanges(before, after)
+		m := map[string]interface{}{}
+		for _, k := range append(added, changed...) {
+			m[k] = after[k]
+		}
+		for _, k := range removed {
+			m[k] = nil
+		}
+		return m
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": current.ResourceVersion,
+			"annotations":     changes(current.Annotations, desired.Annotations),
+			"labels":          changes(current.Labels, desired.Labels),
+		},
+		"data": changes(current.Data, desired.Data),
+	})
+	if err != nil {
+		return err
+	}
+
+	patched := current.DeepCopy()
+	if err := cli.Patch(ctx, patched, client.RawPatch(types.MergePatchType, patch), opts...); err != nil {
+		return err
+	}
+	desired.ResourceVersion = patched.ResourceVersion
+
+	return nil
+}
+
+// UpdateConfigMap gets the ConfigMap, applies mutate to it and writes the
+// result in a single write, guarded by the resource version of the ConfigMap:
+// a server-side apply of FieldManager, which only owns the data, annotation
+// and label keys it wrote, so keys added by others are left untouched. An
+// apply only removes the keys no other field manager owns, so a change
+// removing other keys, e.g. written by updates before the operator used
+// server-side apply, is written with a merge patch instead.
+// The write is retried when the ConfigMap changed since it was read. The
+// returned ConfigMap has the resource version of the write.
+func UpdateConfigMap(
 	cli client.Client,
 	namespace string,
 	configMapName string,
-	configMapData map[string]string,
+	mutate func(configMap *corev1.ConfigMap) error,
 	args Options,
 ) (*corev1.ConfigMap, error) {
 	args = sanitizeOptions(args)
-	ctx, log := args.Ctx, args.Logger
+	log := args.Logger
+
+	ctx, cancel := withTimeout(args)
+	defer cancel()
+
+	var configMap *corev1.ConfigMap
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		current := &corev1.ConfigMap{}
+		err := cli.Get(ctx, types.NamespacedName{
+			Name:      configMapName,
+			Namespace: namespace,
+		}, current)
+		// A dry run never creates the ConfigMap, so it may not exist yet.
+		if args.DryRun && errors.IsNotFound(err) {
+			current = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: configMapName, Namespace: namespace}}
+		} else if err != nil {
+			return err
+		}
 
-	configMap := &corev1.ConfigMap{}
-	err := cli.Get(ctx, types.NamespacedName{
-		Name:      configMapName,
-		Namespace: namespace,
-	}, configMap)
+		configMap = current.DeepCopy()
+		if err := mutate(configMap); err != nil {
+			return err
+		}
+
+		owned, err := OwnedConfigMapKeys(current)
+		if err != nil {
+			return err
+		}
+		dataAdded, dataChanged, dataRemoved := mapChanges(current.Data, configMap.Data)
+		annotationsAdded, annotationsChanged, annotationsRemoved := mapChanges(current.Annotations, configMap.Annotations)
+		labelsAdded, labelsChanged, labelsRemoved := mapChanges(current.Labels, configMap.Labels)
+
+		var patchOpts []client.PatchOption
+		if args.DryRun {
+			logConfigMapDryRun(log, current, configMap)
+			patchOpts = append(patchOpts, client.DryRunAll)
+		}
+		patchOpts = append(patchOpts, client.FieldOwner(FieldManager))
+
+		applies, err := removableByApply(current, dataRemoved, annotationsRemoved, labelsRemoved)
+		if err != nil {
+			return err
+		}
+		if current.ResourceVersion != "" && !applies {
+			log.Debug("Patching ConfigMap", "ConfigMap.Namespace", namespace, "ConfigMap.Name", configMapName)
+			err := patchConfigMap(ctx, cli, current, configMap, patchOpts)
+			if args.DryRun {
+				configMap.ResourceVersion = current.ResourceVersion
+			}
+			return err
+		}
+
+		applyConfig := corev1ac.ConfigMap(configMapName, namespace).
+			WithResourceVersion(current.ResourceVersion).
+			WithData(appliedStringMap(owned.Data, dataAdded, dataChanged, configMap.Data)).
+			WithAnnotations(appliedStringMap(owned.Annotations, annotationsAdded, annotationsChanged, configMap.Annotations)).
+			WithLabels(appliedStringMap(owned.Labels, labelsAdded, labelsChanged, configMap.Labels))
+
+		obj, err := toUnstructured(applyConfig)
+		if err != nil {
+			return err
+		}
+
+		log.Debug("Applying ConfigMap", "ConfigMap.Namespace", namespace, "ConfigMap.Name", configMapName)
+		err = cli.Patch(ctx, obj, client.Apply, append(patchOpts, client.ForceOwnership)...)
+		if err != nil {
+			return err
+		}
+
+		if !args.DryRun {
+			configMap.ResourceVersion = obj.GetResourceVersion()
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if configMap.Data == nil {
-		configMap.Data = map[string]string{}
-	}
-	configMap.Data = mergeStringMaps(configMap.Data, configMapData)
+	return configMap, nil
+}
+
+func AddToConfigMap(
+	cli client.Client,
+	namespace string,
+	configMapName string,
+	configMapData map[string]string,
+	args Options,
+) (*corev1.ConfigMap, error) {
+	return UpdateConfigMap(cli, namespace, configMapName, func(configMap *corev1.ConfigMap) error {
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data = mergeStringMaps(configMap.Data, configMapData)
 
-	log.Debug("Updating ConfigMap", "ConfigMap.Namespace", namespace, "ConfigMap.Name", configMapName)
-	return configMap, cli.Update(ctx, configMap)
+		return nil
+	}, args)
 }
 
 func RemoveFromConfigMap(
@@ -174,24 +529,13 @@ func RemoveFromConfigMap(
 	configMapDataToRemove map[string]string,
 	args Options,
 ) (*corev1.ConfigMap, error) {
-	args = sanitizeOptions(args)
-	ctx, log := args.Ctx, args.Logger
-
-	configMap := &corev1.ConfigMap{}
-	err := cli.Get(ctx, types.NamespacedName{
-		Name:      configMapName,
-		Namespace: namespace,
-	}, configMap)
-	if err != nil {
-		return nil, err
-	}
-
-	for k := range configMapDataToRemove {
-		delete(configMap.Data, k)
-	}
+	return UpdateConfigMap(cli, namespace, configMapName, func(configMap *corev1.ConfigMap) error {
+		for k := range configMapDataToRemove {
+			delete(configMap.Data, k)
+		}
 
-	log.Debug("Updating ConfigMap", "ConfigMap.Namespace", namespace, "ConfigMap.Name", configMapName)
-	return configMap, cli.Update(ctx, configMap)
+		return nil
+	}, args)
 }
 
 func CreateConfigMap(
@@ -202,7 +546,10 @@ func CreateConfigMap(
 	args Options,
 ) (*corev1.ConfigMap, error) {
 	args = sanitizeOptions(args)
-	ctx, log := args.Ctx, args.Logger
+	log := args.Logger
+
+	ctx, cancel := withTimeout(args)
+	defer cancel()
 
 	configMap := &corev1.ConfigMap{}
 
@@ -210,8 +557,17 @@ func CreateConfigMap(
 	configMap.Namespace = namespace
 	configMap.Labels = labels
 
+	var createOpts []client.CreateOption
+	if args.DryRun {
+		createOpts = append(createOpts, client.DryRunAll)
+	}
+
 	log.Debug("Creating a new ConfigMap", "ConfigMap.Namespace", namespace, "ConfigMap.Name", configMapName)
-	err := cli.Create(ctx, configMap)
+	err := cli.Create(ctx, configMap, createOpts...)
+
+	if err == nil && args.DryRun {
+		log.Info("Dry run, ConfigMap not created", "ConfigMap.Namespace", namespace, "ConfigMap.Name", configMapName)
+	}
 
 	if err != nil && !errors.IsAlreadyExists(err) {
 		log.Debug("failed to create configmap", "err", err)
@@ -221,53 +577,168 @@ func CreateConfigMap(
 	return configMap, nil
 }
 
+// MountConfigMap mounts the ConfigMap into the Loki StatefulSet and sets the
+// checksum annotation of its data, rolling the pods when the data changes.
+// The ConfigMap is the one written, so on a dry run the checksum is the one of
+// the data that would have been written.
 func MountConfigMap(
 	cli client.Client,
-	configMapNameSpace string,
-	configMapName string,
+	configMap *corev1.ConfigMap,
 	mountPath string,
 	lokiStatefulSet *appsv1.StatefulSet,
 	args Options,
 ) error {
 	args = sanitizeOptions(args)
-	ctx, log := args.Ctx, args.Logger
+	log := args.Logger
+
+	ctx, cancel := withTimeout(args)
+	defer cancel()
+
+	volume, volumeMount := generateVolumeMounts(mountPath, configMap.Name)
+
+	configMapAnnotationName := ChecksumAnnotation(configMap.Name)
+	configMapHash, err := HashConfigMapData(configMap)
 
-	configMap := &corev1.ConfigMap{}
-	err := cli.Get(ctx, types.NamespacedName{
-		Name:      configMapName,
-		Namespace: configMapNameSpace,
-	}, configMap)
 	if err != nil {
-		log.Debug("failed to get configmap", "err", err)
+		log.Debug("failed to hash configmap data", "err", err)
 		return err
 	}
 
-	volume, volumeMount := generateVolumeMounts(mountPath, configMap.Name)
+	mounted := volumeMatches(volume, lokiStatefulSet) && volumeMountMatches(volumeMount, lokiStatefulSet)
+	annotated := lokiStatefulSet.Spec.Template.Annotations[configMapAnnotationName] == configMapHash
+	if mounted && annotated {
+		log.Debug("ConfigMap already mounted", "StatefulSet.Namespace", lokiStatefulSet.Namespace,
+			"StatefulSet.Name", lokiStatefulSet.Name)
+		return nil
+	}
 
-	configMapAnnotationName := genHashAnnotation(configMap.Name)
-	configMapHash, err := hashConfigMapData(configMap)
+	// Ownership is always forced, as the checksum annotation changes with
+	// every rule change and may be owned by another field manager, e.g. the
+	// Update of an operator version predating server-side apply. Forcing only
+	// takes over the fields whose value differs, a volume another field
+	// manager (e.g. Helm) declares with the same value stays shared with it.
+	patchOpts := []client.PatchOption{client.FieldOwner(FieldManager), client.ForceOwnership}
+	if args.DryRun {
+		patchOpts = append(patchOpts, client.DryRunAll)
+
+		log.Info(
+			"Dry run, StatefulSet not persisted",
+			"StatefulSet.Namespace", lokiStatefulSet.Namespace,
+			"StatefulSet.Name", lokiStatefulSet.Name,
+			"annotationChanged", lokiStatefulSet.Spec.Template.Annotations[configMapAnnotationName] != configMapHash,
+			"volumeAdded", !volumeExists(volume.Name, lokiStatefulSet),
+			"volumeMountAdded", !volumeIsMounted(volume.Name, lokiStatefulSet),
+		)
+	}
 
+	// Only the checksum annotation, the volume and its mount are applied, so
+	// the fields other field managers (e.g. Helm) own are left untouched.
+	applyConfig := appsv1ac.StatefulSet(lokiStatefulSet.Name, lokiStatefulSet.Namespace).
+		WithSpec(appsv1ac.StatefulSetSpec().
+			WithTemplate(corev1ac.PodTemplateSpec().
+				WithAnnotations(map[string]string{configMapAnnotationName: configMapHash}).
+				WithSpec(corev1ac.PodSpec().
+					WithVolumes(corev1ac.Volume().
+						WithName(volume.Name).
+						WithConfigMap(corev1ac.ConfigMapVolumeSource().WithName(configMap.Name))).
+					WithContainers(corev1ac.Container().
+						WithName(lokiStatefulSet.Spec.Template.Spec.Containers[0].Name).
+						WithVolumeMounts(corev1ac.VolumeMount().
+							WithName(volumeMount.Name).
+							WithMountPath(volumeMount.MountPath))))))
+
+	obj, err := toUnstructured(applyConfig)
 	if err != nil {
-		log.Debug("failed to hash configmap data", "err", err)
 		return err
 	}
 
-	if lokiStatefulSet.Spec.Template.Annotations == nil {
-		lokiStatefulSet.Spec.Template.Annotations = make(map[string]string)
+	err = cli.Patch(ctx, obj, client.Apply, patchOpts...)
+	if err != nil {
+		log.Debug("failed to apply statefulSet", "statefulSet", lokiStatefulSet.Name, "err", err)
+		return err
 	}
 
-	lokiStatefulSet.Spec.Template.Annotations[configMapAnnotationName] = configMapHash
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, lokiStatefulSet)
+}
+
+// jsonPointerEscaper escapes a map key as a JSON pointer reference token.
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// UnmountConfigMap removes the volume MountConfigMap added for the ConfigMap,
+// its mount and its checksum annotation from the Loki StatefulSet. A
+// server-side apply only removes the fields its field manager owns, so they
+// are removed with a JSON patch instead, whichever field manager owns them,
+// e.g. the Update of an operator version predating server-side apply. Every
+// removed list item is tested first, so the patch fails if the StatefulSet
+// changed since it was read. The StatefulSet is not written when it has none
+// of them.
+func UnmountConfigMap(
+	cli client.Client,
+	configMapName string,
+	lokiStatefulSet *appsv1.StatefulSet,
+	args Options,
+) error {
+	args = sanitizeOptions(args)
+	log := args.Logger
+
+	ctx, cancel := withTimeout(args)
+	defer cancel()
+
+	volumeName := genVolumeNameFromConfigMap(configMapName)
+
+	var ops []map[string]interface{}
+	removeItem := func(path, name string) {
+		ops = append(ops,
+			map[string]interface{}{"op": "test", "path": path + "/name", "value": name},
+			map[string]interface{}{"op": "remove", "path": path},
+		)
+	}
+
+	// Items are removed from the last one, so the indices of the ones left to
+	// remove do not shift.
+	mounts := lokiStatefulSet.Spec.Template.Spec.Containers[0].VolumeMounts
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].Name == volumeName {
+			removeItem(fmt.Sprintf("/spec/template/spec/containers/0/volumeMounts/%d", i), volumeName)
+		}
+	}
+	volumes := lokiStatefulSet.Spec.Template.Spec.Volumes
+	for i := len(volumes) - 1; i >= 0; i-- {
+		if volumes[i].Name == volumeName {
+			removeItem(fmt.Sprintf("/spec/template/spec/volumes/%d", i), volumeName)
+		}
+	}
+	if _, ok := lokiStatefulSet.Spec.Template.Annotations[ChecksumAnnotation(configMapName)]; ok {
+		ops = append(ops, map[string]interface{}{
+			"op":   "remove",
+			"path": "/spec/template/metadata/annotations/" + jsonPointerEscaper.Replace(ChecksumAnnotation(configMapName)),
+		})
+	}
+
+	if len(ops) == 0 {
+		log.Debug("ConfigMap not mounted", "StatefulSet.Namespace", lokiStatefulSet.Namespace,
+			"StatefulSet.Name", lokiStatefulSet.Name, "ConfigMap.Name", configMapName)
+		return nil
+	}
+
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
 
-	if !volumeExists(volume.Name, lokiStatefulSet) && !volumeIsMounted(volume.Name, lokiStatefulSet) {
-		lokiStatefulSet.Spec.Template.Spec.Volumes = append(lokiStatefulSet.Spec.Template.Spec.Volumes, volume)
+	patchOpts := []client.PatchOption{client.FieldOwner(FieldManager)}
+	if args.DryRun {
+		patchOpts = append(patchOpts, client.DryRunAll)
 
-		lokiStatefulSet.Spec.Template.Spec.Containers[0].VolumeMounts = append(
-			lokiStatefulSet.Spec.Template.Spec.Containers[0].VolumeMounts,
-			volumeMount,
+		log.Info(
+			"Dry run, StatefulSet not persisted",
+			"StatefulSet.Namespace", lokiStatefulSet.Namespace,
+			"StatefulSet.Name", lokiStatefulSet.Name,
+			"unmountedConfigMap", configMapName,
 		)
 	}
 
-	err = cli.Patch(ctx, lokiStatefulSet, client.Merge)
+	err = cli.Patch(ctx, lokiStatefulSet, client.RawPatch(types.JSONPatchType, patch), patchOpts...)
 	if err != nil {
 		log.Debug("failed to patch statefulSet", "statefulSet", lokiStatefulSet.Name, "err", err)
 		return err
@@ -152,6 +152,158 @@ var _ = Describe("K8sutils", func() {
 		})
 	})
 
+	Describe("UpdateConfigMap", func() {
+		It("should only own the keys it applies", func() {
+			configMapName := "test-configmap-apply"
+
+			configMap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      configMapName,
+					Namespace: NAMESPACE,
+				},
+				Data: map[string]string{"foreign": "value"},
+			}
+
+			err := k8sClient.Create(context.TODO(), configMap)
+			Expect(err).To(BeNil())
+
+			_, err = AddToConfigMap(k8sClient, NAMESPACE, configMapName, map[string]string{"foo": "bar"}, Options{})
+			Expect(err).To(BeNil())
+
+			_, err = AddToConfigMap(k8sClient, NAMESPACE, configMapName, map[string]string{"baz": "foo"}, Options{})
+			Expect(err).To(BeNil())
+
+			configMap = &corev1.ConfigMap{}
+			err = k8sClient.Get(context.TODO(), types.NamespacedName{
+				Name:      configMapName,
+				Namespace: NAMESPACE,
+			}, configMap)
+			Expect(err).To(BeNil())
+
+			owned, err := OwnedConfigMapKeys(configMap)
+			Expect(err).To(BeNil())
+			Expect(owned.Data).To(Equal(map[string]bool{"foo": true, "baz": true}))
+
+			_, err = RemoveFromConfigMap(k8sClient, NAMESPACE, configMapName, map[string]string{"foo": ""}, Options{})
+			Expect(err).To(BeNil())
+
+			configMap = &corev1.ConfigMap{}
+			err = k8sClient.Get(context.TODO(), types.NamespacedName{
+				Name:      configMapName,
+				Namespace: NAMESPACE,
+			}, configMap)
+			Expect(err).To(BeNil())
+			Expect(configMap.Data).To(Equal(map[string]string{"foreign": "value", "baz": "foo"}))
+		})
+
+		It("should apply and remove labels", func() {
+			configMapName := "test-configmap-labels"
+
+			configMap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      configMapName,
+					Namespace: NAMESPACE,
+					Labels:    map[string]string{"foreign": "value"},
+				},
+			}
+
+			err := k8sClient.Create(context.TODO(), configMap)
+			Expect(err).To(BeNil())
+
+			setLabel := func(key, value string) func(*corev1.ConfigMap) error {
+				return func(configMap *corev1.ConfigMap) error {
+					if value == "" {
+						delete(configMap.Labels, key)
+					} else {
+						configMap.Labels[key] = value
+					}
+					return nil
+				}
+			}
+
+			_, err = UpdateConfigMap(k8sClient, NAMESPACE, configMapName, setLabel("team", "a"), Options{})
+			Expect(err).To(BeNil())
+
+			configMap = &corev1.ConfigMap{}
+			err = k8sClient.Get(context.TODO(), types.NamespacedName{
+				Name:      configMapName,
+				Namespace: NAMESPACE,
+			}, configMap)
+			Expect(err).To(BeNil())
+			Expect(configMap.Labels).To(Equal(map[string]string{"foreign": "value", "team": "a"}))
+
+			owned, err := OwnedConfigMapKeys(configMap)
+			Expect(err).To(BeNil())
+			Expect(owned.Labels).To(Equal(map[string]bool{"team": true}))
+
+			_, err = UpdateConfigMap(k8sClient, NAMESPACE, configMapName, setLabel("team", ""), Options{})
+			Expect(err).To(BeNil())
+
+			configMap = &corev1.ConfigMap{}
+			err = k8sClient.Get(context.TODO(), types.NamespacedName{
+				Name:      configMapName,
+				Namespace: NAMESPACE,
+			}, configMap)
+			Expect(err).To(BeNil())
+			Expect(configMap.Labels).To(Equal(map[string]string{"foreign": "value"}))
+		})
+
+		It("should remove keys written by others in a single patch", func() {
+			configMapName := "test-configmap-patch"
+
+			configMap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      configMapName,
+					Namespace: NAMESPACE,
+				},
+				Data: map[string]string{"legacy": "value", "kept": "value"},
+			}
+
+			err := k8sClient.Create(context.TODO(), configMap)
+			Expect(err).To(BeNil())
+
+			updated, err := UpdateConfigMap(k8sClient, NAMESPACE, configMapName, func(configMap *corev1.ConfigMap) error {
+				delete(configMap.Data, "legacy")
+				configMap.Data["foo"] = "bar"
+				return nil
+			}, Options{})
+			Expect(err).To(BeNil())
+
+			configMap = &corev1.ConfigMap{}
+			err = k8sClient.Get(context.TODO(), types.NamespacedName{
+				Name:      configMapName,
+				Namespace: NAMESPACE,
+			}, configMap)
+			Expect(err).To(BeNil())
+			Expect(configMap.Data).To(Equal(map[string]string{"kept": "value", "foo": "bar"}))
+			Expect(updated.ResourceVersion).To(Equal(configMap.ResourceVersion))
+
+			owned, err := OwnedConfigMapKeys(configMap)
+			Expect(err).To(BeNil())
+			Expect(owned.Data).To(Equal(map[string]bool{"foo": true}))
+		})
+	})
+
+	Describe("DryRun", func() {
+		It("should not create or update the ConfigMap", func() {
+			configMapName := "test-configmap-dry-run"
+			options := Options{DryRun: true}
+
+			_, err := CreateConfigMap(k8sClient, NAMESPACE, configMapName, nil, options)
+			Expect(err).To(BeNil())
+
+			configMap, err := AddToConfigMap(k8sClient, NAMESPACE, configMapName, map[string]string{"foo": "bar"}, options)
+			Expect(err).To(BeNil())
+			Expect(configMap.Data).To(Equal(map[string]string{"foo": "bar"}))
+
+			err = k8sClient.Get(context.TODO(), types.NamespacedName{
+				Name:      configMapName,
+				Namespace: NAMESPACE,
+			}, &corev1.ConfigMap{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+	})
+
 	Describe("TestGetStatefulSet", func() {
 		var statefulSet *appsv1.StatefulSet
 		var err error
@@ -229,7 +381,7 @@ var _ = Describe("K8sutils", func() {
 		})
 
 		It("Should mount the configMap", func() {
-			err = MountConfigMap(k8sClient, NAMESPACE, configMapName, mountPath, statefulSet, Options{})
+			err = MountConfigMap(k8sClient, configMap, mountPath, statefulSet, Options{})
 			Expect(err).To(BeNil())
 
 			updatedStatefulSet := &appsv1.StatefulSet{}
@@ -259,6 +411,133 @@ var _ = Describe("K8sutils", func() {
 				updatedStatefulSet.Spec.Template.Annotations,
 			).To(HaveKeyWithValue(expectedAnnotationName, expectedAnnotationHash))
 		})
+
+		It("Should only own the annotation, volume and mount it applies", func() {
+			err = MountConfigMap(k8sClient, configMap, mountPath, statefulSet, Options{})
+			Expect(err).To(BeNil())
+
+			updatedStatefulSet := &appsv1.StatefulSet{}
+			err = k8sClient.Get(context.TODO(), types.NamespacedName{
+				Name:      statefulSet.Name,
+				Namespace: statefulSet.Namespace,
+			}, updatedStatefulSet)
+			Expect(err).To(BeNil())
+
+			Expect(updatedStatefulSet.Spec.Template.Spec.Containers[0].Image).To(Equal("grafana/loki:2.2.1"))
+
+			var managers []string
+			for _, entry := range updatedStatefulSet.ManagedFields {
+				if entry.Operation == metav1.ManagedFieldsOperationApply {
+					managers = append(managers, entry.Manager)
+				}
+			}
+			Expect(managers).To(Equal([]string{FieldManager}))
+		})
+
+		It("Should take over the checksum annotation written by an update", func() {
+			err = MountConfigMap(k8sClient, configMap, mountPath, statefulSet, Options{})
+			Expect(err).To(BeNil())
+
+			// An operator version predating server-side apply updates the
+			// checksum annotation, owning it with another field manager.
+			statefulSet.Spec.Template.Annotations[ChecksumAnnotation(configMapName)] = "outdated"
+			err = k8sClient.Update(context.TODO(), statefulSet, client.FieldOwner("loki-rule-operator-update"))
+			Expect(err).To(BeNil())
+
+			err = MountConfigMap(k8sClient, configMap, mountPath, statefulSet, Options{})
+			Expect(err).To(BeNil())
+
+			expectedHash, err := HashConfigMapData(configMap)
+			Expect(err).To(BeNil())
+			Expect(
+				statefulSet.Spec.Template.Annotations,
+			).To(HaveKeyWithValue(ChecksumAnnotation(configMapName), expectedHash))
+		})
+
+		It("Should not write the statefulSet when it already mounts the configMap", func() {
+			err = MountConfigMap(k8sClient, configMap, mountPath, statefulSet, Options{})
+			Expect(err).To(BeNil())
+			resourceVersion := statefulSet.ResourceVersion
+
+			err = MountConfigMap(k8sClient, configMap, mountPath, statefulSet, Options{})
+			Expect(err).To(BeNil())
+
+			updatedStatefulSet := &appsv1.StatefulSet{}
+			err = k8sClient.Get(context.TODO(), types.NamespacedName{
+				Name:      statefulSet.Name,
+				Namespace: statefulSet.Namespace,
+			}, updatedStatefulSet)
+			Expect(err).To(BeNil())
+			Expect(updatedStatefulSet.ResourceVersion).To(Equal(resourceVersion))
+		})
+
+		It("Should not patch the statefulSet on a dry run", func() {
+			err = MountConfigMap(k8sClient, configMap, mountPath, statefulSet, Options{DryRun: true})
+			Expect(err).To(BeNil())
+
+			updatedStatefulSet := &appsv1.StatefulSet{}
+			err = k8sClient.Get(context.TODO(), types.NamespacedName{
+				Name:      statefulSet.Name,
+				Namespace: statefulSet.Namespace,
+			}, updatedStatefulSet)
+			Expect(err).To(BeNil())
+
+			Expect(updatedStatefulSet.Spec.Template.Spec.Volumes).To(BeEmpty())
+			Expect(updatedStatefulSet.Spec.Template.Annotations).To(BeEmpty())
+		})
+
+		It("Should annotate the checksum of the data that would be written on a dry run", func() {
+			wouldBeWritten := configMap.DeepCopy()
+			wouldBeWritten.Data = map[string]string{"foo": "baz"}
+			expectedHash, err := HashConfigMapData(wouldBeWritten)
+			Expect(err).To(BeNil())
+
+			err = MountConfigMap(k8sClient, wouldBeWritten, mountPath, statefulSet, Options{DryRun: true})
+			Expect(err).To(BeNil())
+
+			Expect(
+				statefulSet.Spec.Template.Annotations,
+			).To(HaveKeyWithValue(ChecksumAnnotation(configMapName), expectedHash))
+		})
+
+		It("Should unmount the configMap mounted by an update", func() {
+			// An operator version predating server-side apply mounts the
+			// configMap with an update, owning it with another field manager.
+			volume, volumeMount := generateVolumeMounts(mountPath, configMapName)
+			statefulSet.Spec.Template.Spec.Volumes = append(statefulSet.Spec.Template.Spec.Volumes, volume)
+			statefulSet.Spec.Template.Spec.Containers[0].VolumeMounts = append(
+				statefulSet.Spec.Template.Spec.Containers[0].VolumeMounts,
+				volumeMount,
+			)
+			statefulSet.Spec.Template.Annotations = map[string]string{ChecksumAnnotation(configMapName): "outdated"}
+			err = k8sClient.Update(context.TODO(), statefulSet, client.FieldOwner("loki-rule-operator-update"))
+			Expect(err).To(BeNil())
+
+			err = UnmountConfigMap(k8sClient, configMapName, statefulSet, Options{})
+			Expect(err).To(BeNil())
+
+			updatedStatefulSet := &appsv1.StatefulSet{}
+			err = k8sClient.Get(context.TODO(), types.NamespacedName{
+				Name:      statefulSet.Name,
+				Namespace: statefulSet.Namespace,
+			}, updatedStatefulSet)
+			Expect(err).To(BeNil())
+
+			Expect(updatedStatefulSet.Spec.Template.Spec.Volumes).To(BeEmpty())
+			Expect(updatedStatefulSet.Spec.Template.Spec.Containers[0].VolumeMounts).To(BeEmpty())
+			Expect(updatedStatefulSet.Spec.Template.Annotations).To(BeEmpty())
+		})
+
+		It("Should report a mounted configMap losing its volume as drift", func() {
+			Expect(ConfigMapMountDrifted(configMapName, statefulSet)).To(BeFalse())
+
+			err = MountConfigMap(k8sClient, configMap, mountPath, statefulSet, Options{})
+			Expect(err).To(BeNil())
+			Expect(ConfigMapMountDrifted(configMapName, statefulSet)).To(BeFalse())
+
+			statefulSet.Spec.Template.Spec.Volumes = nil
+			Expect(ConfigMapMountDrifted(configMapName, statefulSet)).To(BeTrue())
+		})
 	})
 })
 
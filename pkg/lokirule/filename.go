@@ -0,0 +1,139 @@
+package lokirule
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// UniqueFileNameTemplate names rule files "<namespace>_<name>.yaml". "_" is
+	// not allowed in namespaces nor LokiRule names, so no two LokiRules share a
+	// rule file.
+	UniqueFileNameTemplate = "{{ .Namespace }}_{{ .Name }}.yaml"
+	// LegacyFileNameTemplate names rule files "<namespace>-<name>.yaml", as
+	// before rule file names were configurable. LokiRules like a-b/c and a/b-c
+	// share a rule file, the second one to be written is reported as a
+	// RuleFileConflict. It keeps the rule namespaces of the Loki ruler of an
+	// existing install unchanged.
+	LegacyFileNameTemplate = "{{ .Namespace }}-{{ .Name }}.yaml"
+	// DefaultFileNameTemplate is the rule file name template used when none is
+	// configured. The rule files of an existing install are renamed to it by
+	// the RuleFileMigrator, which renames the rule namespace of every LokiRule
+	// in the Loki ruler.
+	DefaultFileNameTemplate = UniqueFileNameTemplate
+)
+
+// AppliedRulesAnnotation is the rules ConfigMap annotation the applied rules
+// were stored in before the applied rules ConfigMap, only read to migrate
+// them, as an annotation cannot hold the applied rules of many rule files.
+const AppliedRulesAnnotation = "loki-rule-operator.quero.com/applied-rules"
+
+// appliedRulesConfigMapSuffix is appended to the name of the rules ConfigMap
+// to name its applied rules ConfigMap.
+const appliedRulesConfigMapSuffix = "-applied-rules"
+
+// AppliedRulesConfigMapName returns the name of the ConfigMap mapping every
+// rule file of the rules ConfigMap to the version of the LokiRule it was
+// rendered from, so the rules Loki is running can be compared with the
+// declared ones.
+func AppliedRulesConfigMapName(rulesConfigMapName string) string {
+	return rulesConfigMapName + appliedRulesConfigMapSuffix
+}
+
+// fileNameData is what a rule file name template is executed with.
+type fileNameData struct {
+	Namespace string
+	Name      string
+	// Hash is a short hex encoded SHA-256 of "<namespace>/<name>", for
+	// templates that need to keep file names short
+	Hash string
+}
+
+// fileNameSamples are pairs of LokiRules that a rule file name template must
+// tell apart.
+var fileNameSamples = [][2]fileNameData{
+	{newFileNameData("a", "c"), newFileNameData("b", "c")},
+	{newFileNameData("a", "b"), newFileNameData("a", "c")},
+}
+
+// ambiguousFileNameSample is a pair of LokiRules that only the legacy rule
+// file name template, kept for compatibility, may map to the same file.
+var ambiguousFileNameSample = [2]fileNameData{newFileNameData("a-b", "c"), newFileNameData("a", "b-c")}
+
+func newFileNameData(namespace, name string) fileNameData {
+	sum := sha256.Sum256([]byte(namespace + "/" + name))
+	return fileNameData{Namespace: namespace, Name: name, Hash: hex.EncodeToString(sum[:])[:10]}
+}
+
+func executeFileNameTemplate(text string, data fileNameData) (string, error) {
+	if text == "" {
+		text = DefaultFileNameTemplate
+	}
+
+	tmpl, err := template.New("fileName").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid rule file name template: %w", err)
+	}
+
+	var fileName strings.Builder
+	if err := tmpl.Execute(&fileName, data); err != nil {
+		return "", fmt.Errorf("invalid rule file name template: %w", err)
+	}
+
+	if errs := validation.IsConfigMapKey(fileName.String()); len(errs) > 0 {
+		return "", fmt.Errorf("invalid rule file name %q: %s", fileName.String(), strings.Join(errs, ", "))
+	}
+
+	return fileName.String(), nil
+}
+
+// ValidateFileNameTemplate checks that the rule file name template renders
+// valid ConfigMap keys and tells LokiRules apart, e.g. namespace "a-b" and
+// name "c" from namespace "a" and name "b-c". The legacy template only has
+// to tell apart LokiRules of different namespaces or names.
+func ValidateFileNameTemplate(text string) error {
+	samples := fileNameSamples
+	if text != LegacyFileNameTemplate {
+		samples = append([][2]fileNameData{ambiguousFileNameSample}, samples...)
+	}
+
+	for _, sample := range samples {
+		first, err := executeFileNameTemplate(text, sample[0])
+		if err != nil {
+			return err
+		}
+
+		second, err := executeFileNameTemplate(text, sample[1])
+		if err != nil {
+			return err
+		}
+
+		if first == second {
+			return fmt.Errorf(
+				"rule file name template maps LokiRules %s/%s and %s/%s to the same file %s",
+				sample[0].Namespace, sample[0].Name, sample[1].Namespace, sample[1].Name, first,
+			)
+		}
+	}
+
+	return nil
+}
+
+// RuleFileName returns the name of the rules ConfigMap key holding the rule
+// file of the LokiRule, rendered from options.FileNameTemplate.
+func RuleFileName(rule *querocomv1alpha1.LokiRule, options Options) (string, error) {
+	return executeFileNameTemplate(options.FileNameTemplate, newFileNameData(rule.Namespace, rule.Name))
+}
+
+// LegacyRuleFileName returns the "<namespace>-<name>.yaml" rule file name used
+// before rule file names were configurable, which LokiRules can share. It is
+// the rule file name of LegacyFileNameTemplate.
+func LegacyRuleFileName(rule *querocomv1alpha1.LokiRule) string {
+	return fmt.Sprintf("%s-%s.yaml", rule.Namespace, rule.Name)
+}
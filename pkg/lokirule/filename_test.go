@@ -0,0 +1,64 @@
+package lokirule
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("RuleFileName", func() {
+	newRule := func(namespace, name string) *querocomv1alpha1.LokiRule {
+		return &querocomv1alpha1.LokiRule{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	}
+
+	It("should not map two LokiRules to the same rule file by default", func() {
+		first, err := RuleFileName(newRule("a-b", "c"), Options{})
+		Expect(err).To(BeNil())
+		second, err := RuleFileName(newRule("a", "b-c"), Options{})
+		Expect(err).To(BeNil())
+
+		Expect(first).To(Equal("a-b_c.yaml"))
+		Expect(second).To(Equal("a_b-c.yaml"))
+	})
+
+	It("should keep the legacy rule file names with the legacy template", func() {
+		fileName, err := RuleFileName(newRule("team-a", "errors"), Options{FileNameTemplate: LegacyFileNameTemplate})
+		Expect(err).To(BeNil())
+		Expect(fileName).To(Equal("team-a-errors.yaml"))
+		Expect(fileName).To(Equal(LegacyRuleFileName(newRule("team-a", "errors"))))
+	})
+
+	It("should render the file name template", func() {
+		fileName, err := RuleFileName(newRule("team-a", "errors"), Options{FileNameTemplate: "{{ .Name }}-{{ .Hash }}.yaml"})
+		Expect(err).To(BeNil())
+		Expect(fileName).To(MatchRegexp(`^errors-[0-9a-f]{10}\.yaml$`))
+	})
+
+	It("should reject file names that are not ConfigMap keys", func() {
+		_, err := RuleFileName(newRule("team-a", "errors"), Options{FileNameTemplate: "{{ .Namespace }}/{{ .Name }}"})
+		Expect(err).To(MatchError(ContainSubstring(`invalid rule file name "team-a/errors"`)))
+	})
+
+	Describe("ValidateFileNameTemplate", func() {
+		It("should accept templates telling LokiRules apart", func() {
+			Expect(ValidateFileNameTemplate("")).To(Succeed())
+			Expect(ValidateFileNameTemplate(DefaultFileNameTemplate)).To(Succeed())
+			Expect(ValidateFileNameTemplate(UniqueFileNameTemplate)).To(Succeed())
+			Expect(ValidateFileNameTemplate(LegacyFileNameTemplate)).To(Succeed())
+			Expect(ValidateFileNameTemplate("{{ .Name }}-{{ .Hash }}.yaml")).To(Succeed())
+		})
+
+		It("should reject ambiguous templates", func() {
+			Expect(ValidateFileNameTemplate("{{ .Namespace }}-{{ .Name }}-rules.yaml")).
+				To(MatchError(ContainSubstring("maps LokiRules a-b/c and a/b-c to the same file a-b-c-rules.yaml")))
+			Expect(ValidateFileNameTemplate("{{ .Name }}.yaml")).
+				To(MatchError(ContainSubstring("maps LokiRules a/c and b/c to the same file c.yaml")))
+		})
+
+		It("should reject invalid templates", func() {
+			Expect(ValidateFileNameTemplate("{{ .Namespace }")).To(MatchError(ContainSubstring("invalid rule file name template")))
+			Expect(ValidateFileNameTemplate("{{ .Team }}")).To(MatchError(ContainSubstring("invalid rule file name template")))
+		})
+	})
+})
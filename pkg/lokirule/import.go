@@ -0,0 +1,211 @@
+package lokirule
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+// PrometheusRuleGroup is the API group of the prometheus-operator PrometheusRule.
+const PrometheusRuleGroup = "monitoring.coreos.com"
+
+var invalidObjectNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// ObjectName derives a valid object name from a rule file path, e.g.
+// "rules/fake/High_Errors.yaml" becomes "high-errors".
+func ObjectName(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	name = invalidObjectNameChars.ReplaceAllString(strings.ToLower(name), "-")
+
+	if len(name) > validation.DNS1123SubdomainMaxLength {
+		name = name[:validation.DNS1123SubdomainMaxLength]
+	}
+
+	return strings.Trim(name, "-.")
+}
+
+func formatDuration(d model.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// FromRuleGroups converts rule groups in the rule file format into a
+// LokiRule spec, the inverse of ToRuleGroups.
+func FromRuleGroups(ruleGroups RuleGroups) querocomv1alpha1.LokiRuleSpec {
+	spec := querocomv1alpha1.LokiRuleSpec{Groups: make([]querocomv1alpha1.RuleGroup, 0, len(ruleGroups.Groups))}
+
+	for _, group := range ruleGroups.Groups {
+		g := querocomv1alpha1.RuleGroup{
+			Name:          group.Name,
+			Interval:      formatDuration(group.Interval),
+			Limit:         group.Limit,
+			SourceTenants: append([]string(nil), group.SourceTenants...),
+			Rules:         make([]querocomv1alpha1.Rule, 0, len(group.Rules)),
+		}
+		if group.QueryOffset != nil {
+			g.QueryOffset = group.QueryOffset.String()
+		}
+
+		for _, rule := range group.Rules {
+			g.Rules = append(g.Rules, querocomv1alpha1.Rule{
+				Alert:         rule.Alert,
+				Record:        rule.Record,
+				Expr:          rule.Expr,
+				For:           formatDuration(rule.For),
+				KeepFiringFor: formatDuration(rule.KeepFiringFor),
+				Labels:        copyStringMap(rule.Labels),
+				Annotations:   copyStringMap(rule.Annotations),
+			})
+		}
+
+		spec.Groups = append(spec.Groups, g)
+	}
+
+	return spec
+}
+
+func newLokiRule(namespace, name string, ruleGroups RuleGroups) (*querocomv1alpha1.LokiRule, error) {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid name %q: %s", name, strings.Join(errs, ", "))
+	}
+
+	rule := &querocomv1alpha1.LokiRule{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: querocomv1alpha1.GroupVersion.String(),
+			Kind:       "LokiRule",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: FromRuleGroups(ruleGroups),
+	}
+
+	// Catch anything the operator would refuse before it reaches the cluster.
+	if _, err := GenerateRuleConfigMapFile(rule, Options{}); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+// ImportRuleFile converts a Loki or Prometheus rule file into a LokiRule in
+// namespace, named after the file by ObjectName.
+func ImportRuleFile(path string, content []byte, namespace string) (*querocomv1alpha1.LokiRule, error) {
+	ruleGroups := RuleGroups{}
+	if err := yaml.UnmarshalStrict(content, &ruleGroups); err != nil {
+		return nil, err
+	}
+
+	return newLokiRule(namespace, ObjectName(path), ruleGroups)
+}
+
+// prometheusRule holds the fields of a prometheus-operator PrometheusRule
+// needed to convert it, without depending on the prometheus-operator API.
+type prometheusRule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec struct {
+		Groups []struct {
+			Name        string `json:"name"`
+			Interval    string `json:"interval,omitempty"`
+			QueryOffset string `json:"query_offset,omitempty"`
+			Limit       int    `json:"limit,omitempty"`
+			Rules       []struct {
+				Record        string             `json:"record,omitempty"`
+				Alert         string             `json:"alert,omitempty"`
+				Expr          intstr.IntOrString `json:"expr"`
+				For           string             `json:"for,omitempty"`
+				KeepFiringFor string             `json:"keep_firing_for,omitempty"`
+				Labels        map[string]string  `json:"labels,omitempty"`
+				Annotations   map[string]string  `json:"annotations,omitempty"`
+			} `json:"rules"`
+		} `json:"groups,omitempty"`
+	} `json:"spec"`
+}
+
+func (p *prometheusRule) toRuleGroups() (RuleGroups, error) {
+	ruleGroups := RuleGroups{Groups: make([]RuleGroup, 0, len(p.Spec.Groups))}
+
+	for i, group := range p.Spec.Groups {
+		g := RuleGroup{Name: group.Name, Limit: group.Limit, Rules: make([]Rule, 0, len(group.Rules))}
+
+		var err error
+		if g.Interval, err = parseDuration("interval", group.Interval); err != nil {
+			return RuleGroups{}, fmt.Errorf("group %d (%q): %w", i, group.Name, err)
+		}
+		if group.QueryOffset != "" {
+			offset, err := parseDuration("query offset", group.QueryOffset)
+			if err != nil {
+				return RuleGroups{}, fmt.Errorf("group %d (%q): %w", i, group.Name, err)
+			}
+			g.QueryOffset = &offset
+		}
+
+		for j, rule := range group.Rules {
+			r := Rule{
+				Record:      rule.Record,
+				Alert:       rule.Alert,
+				Expr:        rule.Expr.String(),
+				Labels:      copyStringMap(rule.Labels),
+				Annotations: copyStringMap(rule.Annotations),
+			}
+			if r.For, err = parseDuration("for", rule.For); err != nil {
+				return RuleGroups{}, fmt.Errorf("group %d (%q): rule %d: %w", i, group.Name, j, err)
+			}
+			if r.KeepFiringFor, err = parseDuration("keep firing for", rule.KeepFiringFor); err != nil {
+				return RuleGroups{}, fmt.Errorf("group %d (%q): rule %d: %w", i, group.Name, j, err)
+			}
+			g.Rules = append(g.Rules, r)
+		}
+
+		ruleGroups.Groups = append(ruleGroups.Groups, g)
+	}
+
+	return ruleGroups, nil
+}
+
+// ImportPrometheusRule converts a PrometheusRule manifest whose expressions
+// are LogQL into a LokiRule with the same name, namespace and labels.
+// PrometheusRules without a namespace are given defaultNamespace.
+func ImportPrometheusRule(content []byte, defaultNamespace string) (*querocomv1alpha1.LokiRule, error) {
+	promRule := &prometheusRule{}
+	if err := sigsyaml.Unmarshal(content, promRule); err != nil {
+		return nil, err
+	}
+
+	gvk := promRule.GroupVersionKind()
+	if gvk.Group != PrometheusRuleGroup || gvk.Kind != "PrometheusRule" {
+		return nil, fmt.Errorf("expected a PrometheusRule, got %s", gvk)
+	}
+
+	ruleGroups, err := promRule.toRuleGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := promRule.Namespace
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+
+	rule, err := newLokiRule(namespace, promRule.Name, ruleGroups)
+	if err != nil {
+		return nil, err
+	}
+	rule.Labels = copyStringMap(promRule.Labels)
+
+	return rule, nil
+}
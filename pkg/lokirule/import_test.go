@@ -0,0 +1,115 @@
+package lokirule
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"gopkg.in/yaml.v2"
+)
+
+const ruleFile = `groups:
+- name: errors
+  interval: 1m30s
+  query_offset: 0s
+  limit: 10
+  rules:
+  - record: app:errors:rate1m
+    expr: sum by (app) (rate({app="api"} |= "error" [1m]))
+    labels:
+      team: a
+  - alert: HighErrorRate
+    expr: app:errors:rate1m > 10
+    for: 5m
+    keep_firing_for: 10m
+    annotations:
+      summary: '{{ $labels.app }} errors'
+`
+
+var _ = Describe("Import", func() {
+	Describe("ObjectName", func() {
+		It("should derive a valid object name from the file name", func() {
+			Expect(ObjectName("rules/fake/High_Errors.yaml")).To(Equal("high-errors"))
+			Expect(ObjectName("_app.rules.yml")).To(Equal("app.rules"))
+		})
+	})
+
+	Describe("ImportRuleFile", func() {
+		It("should preserve the groups and render the same rule file", func() {
+			rule, err := ImportRuleFile("rules/fake/errors.yaml", []byte(ruleFile), "team-a")
+			Expect(err).To(BeNil())
+
+			Expect(rule.Kind).To(Equal("LokiRule"))
+			Expect(rule.Namespace).To(Equal("team-a"))
+			Expect(rule.Name).To(Equal("errors"))
+			Expect(rule.Spec.Groups[0].Interval).To(Equal("1m30s"))
+			Expect(rule.Spec.Groups[0].QueryOffset).To(Equal("0s"))
+			Expect(rule.Spec.Groups[0].Rules[0].Labels).To(Equal(map[string]string{"team": "a"}))
+			Expect(rule.Spec.Groups[0].Rules[1].KeepFiringFor).To(Equal("10m"))
+
+			ruleGroups, err := ToRuleGroups(rule, Options{})
+			Expect(err).To(BeNil())
+
+			out, err := yaml.Marshal(ruleGroups)
+			Expect(err).To(BeNil())
+			Expect(string(out)).To(Equal(ruleFile))
+		})
+
+		It("should reject unknown fields and invalid rules", func() {
+			_, err := ImportRuleFile("errors.yaml", []byte("groups:\n- name: a\n  rulez: []\n"), "default")
+			Expect(err).ToNot(BeNil())
+
+			invalid := "groups:\n- name: a\n  rules:\n  - record: a\n    alert: b\n    expr: vector(1)\n"
+			_, err = ImportRuleFile("errors.yaml", []byte(invalid), "default")
+			Expect(err).To(MatchError(ContainSubstring("only one of 'record' and 'alert' must be set")))
+		})
+	})
+
+	Describe("ImportPrometheusRule", func() {
+		It("should keep the name, namespace and labels", func() {
+			manifest := `apiVersion: monitoring.coreos.com/v1
+kind: PrometheusRule
+metadata:
+  name: errors
+  labels:
+    team: a
+spec:
+  groups:
+  - name: errors
+    interval: 30s
+    rules:
+    - alert: HighErrorRate
+      expr: sum(rate({app="api"} |= "error" [1m])) > 10
+      for: 120m
+      labels:
+        severity: page
+`
+			rule, err := ImportPrometheusRule([]byte(manifest), "team-a")
+			Expect(err).To(BeNil())
+
+			Expect(rule.Namespace).To(Equal("team-a"))
+			Expect(rule.Name).To(Equal("errors"))
+			Expect(rule.Labels).To(Equal(map[string]string{"team": "a"}))
+			Expect(rule.Spec).To(Equal(querocomv1alpha1.LokiRuleSpec{
+				Groups: []querocomv1alpha1.RuleGroup{
+					{
+						Name:     "errors",
+						Interval: "30s",
+						Rules: []querocomv1alpha1.Rule{
+							{
+								Alert:  "HighErrorRate",
+								Expr:   `sum(rate({app="api"} |= "error" [1m])) > 10`,
+								For:    "2h",
+								Labels: map[string]string{"severity": "page"},
+							},
+						},
+					},
+				},
+			}))
+		})
+
+		It("should reject other kinds", func() {
+			_, err := ImportPrometheusRule([]byte("apiVersion: v1\nkind: ConfigMap\n"), "default")
+			Expect(err).To(MatchError(ContainSubstring("expected a PrometheusRule")))
+		})
+	})
+})
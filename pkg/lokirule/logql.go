@@ -0,0 +1,244 @@
+package lokirule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/grafana/dskit/user"
+	"github.com/grafana/loki/v3/pkg/iter"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logql"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// ruleTestTenant is the tenant the rule tests query the LogQL engine as, which
+// requires one.
+const ruleTestTenant = "rule-test"
+
+// Stream is a log stream used as input of the LogQL evaluator.
+type Stream struct {
+	Labels  map[string]string
+	Entries []LogEntry
+}
+
+// LogEntry is a log line of a Stream. Its timestamp is an offset from the start
+// of the evaluation.
+type LogEntry struct {
+	Timestamp time.Duration
+	Line      string
+}
+
+// Sample is an element of the vector a LogQL metric query evaluates to.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+func (s Sample) String() string {
+	return fmt.Sprintf("%s => %s", toLabelSet(s.Labels), strconv.FormatFloat(s.Value, 'g', -1, 64))
+}
+
+func toLabelSet(lbls map[string]string) model.LabelSet {
+	set := make(model.LabelSet, len(lbls))
+	for k, v := range lbls {
+		set[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return set
+}
+
+// labelsKey returns a key identifying the label set.
+func labelsKey(lbls map[string]string) string {
+	return toLabelSet(lbls).String()
+}
+
+// evaluationTime returns the time of an offset from the start of the
+// evaluation.
+func evaluationTime(offset time.Duration) time.Time {
+	return time.Unix(0, 0).Add(offset)
+}
+
+// queriedStream is a Stream as the LogQL engine reads it.
+type queriedStream struct {
+	labels  labels.Labels
+	entries []logproto.Entry
+}
+
+// streamQuerier serves the input streams of a rule test to Loki's LogQL engine
+// the way the Loki queriers serve the stored streams.
+type streamQuerier struct {
+	streams []queriedStream
+}
+
+func newStreamQuerier(streams []Stream) *streamQuerier {
+	q := &streamQuerier{}
+	for _, stream := range streams {
+		s := queriedStream{labels: labels.FromMap(stream.Labels)}
+		for _, entry := range stream.Entries {
+			s.entries = append(s.entries, logproto.Entry{
+				Timestamp: evaluationTime(entry.Timestamp),
+				Line:      entry.Line,
+			})
+		}
+		sort.SliceStable(s.entries, func(i, j int) bool {
+			return s.entries[i].Timestamp.Before(s.entries[j].Timestamp)
+		})
+		q.streams = append(q.streams, s)
+	}
+	return q
+}
+
+func (q *streamQuerier) selectStreams(selector syntax.LogSelectorExpr) []queriedStream {
+	var selected []queriedStream
+
+outer:
+	for _, stream := range q.streams {
+		for _, matcher := range selector.Matchers() {
+			if !matcher.Matches(stream.labels.Get(matcher.Name)) {
+				continue outer
+			}
+		}
+		selected = append(selected, stream)
+	}
+
+	return selected
+}
+
+// SelectLogs is never called, as the rules are metric queries.
+func (q *streamQuerier) SelectLogs(context.Context, logql.SelectLogParams) (iter.EntryIterator, error) {
+	return nil, errors.New("log queries cannot be evaluated by rule tests")
+}
+
+func (q *streamQuerier) SelectSamples(_ context.Context, req logql.SelectSampleParams) (iter.SampleIterator, error) {
+	selector, err := req.LogSelector()
+	if err != nil {
+		return nil, err
+	}
+
+	expr, err := req.Expr()
+	if err != nil {
+		return nil, err
+	}
+
+	extractor, err := expr.Extractor()
+	if err != nil {
+		return nil, err
+	}
+
+	seriesByLabels := map[string]*logproto.Series{}
+	for _, stream := range q.selectStreams(selector) {
+		streamExtractor := extractor.ForStream(stream.labels)
+		for _, entry := range stream.entries {
+			value, lbls, ok := streamExtractor.Process(entry.Timestamp.UnixNano(), []byte(entry.Line))
+			if !ok {
+				continue
+			}
+
+			series, ok := seriesByLabels[lbls.String()]
+			if !ok {
+				series = &logproto.Series{Labels: lbls.String(), StreamHash: streamExtractor.BaseLabels().Hash()}
+				seriesByLabels[lbls.String()] = series
+			}
+			series.Samples = append(series.Samples, logproto.Sample{
+				Timestamp: entry.Timestamp.UnixNano(),
+				Value:     value,
+				Hash:      xxhash.Sum64String(entry.Line),
+			})
+		}
+	}
+
+	series := make([]logproto.Series, 0, len(seriesByLabels))
+	for _, s := range seriesByLabels {
+		sort.Sort(s)
+		series = append(series, *s)
+	}
+
+	return iter.NewTimeRangedSampleIterator(
+		iter.NewMultiSeriesIterator(series),
+		req.Start.UnixNano(),
+		req.End.UnixNano()+1,
+	), nil
+}
+
+// parseLogQL parses a LogQL metric query.
+func parseLogQL(query string) (syntax.SampleExpr, error) {
+	expr, err := syntax.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+
+	sampleExpr, ok := expr.(syntax.SampleExpr)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a metric query", query)
+	}
+
+	return sampleExpr, nil
+}
+
+// logqlEvaluator evaluates LogQL metric queries against the input streams of a
+// rule test with Loki's LogQL engine.
+type logqlEvaluator struct {
+	engine *logql.Engine
+}
+
+func newLogQLEvaluator(streams []Stream) *logqlEvaluator {
+	return &logqlEvaluator{
+		engine: logql.NewEngine(logql.EngineOpts{}, newStreamQuerier(streams), logql.NoLimits, nil),
+	}
+}
+
+// evaluate evaluates the LogQL metric query as an instant query at ts.
+func (e *logqlEvaluator) evaluate(query string, ts time.Duration) ([]Sample, error) {
+	if _, err := parseLogQL(query); err != nil {
+		return nil, err
+	}
+
+	at := evaluationTime(ts)
+	params, err := logql.NewLiteralParams(query, at, at, 0, 0, logproto.FORWARD, 0, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := user.InjectOrgID(context.Background(), ruleTestTenant)
+	result, err := e.engine.Query(params).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vector, ok := result.Data.(promql.Vector)
+	if !ok {
+		return nil, fmt.Errorf("query must evaluate to a vector, got a %s", result.Data.Type())
+	}
+
+	samples := make([]Sample, 0, len(vector))
+	for _, sample := range vector {
+		samples = append(samples, Sample{Labels: sample.Metric.Map(), Value: sample.F})
+	}
+
+	return samples, nil
+}
+
+// EvaluateLogQL evaluates the LogQL metric query against the streams at ts
+// with Loki's LogQL engine.
+func EvaluateLogQL(query string, streams []Stream, ts time.Duration) ([]Sample, error) {
+	return newLogQLEvaluator(streams).evaluate(query, ts)
+}
+
+// formatSamples formats samples in a stable order, for test failure messages.
+func formatSamples(samples []Sample) string {
+	formatted := make([]string, 0, len(samples))
+	for _, s := range samples {
+		formatted = append(formatted, s.String())
+	}
+	sort.Strings(formatted)
+
+	return "[" + strings.Join(formatted, ", ") + "]"
+}
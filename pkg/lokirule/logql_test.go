@@ -0,0 +1,130 @@
+package lokirule
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TestEvaluateLogQL", func() {
+	streams := []Stream{
+		{
+			Labels: map[string]string{"app": "api", "env": "prod"},
+			Entries: []LogEntry{
+				{Timestamp: 10 * time.Second, Line: `level=error status=500 msg="boom"`},
+				{Timestamp: 20 * time.Second, Line: `level=info status=200 msg="ok"`},
+				{Timestamp: 30 * time.Second, Line: `level=error status=503 msg="unavailable"`},
+				{Timestamp: 90 * time.Second, Line: `level=error status=500 msg="late"`},
+			},
+		},
+		{
+			Labels: map[string]string{"app": "web", "env": "prod"},
+			Entries: []LogEntry{
+				{Timestamp: 15 * time.Second, Line: `{"level":"error","request":{"status":404}}`},
+				{Timestamp: 25 * time.Second, Line: `not json`},
+			},
+		},
+	}
+
+	DescribeTable("should evaluate the query",
+		func(query string, expected []Sample) {
+			samples, err := EvaluateLogQL(query, streams, time.Minute)
+			Expect(err).To(BeNil())
+			Expect(formatSamples(samples)).To(Equal(formatSamples(expected)))
+		},
+		Entry("count_over_time with a line filter",
+			`count_over_time({app="api"} |= "level=error" [1m])`,
+			[]Sample{{Labels: map[string]string{"app": "api", "env": "prod"}, Value: 2}},
+		),
+		Entry("rate with a negative regexp line filter",
+			`rate({env="prod"} !~ "level=(info|error)" [1m])`,
+			[]Sample{
+				{Labels: map[string]string{"app": "web", "env": "prod"}, Value: 2.0 / 60},
+			},
+		),
+		Entry("bytes_over_time with a regexp matcher",
+			`bytes_over_time({app=~"a.*"} |= "ok" [1m])`,
+			[]Sample{{Labels: map[string]string{"app": "api", "env": "prod"}, Value: 30}},
+		),
+		Entry("sum by with a logfmt label filter",
+			`sum by (app) (count_over_time({app="api"} | logfmt | status >= 500 [1m]))`,
+			[]Sample{{Labels: map[string]string{"app": "api"}, Value: 2}},
+		),
+		Entry("the json parser with nested fields",
+			`sum without (env) (count_over_time({app="web"} | json | request_status = "404" [1m]))`,
+			[]Sample{{Labels: map[string]string{"app": "web", "level": "error", "request_status": "404"}, Value: 1}},
+		),
+		Entry("skipping parser errors",
+			`sum(count_over_time({app="web"} | json | __error__ = "" [1m]))`,
+			[]Sample{{Labels: map[string]string{}, Value: 1}},
+		),
+		Entry("a comparison with a scalar",
+			`sum by (app) (count_over_time({env="prod"}[1m])) > 2`,
+			[]Sample{{Labels: map[string]string{"app": "api"}, Value: 3}},
+		),
+		Entry("a comparison with the bool modifier",
+			`sum by (app) (count_over_time({env="prod"}[1m])) > bool 2`,
+			[]Sample{
+				{Labels: map[string]string{"app": "api"}, Value: 1},
+				{Labels: map[string]string{"app": "web"}, Value: 0},
+			},
+		),
+		Entry("a ratio between vectors",
+			`sum by (app) (count_over_time({env="prod"} |= "error" [1m])) / sum by (app) (count_over_time({env="prod"}[1m]))`,
+			[]Sample{
+				{Labels: map[string]string{"app": "api"}, Value: 2.0 / 3},
+				{Labels: map[string]string{"app": "web"}, Value: 0.5},
+			},
+		),
+		Entry("absent_over_time",
+			`absent_over_time({app="missing", env=~"prod"}[1m])`,
+			[]Sample{{Labels: map[string]string{"app": "missing"}, Value: 1}},
+		),
+		Entry("operator precedence",
+			`sum(count_over_time({app="api"}[1m])) * 2 + 1`,
+			[]Sample{{Labels: map[string]string{}, Value: 7}},
+		),
+		Entry("quantile_over_time with unwrap",
+			`quantile_over_time(0.5, {app="api"} | logfmt | unwrap status [1m]) by (app)`,
+			[]Sample{{Labels: map[string]string{"app": "api"}, Value: 500}},
+		),
+		Entry("topk",
+			`topk(1, sum by (app) (count_over_time({env="prod"}[1m])))`,
+			[]Sample{{Labels: map[string]string{"app": "api"}, Value: 3}},
+		),
+		Entry("line_format",
+			`sum by (app) (count_over_time({app="api"} | logfmt | line_format "{{.msg}}" |= "un" [1m]))`,
+			[]Sample{{Labels: map[string]string{"app": "api"}, Value: 1}},
+		),
+		Entry("offset",
+			`count_over_time({app="api"}[1m] offset 45s)`,
+			[]Sample{{Labels: map[string]string{"app": "api", "env": "prod"}, Value: 1}},
+		),
+		Entry("vector matching with on",
+			`sum by (app, env) (count_over_time({app="api"} |= "error" [1m])) / on (app) group_left `+
+				`sum by (app) (count_over_time({app="api"}[1m]))`,
+			[]Sample{{Labels: map[string]string{"app": "api", "env": "prod"}, Value: 2.0 / 3}},
+		),
+		Entry("a set operator",
+			`count_over_time({app="api"} |= "boom" [1m]) or count_over_time({app="web"} |= "json" [1m])`,
+			[]Sample{
+				{Labels: map[string]string{"app": "api", "env": "prod"}, Value: 1},
+				{Labels: map[string]string{"app": "web", "env": "prod"}, Value: 1},
+			},
+		),
+	)
+
+	DescribeTable("should reject invalid queries",
+		func(query string, expected string) {
+			_, err := EvaluateLogQL(query, streams, time.Minute)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(expected))
+		},
+		Entry("a log query", `{app="api"}`, "is not a metric query"),
+		Entry("a scalar", `1 + 1`, "got a scalar"),
+		Entry("an unknown function", `latest_over_time({app="api"}[1m])`, "syntax error"),
+		Entry("an empty selector", `count_over_time({app=~".*"}[1m])`, "at least one regexp or equality matcher"),
+		Entry("a missing range", `count_over_time({app="api"})`, "syntax error"),
+	)
+})
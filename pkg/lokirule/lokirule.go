@@ -1,16 +1,158 @@
 package lokirule
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 
+	"github.com/prometheus/common/model"
 	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
 	"gopkg.in/yaml.v2"
 )
 
-func GenerateRuleConfigMapFile(rule *querocomv1alpha1.LokiRule) (map[string]string, error) {
-	fileName := fmt.Sprintf("%s-%s.yaml", rule.Namespace, rule.Name)
+var invalidLabelNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
 
-	marshaledGroupData, err := yaml.Marshal(rule.Spec)
+// Options controls how a LokiRule is rendered into a rule file.
+type Options struct {
+	// NamespaceLabel, when set, is the label added to every rule holding the
+	// namespace of the LokiRule it was generated from.
+	NamespaceLabel string
+	// NameLabel, when set, is the label added to every rule holding the name
+	// of the LokiRule it was generated from.
+	NameLabel string
+	// CopyLabels lists metadata label keys of the LokiRule copied into every
+	// rule. Keys are sanitized into valid label names (e.g. "app.kubernetes.io/team"
+	// becomes "app_kubernetes_io_team").
+	CopyLabels []string
+	// FileNameTemplate is the text/template rendering the rules ConfigMap key
+	// of the rule file from the LokiRule .Namespace, .Name and .Hash, defaults
+	// to DefaultFileNameTemplate.
+	FileNameTemplate string
+}
+
+// ValidateOwnerLabels checks that the labels identifying the LokiRule of a
+// rule are valid label names, as the ruler rejects a rule file holding an
+// invalid one. Empty labels are disabled.
+func ValidateOwnerLabels(namespaceLabel, nameLabel string) error {
+	var errs []error
+
+	labels := []struct{ field, name string }{{"namespace", namespaceLabel}, {"name", nameLabel}}
+	for _, label := range labels {
+		if label.name == "" {
+			continue
+		}
+		if !model.LabelName(label.name).IsValid() || strings.HasPrefix(label.name, "__") {
+			errs = append(errs, fmt.Errorf("invalid %s label name %q", label.field, label.name))
+		}
+	}
+
+	if namespaceLabel != "" && namespaceLabel == nameLabel {
+		errs = append(errs, fmt.Errorf("the namespace and name labels are both %q", namespaceLabel))
+	}
+
+	return errors.Join(errs...)
+}
+
+// sanitizeLabelName turns a metadata label key into a valid label name: the
+// invalid characters are replaced with underscores, a leading digit is
+// prefixed with one and the "__" prefix reserved for internal labels is
+// reduced to a single underscore.
+func sanitizeLabelName(name string) string {
+	name = invalidLabelNameChars.ReplaceAllString(name, "_")
+
+	if strings.HasPrefix(name, "__") {
+		name = "_" + strings.TrimLeft(name, "_")
+	}
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// ownerLabels returns the labels copied from the LokiRule metadata and the
+// labels identifying the LokiRule. Copied labels never override labels set on
+// the rule itself, while the identifying labels always do, so a rule cannot
+// claim to belong to another namespace.
+func ownerLabels(rule *querocomv1alpha1.LokiRule, options Options) (map[string]string, map[string]string) {
+	copied := map[string]string{}
+	for _, key := range options.CopyLabels {
+		if value, ok := rule.Labels[key]; ok {
+			copied[sanitizeLabelName(key)] = value
+		}
+	}
+
+	identifying := map[string]string{}
+	if options.NamespaceLabel != "" {
+		identifying[options.NamespaceLabel] = rule.Namespace
+	}
+	if options.NameLabel != "" {
+		identifying[options.NameLabel] = rule.Name
+	}
+
+	return copied, identifying
+}
+
+func addOwnerLabels(ruleGroups *RuleGroups, copied, identifying map[string]string) {
+	if len(copied) == 0 && len(identifying) == 0 {
+		return
+	}
+
+	for i := range ruleGroups.Groups {
+		for j := range ruleGroups.Groups[i].Rules {
+			rule := &ruleGroups.Groups[i].Rules[j]
+
+			labels := make(map[string]string, len(copied)+len(rule.Labels)+len(identifying))
+			for k, v := range copied {
+				labels[k] = v
+			}
+			for k, v := range rule.Labels {
+				labels[k] = v
+			}
+			for k, v := range identifying {
+				labels[k] = v
+			}
+
+			rule.Labels = labels
+		}
+	}
+}
+
+// SpecHash returns the hex encoded SHA-256 of the LokiRule spec, identifying
+// the version of the rules regardless of the object metadata.
+func SpecHash(rule *querocomv1alpha1.LokiRule) (string, error) {
+	spec, err := json.Marshal(rule.Spec)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(spec)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// GenerateRuleConfigMapFile renders the LokiRule into a rule file, keyed by
+// its file name. The rule file is validated the way the Loki ruler does when
+// loading it, so an invalid LokiRule never reaches the rules ConfigMap.
+func GenerateRuleConfigMapFile(rule *querocomv1alpha1.LokiRule, options Options) (map[string]string, error) {
+	fileName, err := RuleFileName(rule, options)
+	if err != nil {
+		return nil, err
+	}
+
+	ruleGroups, err := ToRuleGroups(rule, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ruleGroups.Validate(); err != nil {
+		return nil, err
+	}
+
+	marshaledGroupData, err := yaml.Marshal(ruleGroups)
 	if err != nil {
 		return nil, err
 	}
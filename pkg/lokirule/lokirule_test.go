@@ -6,6 +6,7 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/common/model"
 	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
 	"gopkg.in/yaml.v2"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -38,7 +39,7 @@ var _ = Describe("TestGenerateRuleConfigMapFile", func() {
 			},
 		}
 
-		expectedParsedFileName := "test-namespace-test-rule.yaml"
+		expectedParsedFileName := "test-namespace_test-rule.yaml"
 		expectedParsedYamlContent := map[string][]map[interface{}]interface{}{
 			"groups": {
 				{
@@ -53,7 +54,7 @@ var _ = Describe("TestGenerateRuleConfigMapFile", func() {
 			},
 		}
 
-		ruleFile, err := GenerateRuleConfigMapFile(rule)
+		ruleFile, err := GenerateRuleConfigMapFile(rule, Options{})
 		Expect(err).To(BeNil())
 
 		parsedKeys := []string{}
@@ -81,4 +82,183 @@ var _ = Describe("TestGenerateRuleConfigMapFile", func() {
 
 		Expect(reflect.DeepEqual(parsedRuleFileContent, expectedParsedYamlContent)).To(BeTrue())
 	})
+
+	It("should render the rule group fields", func() {
+		rule := &querocomv1alpha1.LokiRule{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-rule",
+				Namespace: "test-namespace",
+			},
+			Spec: querocomv1alpha1.LokiRuleSpec{
+				Groups: []querocomv1alpha1.RuleGroup{
+					{
+						Name:          "test-group",
+						Interval:      "1m",
+						Limit:         10,
+						QueryOffset:   "30s",
+						SourceTenants: []string{"tenant-a", "tenant-b"},
+						Rules: []querocomv1alpha1.Rule{
+							{
+								Record: "test_record",
+								Expr:   "test_expr",
+							},
+						},
+					},
+				},
+			},
+		}
+
+		ruleFile, err := GenerateRuleConfigMapFile(rule, Options{})
+		Expect(err).To(BeNil())
+
+		parsedRuleFileContent := map[string][]map[string]interface{}{}
+		err = yaml.Unmarshal([]byte(ruleFile["test-namespace_test-rule.yaml"]), &parsedRuleFileContent)
+		Expect(err).To(BeNil())
+
+		group := parsedRuleFileContent["groups"][0]
+		Expect(group).To(HaveKeyWithValue("interval", "1m"))
+		Expect(group).To(HaveKeyWithValue("limit", 10))
+		Expect(group).To(HaveKeyWithValue("query_offset", "30s"))
+		Expect(group).To(HaveKeyWithValue("source_tenants", []interface{}{"tenant-a", "tenant-b"}))
+	})
+
+	Context("With owner labels", func() {
+		var rule *querocomv1alpha1.LokiRule
+
+		BeforeEach(func() {
+			rule = &querocomv1alpha1.LokiRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-rule",
+					Namespace: "test-namespace",
+					Labels: map[string]string{
+						"app.kubernetes.io/team": "observability",
+						"unrelated":              "ignored",
+					},
+				},
+				Spec: querocomv1alpha1.LokiRuleSpec{
+					Groups: []querocomv1alpha1.RuleGroup{
+						{
+							Name: "test-group",
+							Rules: []querocomv1alpha1.Rule{
+								{
+									Alert: "test_alert",
+									Expr:  "test_expr",
+									Labels: map[string]string{
+										"severity":               "page",
+										"app_kubernetes_io_team": "overridden",
+										"lokirule_namespace":     "spoofed",
+									},
+								},
+								{
+									Record: "test_record",
+									Expr:   "test_expr",
+								},
+							},
+						},
+					},
+				},
+			}
+		})
+
+		It("should merge the owner labels into every rule", func() {
+			options := Options{
+				NamespaceLabel: "lokirule_namespace",
+				NameLabel:      "lokirule_name",
+				CopyLabels:     []string{"app.kubernetes.io/team", "missing"},
+			}
+
+			ruleFile, err := GenerateRuleConfigMapFile(rule, options)
+			Expect(err).To(BeNil())
+
+			parsedRuleFile := querocomv1alpha1.LokiRuleSpec{}
+			err = yaml.Unmarshal([]byte(ruleFile["test-namespace_test-rule.yaml"]), &parsedRuleFile)
+			Expect(err).To(BeNil())
+
+			rules := parsedRuleFile.Groups[0].Rules
+			Expect(rules[0].Labels).To(Equal(map[string]string{
+				"severity":               "page",
+				"app_kubernetes_io_team": "overridden",
+				"lokirule_namespace":     "test-namespace",
+				"lokirule_name":          "test-rule",
+			}))
+			Expect(rules[1].Labels).To(Equal(map[string]string{
+				"app_kubernetes_io_team": "observability",
+				"lokirule_namespace":     "test-namespace",
+				"lokirule_name":          "test-rule",
+			}))
+		})
+
+		It("should not modify the LokiRule", func() {
+			_, err := GenerateRuleConfigMapFile(rule, Options{NamespaceLabel: "lokirule_namespace"})
+			Expect(err).To(BeNil())
+
+			Expect(rule.Spec.Groups[0].Rules[0].Labels).To(HaveKeyWithValue("lokirule_namespace", "spoofed"))
+			Expect(rule.Spec.Groups[0].Rules[1].Labels).To(BeNil())
+		})
+	})
+})
+
+var _ = Describe("sanitizeLabelName", func() {
+	DescribeTable("should turn metadata label keys into valid label names",
+		func(key string, expected string) {
+			name := sanitizeLabelName(key)
+			Expect(name).To(Equal(expected))
+			Expect(model.LabelName(name).IsValid()).To(BeTrue())
+			Expect(name).NotTo(HavePrefix("__"))
+		},
+		Entry("valid label name", "team", "team"),
+		Entry("prefixed key", "app.kubernetes.io/team", "app_kubernetes_io_team"),
+		Entry("leading digit", "1password.com/vault", "_1password_com_vault"),
+		Entry("reserved prefix", "__name__", "_name__"),
+		Entry("reserved prefix after sanitizing", "_.team", "_team"),
+		Entry("only underscores", "__", "_"),
+	)
+})
+
+var _ = Describe("TestSpecHash", func() {
+	newRule := func(expr string) *querocomv1alpha1.LokiRule {
+		return &querocomv1alpha1.LokiRule{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-rule", Namespace: "test-namespace"},
+			Spec: querocomv1alpha1.LokiRuleSpec{
+				Groups: []querocomv1alpha1.RuleGroup{
+					{
+						Name:  "test-group",
+						Rules: []querocomv1alpha1.Rule{{Record: "test_record", Expr: expr}},
+					},
+				},
+			},
+		}
+	}
+
+	It("should only depend on the spec", func() {
+		rule := newRule("test_expr")
+		hash, err := SpecHash(rule)
+		Expect(err).To(BeNil())
+		Expect(hash).To(HaveLen(64))
+
+		rule.Generation = 7
+		rule.Labels = map[string]string{"team": "a"}
+		sameHash, err := SpecHash(rule)
+		Expect(err).To(BeNil())
+		Expect(sameHash).To(Equal(hash))
+
+		otherHash, err := SpecHash(newRule("other_expr"))
+		Expect(err).To(BeNil())
+		Expect(otherHash).NotTo(Equal(hash))
+	})
+})
+
+var _ = Describe("TestValidateOwnerLabels", func() {
+	It("should accept valid or disabled labels", func() {
+		Expect(ValidateOwnerLabels("lokirule_namespace", "lokirule_name")).To(Succeed())
+		Expect(ValidateOwnerLabels("", "")).To(Succeed())
+	})
+
+	It("should reject invalid, reserved and duplicate labels", func() {
+		Expect(ValidateOwnerLabels("lokirule-namespace", "")).
+			To(MatchError(ContainSubstring(`invalid namespace label name "lokirule-namespace"`)))
+		Expect(ValidateOwnerLabels("", "__name__")).To(MatchError(ContainSubstring(`invalid name label name "__name__"`)))
+		Expect(ValidateOwnerLabels("lokirule", "lokirule")).
+			To(MatchError(ContainSubstring(`the namespace and name labels are both "lokirule"`)))
+	})
 })
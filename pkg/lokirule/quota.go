@@ -0,0 +1,117 @@
+package lokirule
+
+import (
+	"fmt"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	QuotaScopeObject    = "object"
+	QuotaScopeNamespace = "namespace"
+)
+
+// Quota limits how much may be added to the rules ConfigMap. A zero value
+// disables the corresponding limit.
+type Quota struct {
+	MaxRules  int
+	MaxGroups int
+	MaxBytes  int
+}
+
+// Quotas holds the limits applied to every single LokiRule and to the sum of
+// all LokiRules of a namespace.
+type Quotas struct {
+	PerObject    Quota
+	PerNamespace Quota
+}
+
+// Usage is what a LokiRule, or a set of LokiRules, adds to the rules ConfigMap.
+type Usage struct {
+	Rules  int
+	Groups int
+	Bytes  int
+}
+
+type QuotaExceededError struct {
+	Scope    string
+	Resource string
+	Used     int
+	Limit    int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s quota exceeded: %d %s used, limit is %d", e.Scope, e.Used, e.Resource, e.Limit)
+}
+
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		Rules:  u.Rules + other.Rules,
+		Groups: u.Groups + other.Groups,
+		Bytes:  u.Bytes + other.Bytes,
+	}
+}
+
+// UsageOf returns the usage of a LokiRule given its rendered rule file.
+func UsageOf(rule *querocomv1alpha1.LokiRule, ruleFile map[string]string) Usage {
+	usage := Usage{Groups: len(rule.Spec.Groups)}
+
+	for _, group := range rule.Spec.Groups {
+		usage.Rules += len(group.Rules)
+	}
+
+	for _, content := range ruleFile {
+		usage.Bytes += len(content)
+	}
+
+	return usage
+}
+
+// UsageOfRuleFiles returns the usage of rule files as written to the rules
+// ConfigMap. Only the bytes of a rule file that cannot be parsed are counted.
+func UsageOfRuleFiles(ruleFiles map[string]string) Usage {
+	usage := Usage{}
+
+	for _, content := range ruleFiles {
+		usage.Bytes += len(content)
+
+		var ruleGroups RuleGroups
+		if err := yaml.Unmarshal([]byte(content), &ruleGroups); err != nil {
+			continue
+		}
+
+		usage.Groups += len(ruleGroups.Groups)
+		for _, group := range ruleGroups.Groups {
+			usage.Rules += len(group.Rules)
+		}
+	}
+
+	return usage
+}
+
+// Check returns a *QuotaExceededError for the first limit exceeded by usage.
+func (q Quota) Check(scope string, usage Usage) error {
+	checks := []struct {
+		resource string
+		used     int
+		limit    int
+	}{
+		{"rules", usage.Rules, q.MaxRules},
+		{"groups", usage.Groups, q.MaxGroups},
+		{"bytes", usage.Bytes, q.MaxBytes},
+	}
+
+	for _, c := range checks {
+		if c.limit > 0 && c.used > c.limit {
+			return &QuotaExceededError{Scope: scope, Resource: c.resource, Used: c.used, Limit: c.limit}
+		}
+	}
+
+	return nil
+}
+
+// IsEnabled reports whether any limit is set.
+func (q Quotas) IsEnabled() bool {
+	return q.PerObject != (Quota{}) || q.PerNamespace != (Quota{})
+}
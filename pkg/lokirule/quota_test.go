@@ -0,0 +1,82 @@
+package lokirule
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+)
+
+var _ = Describe("Quota", func() {
+	rule := &querocomv1alpha1.LokiRule{
+		Spec: querocomv1alpha1.LokiRuleSpec{
+			Groups: []querocomv1alpha1.RuleGroup{
+				{
+					Name: "group-1",
+					Rules: []querocomv1alpha1.Rule{
+						{Record: "record_1", Expr: "expr_1"},
+						{Record: "record_2", Expr: "expr_2"},
+					},
+				},
+				{
+					Name:  "group-2",
+					Rules: []querocomv1alpha1.Rule{{Record: "record_3", Expr: "expr_3"}},
+				},
+			},
+		},
+	}
+
+	Describe("UsageOf", func() {
+		It("should count the rules, groups and rendered bytes", func() {
+			usage := UsageOf(rule, map[string]string{"file.yaml": "0123456789"})
+			Expect(usage).To(Equal(Usage{Rules: 3, Groups: 2, Bytes: 10}))
+		})
+	})
+
+	Describe("UsageOfRuleFiles", func() {
+		It("should count the rules, groups and bytes of the rule files", func() {
+			ruleFiles, err := GenerateRuleConfigMapFile(rule, Options{})
+			Expect(err).NotTo(HaveOccurred())
+
+			usage := UsageOfRuleFiles(ruleFiles)
+			Expect(usage).To(Equal(UsageOf(rule, ruleFiles)))
+		})
+
+		It("should only count the bytes of a rule file that cannot be parsed", func() {
+			usage := UsageOfRuleFiles(map[string]string{"file.yaml": "groups: ["})
+			Expect(usage).To(Equal(Usage{Bytes: 9}))
+		})
+	})
+
+	Describe("Check", func() {
+		It("should accept usage within the limits", func() {
+			quota := Quota{MaxRules: 3, MaxGroups: 2, MaxBytes: 10}
+			Expect(quota.Check(QuotaScopeObject, Usage{Rules: 3, Groups: 2, Bytes: 10})).To(Succeed())
+		})
+
+		It("should ignore disabled limits", func() {
+			Expect(Quota{}.Check(QuotaScopeObject, Usage{Rules: 300, Groups: 200, Bytes: 1000})).To(Succeed())
+		})
+
+		It("should report the exceeded limit", func() {
+			quota := Quota{MaxRules: 3, MaxGroups: 1}
+			err := quota.Check(QuotaScopeNamespace, Usage{Rules: 3, Groups: 2})
+
+			quotaErr := &QuotaExceededError{}
+			Expect(err).To(BeAssignableToTypeOf(quotaErr))
+			Expect(err).To(Equal(&QuotaExceededError{
+				Scope:    QuotaScopeNamespace,
+				Resource: "groups",
+				Used:     2,
+				Limit:    1,
+			}))
+			Expect(err.Error()).To(Equal("namespace quota exceeded: 2 groups used, limit is 1"))
+		})
+	})
+
+	Describe("IsEnabled", func() {
+		It("should be disabled without limits", func() {
+			Expect(Quotas{}.IsEnabled()).To(BeFalse())
+			Expect(Quotas{PerNamespace: Quota{MaxBytes: 1}}.IsEnabled()).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,137 @@
+package lokirule
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+)
+
+// RuleGroups is the rule file format loaded by the Loki ruler, the Prometheus
+// rule file format extended with federated rule groups.
+type RuleGroups struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+// RuleGroup is a group of rules evaluated together, in the rule file format.
+type RuleGroup struct {
+	Name          string          `yaml:"name"`
+	Interval      model.Duration  `yaml:"interval,omitempty"`
+	QueryOffset   *model.Duration `yaml:"query_offset,omitempty"`
+	Limit         int             `yaml:"limit,omitempty"`
+	SourceTenants []string        `yaml:"source_tenants,omitempty"`
+	Rules         []Rule          `yaml:"rules"`
+}
+
+// Rule is an alerting or recording rule, in the rule file format.
+type Rule struct {
+	Record        string            `yaml:"record,omitempty"`
+	Alert         string            `yaml:"alert,omitempty"`
+	Expr          string            `yaml:"expr"`
+	For           model.Duration    `yaml:"for,omitempty"`
+	KeepFiringFor model.Duration    `yaml:"keep_firing_for,omitempty"`
+	Labels        map[string]string `yaml:"labels,omitempty"`
+	Annotations   map[string]string `yaml:"annotations,omitempty"`
+}
+
+func parseDuration(field string, value string) (model.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	duration, err := model.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", field, value, err)
+	}
+
+	return duration, nil
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return c
+}
+
+func toRule(rule querocomv1alpha1.Rule) (Rule, error) {
+	forDuration, err := parseDuration("for", rule.For)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	keepFiringFor, err := parseDuration("keep firing for", rule.KeepFiringFor)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	return Rule{
+		Record:        rule.Record,
+		Alert:         rule.Alert,
+		Expr:          rule.Expr,
+		For:           forDuration,
+		KeepFiringFor: keepFiringFor,
+		Labels:        copyStringMap(rule.Labels),
+		Annotations:   copyStringMap(rule.Annotations),
+	}, nil
+}
+
+func toRuleGroup(group querocomv1alpha1.RuleGroup) (RuleGroup, error) {
+	interval, err := parseDuration("interval", group.Interval)
+	if err != nil {
+		return RuleGroup{}, err
+	}
+
+	var queryOffset *model.Duration
+	if group.QueryOffset != "" {
+		offset, err := parseDuration("query offset", group.QueryOffset)
+		if err != nil {
+			return RuleGroup{}, err
+		}
+		queryOffset = &offset
+	}
+
+	ruleGroup := RuleGroup{
+		Name:          group.Name,
+		Interval:      interval,
+		QueryOffset:   queryOffset,
+		Limit:         group.Limit,
+		SourceTenants: append([]string(nil), group.SourceTenants...),
+		Rules:         make([]Rule, 0, len(group.Rules)),
+	}
+
+	for i, rule := range group.Rules {
+		r, err := toRule(rule)
+		if err != nil {
+			return RuleGroup{}, fmt.Errorf("rule %d: %w", i, err)
+		}
+		ruleGroup.Rules = append(ruleGroup.Rules, r)
+	}
+
+	return ruleGroup, nil
+}
+
+// ToRuleGroups converts a LokiRule into the rule file format, parsing and
+// normalizing its durations and adding the owner labels configured in options.
+func ToRuleGroups(rule *querocomv1alpha1.LokiRule, options Options) (RuleGroups, error) {
+	ruleGroups := RuleGroups{Groups: make([]RuleGroup, 0, len(rule.Spec.Groups))}
+
+	for i, group := range rule.Spec.Groups {
+		g, err := toRuleGroup(group)
+		if err != nil {
+			return RuleGroups{}, fmt.Errorf("group %d (%q): %w", i, group.Name, err)
+		}
+		ruleGroups.Groups = append(ruleGroups.Groups, g)
+	}
+
+	copied, identifying := ownerLabels(rule, options)
+	addOwnerLabels(&ruleGroups, copied, identifying)
+
+	return ruleGroups, nil
+}
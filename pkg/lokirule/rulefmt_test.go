@@ -0,0 +1,187 @@
+package lokirule
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/common/model"
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"gopkg.in/yaml.v2"
+)
+
+var _ = Describe("RuleFmt", func() {
+	Describe("ToRuleGroups", func() {
+		It("should parse and normalize durations", func() {
+			rule := &querocomv1alpha1.LokiRule{
+				Spec: querocomv1alpha1.LokiRuleSpec{
+					Groups: []querocomv1alpha1.RuleGroup{
+						{
+							Name:        "test-group",
+							Interval:    "90s",
+							QueryOffset: "0s",
+							Rules: []querocomv1alpha1.Rule{
+								{
+									Alert:         "TestAlert",
+									Expr:          "test_expr",
+									For:           "120m",
+									KeepFiringFor: "1h30m",
+								},
+							},
+						},
+					},
+				},
+			}
+
+			ruleGroups, err := ToRuleGroups(rule, Options{})
+			Expect(err).To(BeNil())
+
+			group := ruleGroups.Groups[0]
+			Expect(group.Interval).To(Equal(model.Duration(90 * time.Second)))
+			Expect(group.QueryOffset).ToNot(BeNil())
+			Expect(*group.QueryOffset).To(Equal(model.Duration(0)))
+			Expect(group.Rules[0].For).To(Equal(model.Duration(2 * time.Hour)))
+
+			out, err := yaml.Marshal(ruleGroups)
+			Expect(err).To(BeNil())
+			Expect(string(out)).To(Equal(`groups:
+- name: test-group
+  interval: 1m30s
+  query_offset: 0s
+  rules:
+  - alert: TestAlert
+    expr: test_expr
+    for: 2h
+    keep_firing_for: 1h30m
+`))
+		})
+
+		It("should reject invalid durations", func() {
+			rule := &querocomv1alpha1.LokiRule{
+				Spec: querocomv1alpha1.LokiRuleSpec{
+					Groups: []querocomv1alpha1.RuleGroup{
+						{
+							Name:  "test-group",
+							Rules: []querocomv1alpha1.Rule{{Alert: "TestAlert", Expr: "test_expr", For: "10 minutes"}},
+						},
+					},
+				},
+			}
+
+			_, err := ToRuleGroups(rule, Options{})
+			Expect(err).To(MatchError(ContainSubstring(`group 0 ("test-group"): rule 0: invalid for "10 minutes"`)))
+		})
+	})
+
+	Describe("Validate", func() {
+		DescribeTable("should reject rules Loki would fail to load",
+			func(rule Rule, expectedErr string) {
+				ruleGroups := RuleGroups{Groups: []RuleGroup{{Name: "test-group", Rules: []Rule{rule}}}}
+				Expect(ruleGroups.Validate()).To(MatchError(ContainSubstring(expectedErr)))
+			},
+			Entry("record and alert",
+				Rule{Record: "test_record", Alert: "TestAlert", Expr: "test_expr"},
+				"only one of 'record' and 'alert' must be set"),
+			Entry("neither record nor alert",
+				Rule{Expr: "test_expr"},
+				"one of 'record' or 'alert' must be set"),
+			Entry("missing expr",
+				Rule{Alert: "TestAlert"},
+				"field 'expr' must be set in rule"),
+			Entry("recording rule with annotations",
+				Rule{Record: "test_record", Expr: "test_expr", Annotations: map[string]string{"summary": "test"}},
+				"invalid field 'annotations' in recording rule"),
+			Entry("recording rule with for",
+				Rule{Record: "test_record", Expr: "test_expr", For: model.Duration(time.Minute)},
+				"invalid field 'for' in recording rule"),
+			Entry("recording rule with keep_firing_for",
+				Rule{Record: "test_record", Expr: "test_expr", KeepFiringFor: model.Duration(time.Minute)},
+				"invalid field 'keep_firing_for' in recording rule"),
+			Entry("invalid recording rule name",
+				Rule{Record: "test-record", Expr: "test_expr"},
+				"invalid recording rule name: test-record"),
+			Entry("invalid label name",
+				Rule{Alert: "TestAlert", Expr: "test_expr", Labels: map[string]string{"team.name": "test"}},
+				"invalid label name: team.name"),
+			Entry("reserved label name",
+				Rule{Alert: "TestAlert", Expr: "test_expr", Labels: map[string]string{"__name__": "test"}},
+				"invalid label name: __name__"),
+			Entry("invalid annotation name",
+				Rule{Alert: "TestAlert", Expr: "test_expr", Annotations: map[string]string{"0summary": "test"}},
+				"invalid annotation name: 0summary"),
+		)
+
+		It("should reject repeated and empty group names", func() {
+			rule := Rule{Record: "test_record", Expr: "test_expr"}
+			ruleGroups := RuleGroups{Groups: []RuleGroup{
+				{Name: "test-group", Rules: []Rule{rule}},
+				{Name: "test-group", Rules: []Rule{rule}},
+				{Name: "", Rules: []Rule{rule}},
+			}}
+
+			err := ruleGroups.Validate()
+			Expect(err).To(MatchError(ContainSubstring(`groupname: "test-group" is repeated in the same file`)))
+			Expect(err).To(MatchError(ContainSubstring("groupname must not be empty")))
+		})
+
+		It("should accept valid rules", func() {
+			ruleGroups := RuleGroups{Groups: []RuleGroup{{
+				Name: "test-group",
+				Rules: []Rule{
+					{Record: "job:test_record:rate5m", Expr: "test_expr", Labels: map[string]string{"team": "test"}},
+					{Record: "app:errors:count1m", Expr: `sum by (app) (count_over_time({app="api"} |= "error" [1m]))`},
+					{
+						Alert:       "TestAlert",
+						Expr:        "test_expr",
+						For:         model.Duration(time.Minute),
+						Annotations: map[string]string{"summary": "{{ $labels.job }} is down"},
+					},
+				},
+			}}}
+
+			Expect(ruleGroups.Validate()).To(Succeed())
+		})
+	})
+})
+
+var _ = Describe("Templates", func() {
+	It("should accept valid alert templates", func() {
+		rule := Rule{
+			Alert: "TestAlert",
+			Expr:  "test_expr",
+			Labels: map[string]string{
+				"instance": "{{ $labels.instance | toUpper }}",
+			},
+			Annotations: map[string]string{
+				"summary":     "{{ $labels.job }} is at {{ $value | humanizePercentage }}",
+				"description": `{{ range $k, $v := $labels }}{{ $k }}={{ $v }} {{ end }}{{ $externalURL }}`,
+			},
+		}
+
+		Expect(rule.Validate()).To(Succeed())
+	})
+
+	It("should reject invalid alert templates", func() {
+		rule := Rule{
+			Alert:       "TestAlert",
+			Expr:        "test_expr",
+			Labels:      map[string]string{"instance": "{{ $labels.instance "},
+			Annotations: map[string]string{"summary": "{{ unknownFunc $value }}"},
+		}
+
+		err := rule.Validate()
+		Expect(err).To(MatchError(ContainSubstring(`label "instance": template: __alert_TestAlert`)))
+		Expect(err).To(MatchError(ContainSubstring(`annotation "summary": template: __alert_TestAlert`)))
+		Expect(err).To(MatchError(ContainSubstring(`function "unknownFunc" not defined`)))
+	})
+
+	It("should not parse recording rule labels as templates", func() {
+		rule := Rule{
+			Record: "test_record",
+			Expr:   "test_expr",
+			Labels: map[string]string{"instance": "{{ not a template"},
+		}
+
+		Expect(rule.Validate()).To(Succeed())
+	})
+})
@@ -0,0 +1,439 @@
+package lokirule
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+)
+
+// DefaultEvaluationInterval is the evaluation interval of rule groups without
+// an interval when the test does not set one.
+const DefaultEvaluationInterval = time.Minute
+
+// RuleTest is a unit test of the rules of a LokiRule, in the spirit of
+// promtool test rules: the rules are evaluated against synthetic log streams
+// and the alerts firing and samples recorded are compared with the expected
+// ones.
+type RuleTest struct {
+	EvaluationInterval time.Duration
+	Streams            []Stream
+	AlertTests         []AlertTest
+	RecordTests        []RecordTest
+}
+
+// AlertTest checks the alerts of an alerting rule firing at EvalTime.
+type AlertTest struct {
+	EvalTime       time.Duration
+	Alertname      string
+	ExpectedAlerts []Alert
+}
+
+// Alert is a firing alert, with its labels and expanded annotations.
+type Alert struct {
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("{labels: %s, annotations: %s}", toLabelSet(a.Labels), toLabelSet(a.Annotations))
+}
+
+// RecordTest checks the samples of a recording rule recorded at EvalTime.
+type RecordTest struct {
+	EvalTime        time.Duration
+	Record          string
+	ExpectedSamples []Sample
+}
+
+func parseTestDuration(field string, value string) (time.Duration, error) {
+	duration, err := parseDuration(field, value)
+	return time.Duration(duration), err
+}
+
+func toStream(stream querocomv1alpha1.InputStream) (Stream, error) {
+	s := Stream{Labels: copyStringMap(stream.Labels)}
+
+	for i, entry := range stream.Entries {
+		at, err := parseTestDuration("at", entry.At)
+		if err != nil {
+			return Stream{}, fmt.Errorf("entry %d: %w", i, err)
+		}
+
+		interval, err := parseTestDuration("interval", entry.Interval)
+		if err != nil {
+			return Stream{}, fmt.Errorf("entry %d: %w", i, err)
+		}
+
+		if entry.Repeat > 0 && interval == 0 {
+			return Stream{}, fmt.Errorf("entry %d: interval must be set to repeat an entry", i)
+		}
+
+		for n := 0; n <= entry.Repeat; n++ {
+			s.Entries = append(s.Entries, LogEntry{
+				Timestamp: at + time.Duration(n)*interval,
+				Line:      entry.Line,
+			})
+		}
+	}
+
+	return s, nil
+}
+
+// ToRuleTest converts a LokiRuleTest, parsing its durations and values.
+func ToRuleTest(test *querocomv1alpha1.LokiRuleTest) (RuleTest, error) {
+	evaluationInterval, err := parseTestDuration("evaluation interval", test.Spec.EvaluationInterval)
+	if err != nil {
+		return RuleTest{}, err
+	}
+	if evaluationInterval == 0 {
+		evaluationInterval = DefaultEvaluationInterval
+	}
+
+	ruleTest := RuleTest{EvaluationInterval: evaluationInterval}
+
+	for i, stream := range test.Spec.InputStreams {
+		s, err := toStream(stream)
+		if err != nil {
+			return RuleTest{}, fmt.Errorf("input stream %d: %w", i, err)
+		}
+		ruleTest.Streams = append(ruleTest.Streams, s)
+	}
+
+	for i, alertTest := range test.Spec.AlertRuleTests {
+		evalTime, err := parseTestDuration("eval time", alertTest.EvalTime)
+		if err != nil {
+			return RuleTest{}, fmt.Errorf("alert rule test %d: %w", i, err)
+		}
+
+		t := AlertTest{EvalTime: evalTime, Alertname: alertTest.Alertname}
+		for _, alert := range alertTest.ExpAlerts {
+			t.ExpectedAlerts = append(t.ExpectedAlerts, Alert{
+				Labels:      copyStringMap(alert.ExpLabels),
+				Annotations: copyStringMap(alert.ExpAnnotations),
+			})
+		}
+		ruleTest.AlertTests = append(ruleTest.AlertTests, t)
+	}
+
+	for i, recordTest := range test.Spec.RecordingRuleTests {
+		evalTime, err := parseTestDuration("eval time", recordTest.EvalTime)
+		if err != nil {
+			return RuleTest{}, fmt.Errorf("recording rule test %d: %w", i, err)
+		}
+
+		t := RecordTest{EvalTime: evalTime, Record: recordTest.Record}
+		for j, sample := range recordTest.ExpSamples {
+			value, err := strconv.ParseFloat(sample.Value, 64)
+			if err != nil {
+				return RuleTest{}, fmt.Errorf("recording rule test %d: sample %d: invalid value %q", i, j, sample.Value)
+			}
+			t.ExpectedSamples = append(t.ExpectedSamples, Sample{Labels: copyStringMap(sample.Labels), Value: value})
+		}
+		ruleTest.RecordTests = append(ruleTest.RecordTests, t)
+	}
+
+	return ruleTest, nil
+}
+
+// testedRule is a rule with the timing of its group.
+type testedRule struct {
+	Rule
+	interval    time.Duration
+	queryOffset time.Duration
+}
+
+// lastEvaluation returns the time of the last evaluation of the rule at or
+// before evalTime.
+func (r testedRule) lastEvaluation(evalTime time.Duration) time.Duration {
+	return evalTime - evalTime%r.interval
+}
+
+func (t RuleTest) findRules(ruleGroups RuleGroups, match func(Rule) bool) ([]testedRule, error) {
+	var rules []testedRule
+
+	for _, group := range ruleGroups.Groups {
+		interval := time.Duration(group.Interval)
+		if interval == 0 {
+			interval = t.EvaluationInterval
+		}
+
+		var queryOffset time.Duration
+		if group.QueryOffset != nil {
+			queryOffset = time.Duration(*group.QueryOffset)
+		}
+
+		for _, rule := range group.Rules {
+			if !match(rule) {
+				continue
+			}
+
+			if _, err := parseLogQL(rule.Expr); err != nil {
+				return nil, fmt.Errorf("group %q: cannot evaluate %q: %w", group.Name, rule.Expr, err)
+			}
+
+			rules = append(rules, testedRule{Rule: rule, interval: interval, queryOffset: queryOffset})
+		}
+	}
+
+	return rules, nil
+}
+
+type alertState struct {
+	alert    Alert
+	activeAt time.Duration
+	lastSeen time.Duration
+	firing   bool
+}
+
+// firingAlerts evaluates the alerting rule at every evaluation until evalTime
+// and returns the alerts firing at the last one, honoring for and
+// keep_firing_for.
+func firingAlerts(evaluator *logqlEvaluator, rule testedRule, evalTime time.Duration) ([]Alert, error) {
+	active := map[string]*alertState{}
+
+	for ts := time.Duration(0); ts <= evalTime; ts += rule.interval {
+		samples, err := evaluator.evaluate(rule.Expr, ts-rule.queryOffset)
+		if err != nil {
+			return nil, fmt.Errorf("cannot evaluate %q at %s: %w", rule.Expr, ts, err)
+		}
+
+		seen := map[string]bool{}
+		for _, sample := range samples {
+			alert, err := newAlert(rule.Rule, sample, ts)
+			if err != nil {
+				return nil, err
+			}
+
+			key := labelsKey(alert.Labels)
+			seen[key] = true
+
+			state, ok := active[key]
+			if !ok {
+				state = &alertState{activeAt: ts}
+				active[key] = state
+			}
+			state.alert = alert
+			state.lastSeen = ts
+			state.firing = ts-state.activeAt >= time.Duration(rule.For)
+		}
+
+		for key, state := range active {
+			if seen[key] {
+				continue
+			}
+
+			if state.firing && ts-state.lastSeen < time.Duration(rule.KeepFiringFor) {
+				continue
+			}
+			delete(active, key)
+		}
+	}
+
+	var alerts []Alert
+	for _, state := range active {
+		if state.firing {
+			alerts = append(alerts, state.alert)
+		}
+	}
+
+	return alerts, nil
+}
+
+// newAlert builds the alert of a sample of the evaluation at ts the way the
+// ruler does: the sample labels, overridden by the expanded rule labels and
+// the alert name.
+func newAlert(rule Rule, sample Sample, ts time.Duration) (Alert, error) {
+	name := "__alert_" + rule.Alert
+
+	alert := Alert{
+		Labels:      copyStringMap(sample.Labels),
+		Annotations: map[string]string{},
+	}
+	if alert.Labels == nil {
+		alert.Labels = map[string]string{}
+	}
+
+	for k, v := range rule.Labels {
+		value, err := expandTemplate(name, v, sample.Labels, sample.Value, ts)
+		if err != nil {
+			return Alert{}, fmt.Errorf("label %q: %w", k, err)
+		}
+		alert.Labels[k] = value
+	}
+	alert.Labels["alertname"] = rule.Alert
+
+	for k, v := range rule.Annotations {
+		value, err := expandTemplate(name, v, sample.Labels, sample.Value, ts)
+		if err != nil {
+			return Alert{}, fmt.Errorf("annotation %q: %w", k, err)
+		}
+		alert.Annotations[k] = value
+	}
+
+	return alert, nil
+}
+
+func formatAlerts(alerts []Alert) string {
+	formatted := make([]string, 0, len(alerts))
+	for _, a := range alerts {
+		formatted = append(formatted, a.String())
+	}
+	sort.Strings(formatted)
+
+	return "[" + strings.Join(formatted, ", ") + "]"
+}
+
+func (t RuleTest) runAlertTest(evaluator *logqlEvaluator, ruleGroups RuleGroups, test AlertTest) error {
+	rules, err := t.findRules(ruleGroups, func(r Rule) bool { return r.Alert == test.Alertname })
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("alerting rule %q not found", test.Alertname)
+	}
+
+	var got []Alert
+	for _, rule := range rules {
+		alerts, err := firingAlerts(evaluator, rule, rule.lastEvaluation(test.EvalTime))
+		if err != nil {
+			return err
+		}
+		got = append(got, alerts...)
+	}
+
+	expected := make([]Alert, 0, len(test.ExpectedAlerts))
+	for _, alert := range test.ExpectedAlerts {
+		labels := copyStringMap(alert.Labels)
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels["alertname"] = test.Alertname
+
+		annotations := alert.Annotations
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		expected = append(expected, Alert{Labels: labels, Annotations: annotations})
+	}
+
+	if formatAlerts(expected) != formatAlerts(got) {
+		return fmt.Errorf(
+			"alertname: %s, time: %s,\n    exp: %s,\n    got: %s",
+			test.Alertname, test.EvalTime, formatAlerts(expected), formatAlerts(got),
+		)
+	}
+
+	return nil
+}
+
+func sameValue(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+
+	return a == b || math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func sameSamples(expected, got []Sample) bool {
+	if len(expected) != len(got) {
+		return false
+	}
+
+	gotByKey := make(map[string]float64, len(got))
+	for _, sample := range got {
+		gotByKey[labelsKey(sample.Labels)] = sample.Value
+	}
+
+	for _, sample := range expected {
+		value, ok := gotByKey[labelsKey(sample.Labels)]
+		if !ok || !sameValue(sample.Value, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t RuleTest) runRecordTest(evaluator *logqlEvaluator, ruleGroups RuleGroups, test RecordTest) error {
+	rules, err := t.findRules(ruleGroups, func(r Rule) bool { return r.Record == test.Record })
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("recording rule %q not found", test.Record)
+	}
+
+	var got []Sample
+	for _, rule := range rules {
+		ts := rule.lastEvaluation(test.EvalTime)
+		samples, err := evaluator.evaluate(rule.Expr, ts-rule.queryOffset)
+		if err != nil {
+			return fmt.Errorf("cannot evaluate %q at %s: %w", rule.Expr, ts, err)
+		}
+
+		for _, sample := range samples {
+			labels := copyStringMap(sample.Labels)
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			for k, v := range rule.Labels {
+				labels[k] = v
+			}
+			got = append(got, Sample{Labels: labels, Value: sample.Value})
+		}
+	}
+
+	if !sameSamples(test.ExpectedSamples, got) {
+		return fmt.Errorf(
+			"record: %s, time: %s,\n    exp: %s,\n    got: %s",
+			test.Record, test.EvalTime, formatSamples(test.ExpectedSamples), formatSamples(got),
+		)
+	}
+
+	return nil
+}
+
+// Run evaluates the rule groups and returns an error describing every failed
+// test, nil when all of them passed.
+func (t RuleTest) Run(ruleGroups RuleGroups) error {
+	evaluator := newLogQLEvaluator(t.Streams)
+	var errs []error
+
+	for _, test := range t.AlertTests {
+		if err := t.runAlertTest(evaluator, ruleGroups, test); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, test := range t.RecordTests {
+		if err := t.runRecordTest(evaluator, ruleGroups, test); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Failures splits the error returned by Run into one message per failed test.
+func Failures(err error) []string {
+	if err == nil {
+		return nil
+	}
+
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) {
+		return []string{err.Error()}
+	}
+
+	var failures []string
+	for _, e := range joined.Unwrap() {
+		failures = append(failures, e.Error())
+	}
+	return failures
+}
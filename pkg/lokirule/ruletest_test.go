@@ -0,0 +1,150 @@
+package lokirule
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("TestRuleTest", func() {
+	rule := &querocomv1alpha1.LokiRule{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-rule", Namespace: "test-namespace"},
+		Spec: querocomv1alpha1.LokiRuleSpec{
+			Groups: []querocomv1alpha1.RuleGroup{
+				{
+					Name: "test-group",
+					Rules: []querocomv1alpha1.Rule{
+						{
+							Alert: "HighErrorRate",
+							Expr:  `sum by (app) (count_over_time({app="api"} |= "error" [1m])) > 2`,
+							For:   "2m",
+							Labels: map[string]string{
+								"severity": "page",
+							},
+							Annotations: map[string]string{
+								"summary":     "{{ $labels.app }} logged {{ $value }} errors",
+								"description": "{{ $labels.app | toUpper }} at {{ $value | humanize1024 }} errors",
+							},
+						},
+						{
+							Record: "app:errors:count1m",
+							Expr:   `sum by (app) (count_over_time({app="api"} |= "error" [1m]))`,
+							Labels: map[string]string{"team": "a"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	newTest := func() *querocomv1alpha1.LokiRuleTest {
+		return &querocomv1alpha1.LokiRuleTest{
+			Spec: querocomv1alpha1.LokiRuleTestSpec{
+				LokiRuleName: "test-rule",
+				InputStreams: []querocomv1alpha1.InputStream{
+					{
+						Labels: map[string]string{"app": "api"},
+						Entries: []querocomv1alpha1.InputEntry{
+							{At: "5s", Line: "level=error", Repeat: 59, Interval: "10s"},
+						},
+					},
+				},
+				AlertRuleTests: []querocomv1alpha1.AlertRuleTest{
+					{EvalTime: "1m", Alertname: "HighErrorRate"},
+					{
+						EvalTime:  "4m30s",
+						Alertname: "HighErrorRate",
+						ExpAlerts: []querocomv1alpha1.ExpectedAlert{
+							{
+								ExpLabels: map[string]string{"app": "api", "severity": "page"},
+								ExpAnnotations: map[string]string{
+									"summary":     "api logged 6 errors",
+									"description": "API at 6 errors",
+								},
+							},
+						},
+					},
+					{EvalTime: "12m", Alertname: "HighErrorRate"},
+				},
+				RecordingRuleTests: []querocomv1alpha1.RecordingRuleTest{
+					{
+						EvalTime: "3m",
+						Record:   "app:errors:count1m",
+						ExpSamples: []querocomv1alpha1.ExpectedSample{
+							{Labels: map[string]string{"app": "api", "team": "a"}, Value: "6"},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	run := func(test *querocomv1alpha1.LokiRuleTest) error {
+		ruleTest, err := ToRuleTest(test)
+		Expect(err).To(BeNil())
+
+		ruleGroups, err := ToRuleGroups(rule, Options{})
+		Expect(err).To(BeNil())
+
+		return ruleTest.Run(ruleGroups)
+	}
+
+	It("should pass when the rules behave as expected", func() {
+		Expect(run(newTest())).To(BeNil())
+	})
+
+	It("should report every failed test", func() {
+		test := newTest()
+		test.Spec.AlertRuleTests[0].EvalTime = "2m"
+		test.Spec.AlertRuleTests[0].ExpAlerts = test.Spec.AlertRuleTests[1].ExpAlerts
+		test.Spec.RecordingRuleTests[0].ExpSamples[0].Value = "5"
+		test.Spec.RecordingRuleTests = append(test.Spec.RecordingRuleTests, querocomv1alpha1.RecordingRuleTest{
+			EvalTime: "1m",
+			Record:   "missing",
+		})
+
+		failures := Failures(run(test))
+		Expect(failures).To(HaveLen(3))
+		Expect(failures[0]).To(ContainSubstring("alertname: HighErrorRate, time: 2m0s"))
+		Expect(failures[0]).To(ContainSubstring("got: []"))
+		Expect(failures[1]).To(ContainSubstring(`got: [{app="api", team="a"} => 6]`))
+		Expect(failures[2]).To(ContainSubstring(`recording rule "missing" not found`))
+	})
+
+	It("should keep alerts firing for keep_firing_for", func() {
+		withKeepFiringFor := rule.DeepCopy()
+		withKeepFiringFor.Spec.Groups[0].Rules[0].KeepFiringFor = "10m"
+
+		ruleTest, err := ToRuleTest(newTest())
+		Expect(err).To(BeNil())
+		ruleGroups, err := ToRuleGroups(withKeepFiringFor, Options{})
+		Expect(err).To(BeNil())
+
+		failures := Failures(ruleTest.Run(ruleGroups))
+		Expect(failures).To(HaveLen(1))
+		Expect(failures[0]).To(ContainSubstring("time: 12m0s"))
+	})
+
+	It("should report the templates that cannot be expanded without Loki", func() {
+		withQuery := rule.DeepCopy()
+		withQuery.Spec.Groups[0].Rules[0].Annotations["summary"] = `{{ query "up" }}`
+
+		ruleTest, err := ToRuleTest(newTest())
+		Expect(err).To(BeNil())
+		ruleGroups, err := ToRuleGroups(withQuery, Options{})
+		Expect(err).To(BeNil())
+
+		failures := Failures(ruleTest.Run(ruleGroups))
+		Expect(failures).NotTo(BeEmpty())
+		Expect(failures[0]).To(ContainSubstring("queries are not supported by rule tests"))
+	})
+
+	It("should reject invalid tests", func() {
+		test := newTest()
+		test.Spec.InputStreams[0].Entries[0].Interval = ""
+
+		_, err := ToRuleTest(test)
+		Expect(err).To(MatchError("input stream 0: entry 0: interval must be set to repeat an entry"))
+	})
+})
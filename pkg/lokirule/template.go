@@ -0,0 +1,45 @@
+package lokirule
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/template"
+)
+
+// templateDefs are the variables the ruler defines before expanding alert
+// labels and annotations.
+var templateDefs = []string{
+	"{{$labels := .Labels}}",
+	"{{$externalLabels := .ExternalLabels}}",
+	"{{$externalURL := .ExternalURL}}",
+	"{{$value := .Value}}",
+}
+
+// queryNotSupported is the query function of the templates expanded by rule
+// tests, which have no Loki to query.
+func queryNotSupported(_ context.Context, query string, _ time.Time) (promql.Vector, error) {
+	return nil, fmt.Errorf("query %q: queries are not supported by rule tests", query)
+}
+
+// expandTemplate expands an alert label or annotation template with the
+// Prometheus template expander, as the ruler does at the evaluation at ts.
+func expandTemplate(name string, text string, labels map[string]string, value float64, ts time.Duration) (string, error) {
+	expander := template.NewTemplateExpander(
+		context.Background(),
+		strings.Join(append(templateDefs, text), ""),
+		name,
+		template.AlertTemplateData(labels, map[string]string{}, "", value),
+		model.TimeFromUnixNano(evaluationTime(ts).UnixNano()),
+		queryNotSupported,
+		&url.URL{},
+		nil,
+	)
+
+	return expander.Expand()
+}
@@ -0,0 +1,98 @@
+package lokirule
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/rulefmt"
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+	"gopkg.in/yaml.v3"
+)
+
+// exprPlaceholder stands for the LogQL expression of a rule validated by
+// rulefmt, which parses expressions as PromQL. The LogQL expressions are
+// validated by Loki instead.
+const exprPlaceholder = "vector(0)"
+
+// Validate checks the rule with Prometheus rulefmt, the way the ruler does
+// when it loads a rule file, except for the expression which is LogQL.
+func (r Rule) Validate() error {
+	node := rulefmt.RuleNode{
+		Record:        yaml.Node{Kind: yaml.ScalarNode, Value: r.Record},
+		Alert:         yaml.Node{Kind: yaml.ScalarNode, Value: r.Alert},
+		Expr:          yaml.Node{Kind: yaml.ScalarNode},
+		For:           r.For,
+		KeepFiringFor: r.KeepFiringFor,
+		Labels:        r.Labels,
+		Annotations:   r.Annotations,
+	}
+	if r.Expr != "" {
+		node.Expr.Value = exprPlaceholder
+	}
+
+	var errs []error
+	for _, wrapped := range node.Validate() {
+		// the rule file is rendered, so the yaml positions are meaningless
+		errs = append(errs, errors.Unwrap(&wrapped))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the rule group and its rules.
+func (g RuleGroup) Validate() error {
+	var errs []error
+
+	if g.Name == "" {
+		errs = append(errs, fmt.Errorf("groupname must not be empty"))
+	}
+
+	if g.Limit < 0 {
+		errs = append(errs, fmt.Errorf("invalid limit %d: must not be negative", g.Limit))
+	}
+
+	for _, tenant := range g.SourceTenants {
+		if tenant == "" {
+			errs = append(errs, fmt.Errorf("invalid source tenant: must not be empty"))
+		}
+	}
+
+	for i, rule := range g.Rules {
+		if err := rule.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks every rule group and that group names are unique in the
+// rule file.
+func (g RuleGroups) Validate() error {
+	var errs []error
+
+	names := map[string]struct{}{}
+	for i, group := range g.Groups {
+		if _, ok := names[group.Name]; ok {
+			errs = append(errs, fmt.Errorf("groupname: %q is repeated in the same file", group.Name))
+		}
+		names[group.Name] = struct{}{}
+
+		if err := group.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("group %d (%q): %w", i, group.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks that the LokiRule can be rendered into a rule file Loki is
+// able to load.
+func Validate(rule *querocomv1alpha1.LokiRule) error {
+	ruleGroups, err := ToRuleGroups(rule, Options{})
+	if err != nil {
+		return err
+	}
+
+	return ruleGroups.Validate()
+}
@@ -0,0 +1,49 @@
+package lokirule
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	querocomv1alpha1 "github.com/quero-edu/loki-rule-operator/api/v1alpha1"
+)
+
+var _ = Describe("Validate", func() {
+	newRule := func(group querocomv1alpha1.RuleGroup) *querocomv1alpha1.LokiRule {
+		group.Name = "test-group"
+		group.Rules = []querocomv1alpha1.Rule{{Record: "test_record", Expr: "test_expr"}}
+
+		return &querocomv1alpha1.LokiRule{
+			Spec: querocomv1alpha1.LokiRuleSpec{Groups: []querocomv1alpha1.RuleGroup{group}},
+		}
+	}
+
+	It("should accept valid group fields", func() {
+		rule := newRule(querocomv1alpha1.RuleGroup{
+			Interval:      "1m30s",
+			Limit:         10,
+			QueryOffset:   "2m",
+			SourceTenants: []string{"tenant-a", "tenant-b"},
+		})
+
+		Expect(Validate(rule)).To(Succeed())
+	})
+
+	It("should reject an invalid interval", func() {
+		err := Validate(newRule(querocomv1alpha1.RuleGroup{Interval: "10 minutes"}))
+		Expect(err).To(MatchError(ContainSubstring(`group 0 ("test-group"): invalid interval "10 minutes"`)))
+	})
+
+	It("should reject an invalid query offset", func() {
+		err := Validate(newRule(querocomv1alpha1.RuleGroup{QueryOffset: "1.5h"}))
+		Expect(err).To(MatchError(ContainSubstring(`invalid query offset "1.5h"`)))
+	})
+
+	It("should reject a negative limit", func() {
+		err := Validate(newRule(querocomv1alpha1.RuleGroup{Limit: -1}))
+		Expect(err).To(MatchError(ContainSubstring("invalid limit -1")))
+	})
+
+	It("should reject an empty source tenant", func() {
+		err := Validate(newRule(querocomv1alpha1.RuleGroup{SourceTenants: []string{""}}))
+		Expect(err).To(MatchError(ContainSubstring("invalid source tenant")))
+	})
+})